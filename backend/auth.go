@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// --- Device Tokens ---
+// Devices that can't speak MQTT authenticate HTTP ingestion with a per-vehicle
+// bearer token. Tokens are random, so a plain SHA-256 is enough to avoid
+// storing them in clear text (bcrypt would cost too much on every sample).
+
+func hashDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueDeviceToken generates a new ingestion token for a vehicle, replacing any previous one.
+func issueDeviceToken(ctx context.Context, redisClient *redis.Client, vehicleID string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("could not generate token: %v", err)
+	}
+	token := hex.EncodeToString(buf)
+
+	key := fmt.Sprintf("device_token:%s", vehicleID)
+	hash := hashDeviceToken(token)
+	previous, _ := redisClient.Get(ctx, key).Result()
+	pipe := redisClient.TxPipeline()
+	pipe.Set(ctx, key, hash, 0)
+	pipe.Set(ctx, fmt.Sprintf("device_token_vehicle:%s", hash), vehicleID, 0)
+	if previous != "" {
+		pipe.Del(ctx, fmt.Sprintf("device_token_vehicle:%s", previous))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", fmt.Errorf("could not store token: %v", err)
+	}
+	return token, nil
+}
+
+// deviceTokenVehicle returns the vehicle a device token belongs to, so a
+// request can be authenticated before its payload is read.
+func deviceTokenVehicle(ctx context.Context, redisClient *redis.Client, token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	vehicleID, err := redisClient.Get(ctx, fmt.Sprintf("device_token_vehicle:%s", hashDeviceToken(token))).Result()
+	if err != nil {
+		return "", false
+	}
+	return vehicleID, verifyDeviceToken(ctx, redisClient, vehicleID, token) // Not rotated since
+}
+
+// verifyDeviceToken reports whether token is the current ingestion token for vehicleID.
+func verifyDeviceToken(ctx context.Context, redisClient *redis.Client, vehicleID, token string) bool {
+	if vehicleID == "" || token == "" {
+		return false
+	}
+	stored, err := redisClient.Get(ctx, fmt.Sprintf("device_token:%s", vehicleID)).Result()
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(hashDeviceToken(token))) == 1
+}
+
+// deviceTokenFromRequest reads the token from "Authorization: Bearer <token>" or "X-Device-Token".
+func deviceTokenFromRequest(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return c.GetHeader("X-Device-Token")
+}
+
+// --- Admin ---
+
+// requireAdmin guards operator-only routes with the ADMIN_API_KEY env var,
+// sent by clients in the "X-Admin-Key" header. Admin routes are disabled
+// when the variable is unset.
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminKey := os.Getenv("ADMIN_API_KEY")
+		if adminKey == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Admin API disabled"})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("X-Admin-Key")), []byte(adminKey)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin key"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// isAdminRequest reports whether the request carries the admin key, for
+// routes that devices and operators share.
+func isAdminRequest(c *gin.Context) bool {
+	adminKey := os.Getenv("ADMIN_API_KEY")
+	return adminKey != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader("X-Admin-Key")), []byte(adminKey)) == 1
+}
+
+// --- User Sessions ---
+// Login hands out a random bearer token for driver-facing routes. Like
+// device tokens, only its hash is stored; it maps back to the user's email.
+
+// issueSessionToken starts a SESSION_TTL session for the user with the given email.
+func issueSessionToken(ctx context.Context, redisClient *redis.Client, email string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("could not generate token: %v", err)
+	}
+	token := hex.EncodeToString(buf)
+
+	key := fmt.Sprintf("session:%s", hashDeviceToken(token))
+	if err := redisClient.Set(ctx, key, email, SESSION_TTL*time.Second).Err(); err != nil {
+		return "", fmt.Errorf("could not store session: %v", err)
+	}
+	return token, nil
+}
+
+// sessionUser returns the user a session token belongs to.
+func sessionUser(ctx context.Context, redisClient *redis.Client, token string) (User, bool) {
+	if token == "" {
+		return User{}, false
+	}
+	email, err := redisClient.Get(ctx, fmt.Sprintf("session:%s", hashDeviceToken(token))).Result()
+	if err != nil {
+		return User{}, false
+	}
+	val, err := redisClient.Get(ctx, "user:"+email).Result()
+	if err != nil {
+		return User{}, false
+	}
+	var user User
+	if json.Unmarshal([]byte(val), &user) != nil {
+		return User{}, false
+	}
+	return user, true
+}
+
+// requireSession guards driver routes with the "Authorization: Bearer <token>"
+// returned by /api/login. The signed-in user is available as "user".
+func requireSession(ctx context.Context, redisClient *redis.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+		user, ok := sessionUser(ctx, redisClient, token)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session"})
+			return
+		}
+		c.Set("user", user)
+		c.Next()
+	}
+}
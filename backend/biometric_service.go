@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// Biometric states, reported per sample and as biometric_status.
+const (
+	BiometricNoReading   = "no_reading"   // heart_rate 0 from a device without an active HR sensor
+	BiometricNormal      = "normal"       // Within the personal (or default) limits
+	BiometricSensorFault = "sensor_fault" // Dropout or an implausible reading, not a medical event
+	BiometricTachycardia = "tachycardia"
+	BiometricBradycardia = "bradycardia"
+)
+
+// HRBaseline is a driver's learned heart rate profile. Mean/StdDev track HR
+// while driving; RestingMean follows the lower half of the readings.
+type HRBaseline struct {
+	Mean        float64 `json:"mean"`
+	StdDev      float64 `json:"std_dev"`
+	RestingMean float64 `json:"resting_mean"`
+	Samples     int64   `json:"samples"`
+	Ready       bool    `json:"ready"` // Enough samples to use personal limits
+	High        float64 `json:"high"`  // Current tachycardia threshold
+	Low         float64 `json:"low"`   // Current bradycardia threshold
+}
+
+// BiometricAssessment is the verdict on one sample.
+type BiometricAssessment struct {
+	State    string     `json:"state"`
+	Critical bool       `json:"critical"` // Sustained anomaly: raise HEALTH_CRITICAL
+	Baseline HRBaseline `json:"baseline"`
+}
+
+// BiometricService learns per-driver heart rate baselines and flags
+// sustained tachycardia or bradycardia against them. Single-sample spikes,
+// dropouts and jumps no heart can make are treated as sensor faults.
+type BiometricService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewBiometricService creates a new BiometricService instance.
+func NewBiometricService(redisClient *redis.Client, ctx context.Context) *BiometricService {
+	return &BiometricService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Assess classifies the sample's heart rate and updates the baseline.
+func (b *BiometricService) Assess(data Telemetry) BiometricAssessment {
+	key := fmt.Sprintf("hr:%s", data.VehicleID)
+	device := deviceName(data)
+	state, err := b.redisClient.HGetAll(b.ctx, key).Result()
+	if err != nil {
+		log.Printf("Error getting HR state: %v", err)
+		return BiometricAssessment{State: BiometricNoReading}
+	}
+	num := func(field string) float64 {
+		v, _ := strconv.ParseFloat(state[field], 64)
+		return v
+	}
+	baseline := hrBaseline(num("mean"), num("var"), num("rest_mean"), int64(num("count")))
+	result := BiometricAssessment{State: BiometricNormal, Baseline: baseline}
+	update := map[string]interface{}{}
+
+	lastReadingAt := int64(num("last_hr_at:" + device))
+	hr := float64(data.HeartRate)
+
+	switch {
+	case data.HeartRate == 0:
+		// Most devices never send HR. Zeros only matter from a sensor that was
+		// working a moment ago.
+		result.State = BiometricNoReading
+		if lastReadingAt == 0 || data.Timestamp-lastReadingAt > HR_SENSOR_TIMEOUT {
+			return result
+		}
+		zeroSince := int64(num("zero_since:" + device))
+		if zeroSince == 0 {
+			update["zero_since:"+device] = data.Timestamp
+		} else if data.Timestamp-zeroSince >= HR_DROPOUT_SECONDS {
+			result.State = BiometricSensorFault
+			if state["dropout_reported:"+device] == "" {
+				b.reportFault(data, "dropout")
+				update["dropout_reported:"+device] = 1
+			}
+		}
+		if len(update) > 0 {
+			b.redisClient.HSet(b.ctx, key, update)
+		}
+		return result
+
+	case data.HeartRate < HR_MIN_PLAUSIBLE ||
+		(data.Timestamp-lastReadingAt <= 2 && math.Abs(hr-num("last_hr:"+device)) > HR_MAX_JUMP):
+		result.State = BiometricSensorFault
+		b.reportFault(data, "implausible")
+
+	case hr > baseline.High:
+		result.State = BiometricTachycardia
+	case hr < baseline.Low:
+		result.State = BiometricBradycardia
+	}
+
+	if result.State != BiometricSensorFault {
+		// Jumps are measured from the last good reading
+		update["last_hr:"+device] = data.HeartRate
+		update["last_hr_at:"+device] = data.Timestamp
+	}
+	b.redisClient.HDel(b.ctx, key, "zero_since:"+device, "dropout_reported:"+device)
+
+	switch result.State {
+	case BiometricNormal:
+		// Only normal readings teach the baseline, so an episode can't
+		// become the new normal.
+		mean, variance, rest := learnBaseline(num("mean"), num("var"), num("rest_mean"), int64(num("count")), hr)
+		update["mean"], update["var"], update["rest_mean"] = mean, variance, rest
+		update["count"] = int64(num("count")) + 1
+		update["abnormal"], update["abnormal_since"], update["abnormal_count"] = "", 0, 0
+	case BiometricTachycardia, BiometricBradycardia:
+		since, count := int64(num("abnormal_since")), int64(num("abnormal_count"))
+		if state["abnormal"] != result.State {
+			since, count = data.Timestamp, 0
+		}
+		count++
+		update["abnormal"], update["abnormal_since"], update["abnormal_count"] = result.State, since, count
+		if count >= HR_SUSTAIN_SAMPLES && data.Timestamp-since >= HR_SUSTAIN_SECONDS {
+			result.Critical = true
+			log.Printf("💓 Sustained %s for %s: %d bpm for %ds (limits %.0f-%.0f)", result.State, data.VehicleID, data.HeartRate, data.Timestamp-since, baseline.Low, baseline.High)
+		}
+	}
+
+	if len(update) == 0 {
+		return result
+	}
+	if err := b.redisClient.HSet(b.ctx, key, update).Err(); err != nil {
+		log.Printf("Failed to update HR state: %v", err)
+	}
+	return result
+}
+
+func (b *BiometricService) reportFault(data Telemetry, reason string) {
+	log.Printf("🩺 HR sensor fault for %s/%s (%s, %d bpm)", data.VehicleID, deviceName(data), reason, data.HeartRate)
+	b.redisClient.HIncrBy(b.ctx, fmt.Sprintf("hr_sensor_faults:%s", data.VehicleID), reason, 1)
+}
+
+// Baseline returns the learned baseline and sensor fault counts for a vehicle.
+func (b *BiometricService) Baseline(vehicleID string) (HRBaseline, map[string]int64, error) {
+	state, err := b.redisClient.HMGet(b.ctx, fmt.Sprintf("hr:%s", vehicleID), "mean", "var", "rest_mean", "count").Result()
+	if err != nil {
+		return HRBaseline{}, nil, err
+	}
+	var vals [4]float64
+	for i, v := range state {
+		if s, ok := v.(string); ok {
+			vals[i], _ = strconv.ParseFloat(s, 64)
+		}
+	}
+	faults, err := b.redisClient.HGetAll(b.ctx, fmt.Sprintf("hr_sensor_faults:%s", vehicleID)).Result()
+	if err != nil {
+		return HRBaseline{}, nil, err
+	}
+	return hrBaseline(vals[0], vals[1], vals[2], int64(vals[3])), parseCounts(faults), nil
+}
+
+// hrBaseline derives the alert limits. Until the baseline is ready the old
+// fixed limit applies; after that the personal limits, never looser than the
+// absolute ones.
+func hrBaseline(mean, variance, rest float64, count int64) HRBaseline {
+	baseline := HRBaseline{
+		Mean:        mean,
+		StdDev:      math.Sqrt(variance),
+		RestingMean: rest,
+		Samples:     count,
+		Ready:       count >= HR_BASELINE_MIN_SAMPLES,
+		High:        HR_DEFAULT_HIGH,
+		Low:         HR_ABSOLUTE_LOW,
+	}
+	if baseline.Ready {
+		baseline.High = math.Min(HR_ABSOLUTE_HIGH, mean+math.Max(3*baseline.StdDev, 25))
+		baseline.Low = math.Max(HR_ABSOLUTE_LOW, rest-math.Max(3*baseline.StdDev, 15))
+	}
+	return baseline
+}
+
+// learnBaseline folds one normal reading into an exponentially weighted mean
+// and variance over roughly HR_BASELINE_WINDOW samples.
+func learnBaseline(mean, variance, rest float64, count int64, hr float64) (float64, float64, float64) {
+	if count == 0 {
+		return hr, 0, hr
+	}
+	alpha := math.Max(1/float64(HR_BASELINE_WINDOW), 1/float64(count+1))
+	diff := hr - mean
+	incr := alpha * diff
+	mean += incr
+	variance = (1 - alpha) * (variance + diff*incr)
+	if hr <= mean {
+		rest += alpha * (hr - rest)
+	}
+	return mean, variance, rest
+}
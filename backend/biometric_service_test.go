@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestBiometricServiceAnomalies(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-hr")
+	biometrics := NewBiometricService(rdb, ctx)
+
+	ts := int64(1700000000)
+	assess := func(hr int) BiometricAssessment {
+		ts++
+		return biometrics.Assess(Telemetry{VehicleID: "test-hr", DeviceID: "pico", HeartRate: hr, Timestamp: ts})
+	}
+
+	// Learn a resting-ish baseline around 60-70 bpm.
+	for i := 0; i < HR_BASELINE_MIN_SAMPLES; i++ {
+		assert.Equal(t, BiometricNormal, assess(60+i%10).State)
+	}
+	baseline, _, err := biometrics.Baseline("test-hr")
+	assert.NoError(t, err)
+	assert.True(t, baseline.Ready)
+	assert.Less(t, baseline.High, float64(HR_DEFAULT_HIGH), "personal limit is tighter than the default")
+
+	assert.Equal(t, BiometricSensorFault, assess(140).State, "jumps no heart can make are sensor faults")
+	assert.Equal(t, BiometricNormal, assess(65).State)
+
+	var last BiometricAssessment
+	for hr := 85; hr <= 115; hr += 2 {
+		last = assess(hr)
+		if hr < 100 {
+			continue
+		}
+		assert.Equal(t, BiometricTachycardia, last.State)
+	}
+	assert.True(t, last.Critical, "sustained tachycardia relative to baseline")
+
+	assert.Equal(t, BiometricNormal, assess(80).State)
+	assert.Equal(t, BiometricNoReading, assess(0).State)
+	for i := 0; i < HR_DROPOUT_SECONDS; i++ {
+		last = assess(0)
+	}
+	assert.Equal(t, BiometricSensorFault, last.State, "a sensor that stopped reading")
+	assert.False(t, last.Critical)
+
+	assert.Equal(t, BiometricNoReading, biometrics.Assess(Telemetry{VehicleID: "test-hr", DeviceID: "cam", Timestamp: ts}).State,
+		"devices without an HR sensor never fault")
+}
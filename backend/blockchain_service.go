@@ -40,86 +40,41 @@ func (s *BlockchainService) sendSolanaAlert(data Telemetry) {
 	if data.Status == "HEALTH_CRITICAL" {
 		memoText = fmt.Sprintf("SAFERIDE MEDICAL ALERT [HR: %d BPM]: %s | ID: %s | TIME: %d",
 			data.HeartRate, data.Status, data.VehicleID, data.Timestamp)
+	} else if data.GeofenceID != "" {
+		memoText = fmt.Sprintf("SAFERIDE GEOFENCE ALERT [%s]: %s | ZONE: %s | ID: %s | TIME: %d",
+			data.Violation, data.Status, data.GeofenceID, data.VehicleID, data.Timestamp)
+	} else if data.Status == StatusCrash {
+		memoText = fmt.Sprintf("SAFERIDE CRASH ALERT [%.1fG]: %s | ID: %s | TIME: %d | LOC: %.5f,%.5f",
+			data.PeakG, data.Status, data.VehicleID, data.Timestamp, data.Lat, data.Long)
 	} else {
 		memoText = fmt.Sprintf("SAFERIDE ALERT [%s]: %s | ID: %s | TIME: %d | CONF: %.2f",
 			data.Source, data.Status, data.VehicleID, data.Timestamp, data.Confidence)
 	}
 	log.Printf("📝 Memo: %s", memoText)
 
-	// 2. Build Instructions
-	memoProgramID := solana.MustPublicKeyFromBase58("MemoSq4gqABAXKb96qnH8TysNcWxMyWCqXgDLGmfcHr")
-	memoInstr := solana.NewInstruction(
-		memoProgramID,
-		solana.AccountMetaSlice{
-			solana.Meta(s.solanaWallet.PublicKey()).SIGNER(),
-		},
-		[]byte(memoText),
-	)
-
-	transferInstr := system.NewTransferInstruction(
-		0,
-		s.solanaWallet.PublicKey(),
-		s.solanaWallet.PublicKey(),
-	).Build()
-
-	recent, err := s.solanaClient.GetLatestBlockhash(context.TODO(), rpc.CommitmentFinalized)
-	if err != nil {
-		log.Printf("❌ Solana Error (GetBlockhash): %v", err)
-		return
-	}
-
-	// Combine both instructions
-	tx, err := solana.NewTransaction(
-		[]solana.Instruction{memoInstr, transferInstr},
-		recent.Value.Blockhash,
-		solana.TransactionPayer(s.solanaWallet.PublicKey()),
-	)
-	if err != nil {
-		log.Printf("❌ Solana Error (BuildTx): %v", err)
-		return
-	}
-
-	// 3. Sign Transaction
-	_, err = tx.Sign(
-		func(key solana.PublicKey) *solana.PrivateKey {
-			if s.solanaWallet.PublicKey().Equals(key) {
-				return &s.solanaWallet
-			}
-			return nil
-		},
-	)
+	// 2. Build, Sign and Send
+	sig, err := s.sendMemo(memoText)
 	if err != nil {
-		log.Printf("❌ Solana Error (Sign): %v", err)
-		return
-	}
-
-	// 4. Send Transaction
-	sig, err := s.solanaClient.SendTransactionWithOpts(
-		context.TODO(),
-		tx,
-		rpc.TransactionOpts{
-			SkipPreflight:       false,
-			PreflightCommitment: rpc.CommitmentFinalized,
-		},
-	)
-	if err != nil {
-		log.Printf("❌ Solana Error (Send): %v", err)
+		log.Printf("❌ Solana Error: %v", err)
 		return
 	}
 
 	log.Printf("✅ Solana Logged: [%s] Signature: %s", data.Status, sig)
 
-	// 5. Update Redis with the Hash
+	// 3. Update Redis with the Hash
 	data.TxHash = sig.String()
 	updatedJSON, _ := json.Marshal(data)
 
-	// A. Update Hot State
-	err = s.redisClient.Set(s.ctx, data.VehicleID, updatedJSON, time.Hour).Err()
-	if err != nil {
-		log.Printf("Failed to update Redis with Hash: %v", err)
+	// A. Update Hot State (unless newer telemetry arrived meanwhile, e.g. for backlogged alerts)
+	var current Telemetry
+	if val, err := s.redisClient.Get(s.ctx, data.VehicleID).Bytes(); err != nil || json.Unmarshal(val, &current) != nil || current.Timestamp <= data.Timestamp {
+		err = s.redisClient.Set(s.ctx, data.VehicleID, updatedJSON, time.Hour).Err()
+		if err != nil {
+			log.Printf("Failed to update Redis with Hash: %v", err)
+		}
 	}
 
-	// B. Add to Alerts History (Only Incidents with Hashes go here)
+	// B. Add to Alerts History (Incidents with Hashes, plus geofence events)
 	alertKey := fmt.Sprintf("alerts:%s", data.VehicleID)
 	s.redisClient.RPush(s.ctx, alertKey, updatedJSON)
 	s.redisClient.LTrim(s.ctx, alertKey, -20, -1) // Keep last 20 alerts
@@ -135,67 +90,17 @@ func (s *BlockchainService) sendSolanaSafeAttestation(data Telemetry, pointsAwar
 		data.VehicleID, pointsAwarded, totalPoints)
 	log.Printf("📝 Memo: %s", memoText)
 
-	memoProgramID := solana.MustPublicKeyFromBase58("MemoSq4gqABAXKb96qnH8TysNcWxMyWCqXgDLGmfcHr")
-	memoInstr := solana.NewInstruction(
-		memoProgramID,
-		solana.AccountMetaSlice{
-			solana.Meta(s.solanaWallet.PublicKey()).SIGNER(),
-		},
-		[]byte(memoText),
-	)
-
-	transferInstr := system.NewTransferInstruction(
-		0,
-		s.solanaWallet.PublicKey(),
-		s.solanaWallet.PublicKey(),
-	).Build()
-
-	recent, err := s.solanaClient.GetLatestBlockhash(context.TODO(), rpc.CommitmentFinalized)
-	if err != nil {
-		log.Printf("❌ Solana Error (GetBlockhash for Attestation): %v", err)
-		return
-	}
-
-	tx, err := solana.NewTransaction(
-		[]solana.Instruction{memoInstr, transferInstr},
-		recent.Value.Blockhash,
-		solana.TransactionPayer(s.solanaWallet.PublicKey()),
-	)
+	// 2. Build, Sign and Send
+	sig, err := s.sendMemo(memoText)
 	if err != nil {
-		log.Printf("❌ Solana Error (BuildTx for Attestation): %v", err)
-		return
-	}
-
-	_, err = tx.Sign(
-		func(key solana.PublicKey) *solana.PrivateKey {
-			if s.solanaWallet.PublicKey().Equals(key) {
-				return &s.solanaWallet
-			}
-			return nil
-		},
-	)
-	if err != nil {
-		log.Printf("❌ Solana Error (Sign for Attestation): %v", err)
-		return
-	}
-
-	sig, err := s.solanaClient.SendTransactionWithOpts(
-		context.TODO(),
-		tx,
-		rpc.TransactionOpts{
-			SkipPreflight:       false,
-			PreflightCommitment: rpc.CommitmentFinalized,
-		},
-	)
-	if err != nil {
-		log.Printf("❌ Solana Error (Send for Attestation): %v", err)
+		log.Printf("❌ Solana Error (Attestation): %v", err)
 		return
 	}
 
 	sigStr := sig.String()
 	log.Printf("✅ Solana Safe Attestation Logged! Signature: %s", sigStr)
 
-	// 5. Update Telemetry data with hash and specific status, then push to Redis alerts list
+	// 3. Update Telemetry data with hash and specific status, then push to Redis alerts list
 	data.TxHash = sigStr
 	data.Status = "SAFE_STREAK_ATTESTATION" // New status for frontend
 	updatedJSON, _ := json.Marshal(data)
@@ -214,6 +119,61 @@ func (s *BlockchainService) sendSolanaPeriodicSafeAttestation(data Telemetry) {
 	memoText := fmt.Sprintf("SAFERIDE PERIODIC ATTESTATION: %s status: %s", data.VehicleID, data.Status)
 	log.Printf("📝 Memo: %s", memoText)
 
+	// 2. Build, Sign and Send
+	sig, err := s.sendMemo(memoText)
+	if err != nil {
+		log.Printf("❌ Solana Error (Periodic Attestation): %v", err)
+		return
+	}
+
+	sigStr := sig.String()
+	log.Printf("✅ Solana Periodic Safe Attestation Logged! Signature: %s", sigStr)
+
+	// 3. Update Telemetry data with hash and specific status, then push to Redis alerts list
+	data.TxHash = sigStr
+	data.Status = "PERIODIC_SAFE_ATTESTATION" // New status for frontend
+	updatedJSON, _ := json.Marshal(data)
+
+	alertKey := fmt.Sprintf("alerts:%s", data.VehicleID)
+	s.redisClient.RPush(s.ctx, alertKey, updatedJSON)
+	s.redisClient.LTrim(s.ctx, alertKey, -20, -1) // Keep last 20 alerts
+}
+
+// sendSolanaIncident attests a closed incident with its summary and returns
+// the signature ("" on failure).
+func (s *BlockchainService) sendSolanaIncident(incident Incident) string {
+	log.Printf("⛓️ Initiating Solana Incident Attestation for %s [%s %s]...", incident.VehicleID, incident.Type, incident.ID)
+
+	// 1. Create the Memo String
+	memoText := fmt.Sprintf("SAFERIDE INCIDENT [%s]: %s | ID: %s | START: %d | DURATION: %ds | SAMPLES: %d | PEAK CONF: %.2f | REF: %s",
+		incident.Severity, incident.Type, incident.VehicleID, incident.StartTime, incident.DurationSec, incident.SampleCount, incident.PeakConfidence, incident.ID)
+	if incident.PeakHeartRate > 0 {
+		memoText += fmt.Sprintf(" | PEAK HR: %d BPM", incident.PeakHeartRate)
+	}
+	log.Printf("📝 Memo: %s", memoText)
+
+	// 2. Build, Sign and Send
+	sig, err := s.sendMemo(memoText)
+	if err != nil {
+		log.Printf("❌ Solana Error (Incident %s): %v", incident.ID, err)
+		return ""
+	}
+	sigStr := sig.String()
+	log.Printf("✅ Solana Incident Logged: [%s] Signature: %s", incident.Type, sigStr)
+
+	// 3. Add to Alerts History, one entry per incident
+	data := incidentTelemetry(incident)
+	data.TxHash = sigStr
+	updatedJSON, _ := json.Marshal(data)
+
+	alertKey := fmt.Sprintf("alerts:%s", data.VehicleID)
+	s.redisClient.RPush(s.ctx, alertKey, updatedJSON)
+	s.redisClient.LTrim(s.ctx, alertKey, -20, -1) // Keep last 20 alerts
+	return sigStr
+}
+
+// sendMemo writes memoText on-chain with a zero-value self transfer.
+func (s *BlockchainService) sendMemo(memoText string) (solana.Signature, error) {
 	memoProgramID := solana.MustPublicKeyFromBase58("MemoSq4gqABAXKb96qnH8TysNcWxMyWCqXgDLGmfcHr")
 	memoInstr := solana.NewInstruction(
 		memoProgramID,
@@ -231,8 +191,7 @@ func (s *BlockchainService) sendSolanaPeriodicSafeAttestation(data Telemetry) {
 
 	recent, err := s.solanaClient.GetLatestBlockhash(context.TODO(), rpc.CommitmentFinalized)
 	if err != nil {
-		log.Printf("❌ Solana Error (GetBlockhash for Periodic Attestation): %v", err)
-		return
+		return solana.Signature{}, fmt.Errorf("get blockhash: %v", err)
 	}
 
 	tx, err := solana.NewTransaction(
@@ -241,8 +200,7 @@ func (s *BlockchainService) sendSolanaPeriodicSafeAttestation(data Telemetry) {
 		solana.TransactionPayer(s.solanaWallet.PublicKey()),
 	)
 	if err != nil {
-		log.Printf("❌ Solana Error (BuildTx for Periodic Attestation): %v", err)
-		return
+		return solana.Signature{}, fmt.Errorf("build tx: %v", err)
 	}
 
 	_, err = tx.Sign(
@@ -254,11 +212,10 @@ func (s *BlockchainService) sendSolanaPeriodicSafeAttestation(data Telemetry) {
 		},
 	)
 	if err != nil {
-		log.Printf("❌ Solana Error (Sign for Periodic Attestation): %v", err)
-		return
+		return solana.Signature{}, fmt.Errorf("sign: %v", err)
 	}
 
-	sig, err := s.solanaClient.SendTransactionWithOpts(
+	return s.solanaClient.SendTransactionWithOpts(
 		context.TODO(),
 		tx,
 		rpc.TransactionOpts{
@@ -266,20 +223,4 @@ func (s *BlockchainService) sendSolanaPeriodicSafeAttestation(data Telemetry) {
 			PreflightCommitment: rpc.CommitmentFinalized,
 		},
 	)
-	if err != nil {
-		log.Printf("❌ Solana Error (Send for Periodic Attestation): %v", err)
-		return
-	}
-
-	sigStr := sig.String()
-	log.Printf("✅ Solana Periodic Safe Attestation Logged! Signature: %s", sigStr)
-
-	// 5. Update Telemetry data with hash and specific status, then push to Redis alerts list
-	data.TxHash = sigStr
-	data.Status = "PERIODIC_SAFE_ATTESTATION" // New status for frontend
-	updatedJSON, _ := json.Marshal(data)
-
-	alertKey := fmt.Sprintf("alerts:%s", data.VehicleID)
-	s.redisClient.RPush(s.ctx, alertKey, updatedJSON)
-	s.redisClient.LTrim(s.ctx, alertKey, -20, -1) // Keep last 20 alerts
 }
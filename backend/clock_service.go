@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// ClockService estimates each device's clock offset so delayed deliveries
+// (QoS 1 retries, offline backlogs) keep their real event time instead of
+// being stamped with arrival time.
+//
+// Every message gives one observation: arrival time minus device time. That
+// is the true offset plus the delivery delay, and delays are never negative,
+// so the smallest observation in a recent window is the best estimate (the
+// same idea NTP uses). Devices without a wall clock can send a monotonic
+// uptime instead; the estimated boot time is tracked the same way.
+type ClockService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewClockService creates a new ClockService instance.
+func NewClockService(redisClient *redis.Client, ctx context.Context) *ClockService {
+	return &ClockService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Resolve sets data.Timestamp to the corrected event time and fills in the
+// device/server timestamps and skew flags. sentAt is the batch send time on
+// the device clock (0 if none).
+func (c *ClockService) Resolve(data *Telemetry, sentAt, receivedAtMs int64) {
+	device := deviceName(*data)
+	key := fmt.Sprintf("clock:%s:%s", data.VehicleID, device)
+
+	data.DeviceTimestamp = data.Timestamp
+	data.ReceivedAt = receivedAtMs / 1000
+
+	eventMs := receivedAtMs
+	switch {
+	case data.UptimeMs > 0:
+		// Monotonic clock (e.g. Pico ticks_ms): anchor to the estimated boot time.
+		bootMs := c.observeBoot(key, receivedAtMs, data.UptimeMs)
+		eventMs = bootMs + data.UptimeMs
+	case data.AgeMs > 0:
+		eventMs = receivedAtMs - data.AgeMs
+	case sentAt != 0 && data.Timestamp != 0:
+		// Batched samples on the device clock: the send time gives the offset.
+		offsetMs := c.observeOffset(key, receivedAtMs-sentAt*1000)
+		eventMs = data.Timestamp*1000 + offsetMs
+		data.ClockSkewMs = offsetMs
+	case data.Timestamp != 0:
+		offsetMs := c.observeOffset(key, receivedAtMs-data.Timestamp*1000)
+		eventMs = data.Timestamp*1000 + offsetMs
+		data.ClockSkewMs = offsetMs
+	}
+	data.AgeMs = 0 // Folded into Timestamp
+
+	if abs64(data.ClockSkewMs) > MAX_CLOCK_SKEW*1000 {
+		// Usually a device that never synced its clock. The correction still
+		// keeps its samples in order, but the flag travels downstream.
+		data.ClockSuspect = true
+	}
+
+	// Never trust an event time in the future or beyond the backlog horizon.
+	if eventMs > receivedAtMs+MAX_FUTURE_SKEW*1000 || eventMs < receivedAtMs-MAX_SAMPLE_AGE*1000 {
+		log.Printf("⏱️ Implausible event time for %s/%s (%d ms vs arrival %d ms); using server time", data.VehicleID, device, eventMs, receivedAtMs)
+		data.ClockSuspect = true
+		eventMs = receivedAtMs
+	}
+	data.Timestamp = min(eventMs, receivedAtMs) / 1000
+}
+
+// observeOffset records one arrival-minus-device-time observation (ms) and
+// returns the current offset estimate.
+func (c *ClockService) observeOffset(key string, observationMs int64) int64 {
+	return c.observeMin(key+":offsets", observationMs)
+}
+
+// observeBoot records one boot-time observation (ms since epoch) and returns
+// the current boot time estimate. An uptime that went backwards is either a
+// late sample or a reboot; it can only be a reboot if the device hasn't been
+// up longer than the time since its previous message, and then older boot
+// estimates are discarded.
+func (c *ClockService) observeBoot(key string, receivedAtMs, uptimeMs int64) int64 {
+	bootsKey := key + ":boots"
+	uptimeKey := key + ":uptime"
+
+	last, err := c.redisClient.HGetAll(c.ctx, uptimeKey).Result()
+	if err != nil {
+		log.Printf("Error getting last device uptime: %v", err)
+	}
+	lastUptime, _ := strconv.ParseInt(last["uptime_ms"], 10, 64)
+	lastReceived, _ := strconv.ParseInt(last["received_ms"], 10, 64)
+
+	rebooted := uptimeMs < lastUptime && uptimeMs <= receivedAtMs-lastReceived+MAX_FUTURE_SKEW*1000
+	if rebooted {
+		log.Printf("🔄 Device %s rebooted (uptime %d ms < %d ms)", key, uptimeMs, lastUptime)
+		c.redisClient.Del(c.ctx, bootsKey)
+	}
+	if rebooted || uptimeMs >= lastUptime {
+		c.redisClient.HSet(c.ctx, uptimeKey, "uptime_ms", uptimeMs, "received_ms", receivedAtMs)
+	}
+
+	return c.observeMin(bootsKey, receivedAtMs-uptimeMs)
+}
+
+// observeMin pushes an observation onto a capped list and returns the
+// smallest value in it.
+func (c *ClockService) observeMin(key string, observation int64) int64 {
+	pipe := c.redisClient.TxPipeline()
+	pipe.LPush(c.ctx, key, observation)
+	pipe.LTrim(c.ctx, key, 0, CLOCK_SKEW_WINDOW-1)
+	values := pipe.LRange(c.ctx, key, 0, -1)
+	if _, err := pipe.Exec(c.ctx); err != nil {
+		log.Printf("Failed to update clock estimate %s: %v", key, err)
+		return observation
+	}
+
+	best := observation
+	for _, v := range values.Val() {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n < best {
+			best = n
+		}
+	}
+	return best
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestClockServiceResolve(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "clock:test-clock:cam:offsets", "clock:test-clock:pico:boots", "clock:test-clock:pico:uptime")
+	clock := NewClockService(rdb, ctx)
+
+	const now = int64(1700000000000) // ms
+
+	// Device clock runs 1 hour behind; the first message took 2 s to arrive.
+	first := Telemetry{VehicleID: "test-clock", DeviceID: "cam", Timestamp: (now - 3600_000 - 2000) / 1000}
+	clock.Resolve(&first, 0, now)
+	assert.Equal(t, now/1000, first.Timestamp, "no better estimate than its own arrival yet")
+
+	// A prompt message refines the offset...
+	prompt := Telemetry{VehicleID: "test-clock", DeviceID: "cam", Timestamp: (now + 10_000 - 3600_000) / 1000}
+	clock.Resolve(&prompt, 0, now+10_000)
+	assert.Equal(t, (now+10_000)/1000, prompt.Timestamp)
+	assert.True(t, prompt.ClockSuspect, "an hour of skew is flagged")
+
+	// ...so a QoS 1 redelivery 30 s late keeps its real event time.
+	late := Telemetry{VehicleID: "test-clock", DeviceID: "cam", Timestamp: (now + 20_000 - 3600_000) / 1000}
+	clock.Resolve(&late, 0, now+50_000)
+	assert.Equal(t, (now+20_000)/1000, late.Timestamp)
+	assert.Equal(t, (now+50_000)/1000, late.ReceivedAt)
+
+	// Monotonic uptime: a late sample is placed relative to the estimated boot time.
+	boot := now - 60_000
+	fresh := Telemetry{VehicleID: "test-clock", DeviceID: "pico", UptimeMs: 60_000}
+	clock.Resolve(&fresh, 0, now)
+	delayed := Telemetry{VehicleID: "test-clock", DeviceID: "pico", UptimeMs: 65_000}
+	clock.Resolve(&delayed, 0, now+40_000)
+	assert.Equal(t, (boot+65_000)/1000, delayed.Timestamp)
+
+	// A sample that was still in flight is late, not a reboot...
+	inFlight := Telemetry{VehicleID: "test-clock", DeviceID: "pico", UptimeMs: 62_000}
+	clock.Resolve(&inFlight, 0, now+41_000)
+	assert.Equal(t, (boot+62_000)/1000, inFlight.Timestamp)
+
+	// ...but an uptime shorter than the time since the last message is.
+	rebooted := Telemetry{VehicleID: "test-clock", DeviceID: "pico", UptimeMs: 5_000}
+	clock.Resolve(&rebooted, 0, now+100_000)
+	assert.Equal(t, (now+100_000)/1000, rebooted.Timestamp)
+}
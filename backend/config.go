@@ -1,9 +1,93 @@
 package main
 
 const (
-	mqttTopic = "vehicles/+/telemetry"
+	mqttTopic = "vehicles/+/telemetry/#" // Also matches the bare topic; suffix selects the encoding
 
-	SAFE_STREAK_THRESHOLD              = 15
-	POINTS_PER_STREAK                  = 10
+	STREAK_SAMPLE_GAP                  = 60 // seconds between safe samples still counted as safe driving time
 	PERIODIC_SAFE_ATTESTATION_INTERVAL = 30 // seconds
+
+	REDEMPTION_IDEMPOTENCY_TTL = 24 * 60 * 60 // seconds an Idempotency-Key is remembered
+
+	SESSION_TTL = 7 * 24 * 60 * 60 // seconds a login session stays valid
+
+	MAX_TELEMETRY_BATCH = 500          // samples per ingestion message/request
+	MAX_TELEMETRY_BODY  = 4 << 20      // bytes per HTTP ingestion request
+	MAX_SAMPLE_AGE      = 24 * 60 * 60 // seconds; older backlog falls back to server time
+	MAX_FUTURE_SKEW     = 5            // seconds a sample may claim to be ahead of the server
+
+	CLOCK_SKEW_WINDOW = 20  // observations kept per device for the offset estimate
+	MAX_CLOCK_SKEW    = 300 // seconds; larger device clock offsets are flagged as suspect
+
+	DEDUP_WINDOW        = 10 * 60 // seconds a message ID / sequence number is remembered
+	SEQ_RESET_THRESHOLD = 1000    // a sequence this far behind means the counter restarted
+	MAX_SEQUENCE_GAPS   = 100     // gap ranges kept per vehicle
+
+	DEADLETTER_MAX_LEN = 1000 // rejected messages kept (approximate stream cap)
+
+	MAX_HEART_RATE = 250 // bpm; anything above is a sensor or encoding error
+
+	STATUS_RULES_RELOAD_INTERVAL = 5 // seconds between checks of the status rules file
+
+	INCIDENT_CLOSE_AFTER    = 5                 // seconds without the status before an open incident closes
+	INCIDENT_SWEEP_INTERVAL = 5                 // seconds between checks for incidents of vehicles that went quiet
+	INCIDENT_RETENTION      = 30 * 24 * 60 * 60 // seconds incidents are kept
+	MAX_INCIDENT_SAMPLES    = 100               // linked samples stored per incident
+
+	DETECTOR_STATE_TTL = 60 * 60 // seconds of silence after which a detector falls back to safe
+
+	HR_BASELINE_WINDOW      = 300 // readings the learned HR baseline roughly averages over
+	HR_BASELINE_MIN_SAMPLES = 60  // readings before personal HR limits replace the defaults
+	HR_DEFAULT_HIGH         = 120 // bpm; tachycardia limit until the baseline is ready
+	HR_ABSOLUTE_HIGH        = 150 // bpm; personal limits are never looser than this...
+	HR_ABSOLUTE_LOW         = 40  // bpm; ...or this
+	HR_MIN_PLAUSIBLE        = 25  // bpm; anything lower (but not 0) is a sensor fault
+	HR_MAX_JUMP             = 40  // bpm change within 2 s that no heart makes
+	HR_SUSTAIN_SECONDS      = 10  // an anomaly must last this long...
+	HR_SUSTAIN_SAMPLES      = 3   // ...over this many readings to be a medical event
+	HR_DROPOUT_SECONDS      = 10  // seconds of 0 bpm from a working sensor before it counts as a fault
+	HR_SENSOR_TIMEOUT       = 60  // seconds after the last reading that a sensor still counts as working
+
+	RISK_HALF_LIFE          = 120     // seconds for the risk score to halve without new events
+	RISK_SESSION_GAP        = 10 * 60 // seconds of silence that end a drive (resets continuous driving time)
+	RISK_ELEVATED_THRESHOLD = 30      // risk score levels (0-100)
+	RISK_HIGH_THRESHOLD     = 60      // escalates (HIGH_RISK alert)
+	RISK_CRITICAL_THRESHOLD = 80      // escalates again
+
+	MAX_IMU_SAMPLES   = 1000  // IMU readings per telemetry sample
+	MAX_IMU_OFFSET_MS = 60000 // IMU readings must be this close to the sample timestamp
+	MAX_IMU_G         = 16    // accelerometer range; beyond is a sensor or encoding error
+	MAX_IMU_DPS       = 2000  // gyroscope range, degrees/second
+	IMU_MAX_GAP_MS    = 1000  // a longer gap between readings restarts the filters
+
+	CRASH_STILL_G   = 0.15 // g away from gravity alone that still counts as not moving...
+	CRASH_STILL_DPS = 5    // ...and rotation, degrees/second
+	CRASH_SETTLE_MS = 5000 // ms after an impact for the vehicle to come to rest
+
+	EMERGENCY_RESPONSE_TIMEOUT = 60                // seconds for the driver to answer "are you OK" before contacts are alerted
+	EMERGENCY_SWEEP_INTERVAL   = 5                 // seconds between checks for unanswered emergencies
+	EMERGENCY_RETENTION        = 30 * 24 * 60 * 60 // seconds emergencies are kept
+	EMERGENCY_WEBHOOK_TIMEOUT  = 10                // seconds to wait for the notification gateway
+
+	DOWNLINK_QUEUE_SIZE = 256 // downlink messages waiting to be published before new ones are dropped
+
+	GPS_MAX_SPEED_KMH = 250     // implied speed above this is a GPS jump, not driving
+	GPS_MAX_OUTLIERS  = 3       // rejected fixes in a row before the tracker starts over from the new position
+	GPS_JITTER_METERS = 10      // movement below this is GPS wander, not driving
+	GPS_MAX_GAP       = 60      // seconds between fixes beyond which no distance is counted
+	TRIP_GAP          = 10 * 60 // seconds without a fix (or any sample) that end a trip
+
+	TRIP_MOVING_KMH     = 5                 // speed from which a vehicle counts as moving (starts a trip)
+	TRIP_STOP_SECONDS   = 5 * 60            // seconds standing still that end a trip
+	TRIP_SWEEP_INTERVAL = 60                // seconds between checks for trips of vehicles that went quiet
+	TRIP_RETENTION      = 90 * 24 * 60 * 60 // seconds trips are kept
+
+	DRIVING_SAMPLE_GAP = 2 * 60 // seconds between moving samples still counted as driving; a longer gap is a stop
+
+	FRAUD_REPEAT_SAMPLES    = 30               // identical fixes or confidence values in a row that flag a vehicle
+	FRAUD_CADENCE_SAMPLES   = 20               // message intervals compared for a fixed cadence...
+	FRAUD_CADENCE_JITTER_MS = 5                // ...which is flagged if they all fall within this spread
+	FRAUD_CADENCE_MAX_MS    = 10 * 60 * 1000   // a longer pause restarts the cadence check
+	FRAUD_DUPLICATE_WINDOW  = 10 * 60          // seconds within which identical readings from two vehicles are flagged
+	FRAUD_STATE_TTL         = 7 * 24 * 60 * 60 // seconds the checks remember a quiet vehicle
+	FRAUD_MAX_EVIDENCE      = 50               // evidence entries kept per case
 )
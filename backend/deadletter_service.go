@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+const deadLetterStream = "deadletter"
+
+// Dead-letter reasons.
+const (
+	DeadLetterParseError      = "parse_error"
+	DeadLetterSchemaViolation = "schema_violation"
+	DeadLetterAuthFailure     = "auth_failure"
+	DeadLetterBatchTooLarge   = "batch_too_large"
+	DeadLetterIngestError     = "ingest_error"
+)
+
+// DeadLetterService keeps rejected telemetry in a capped Redis stream so it
+// can be inspected and, once the cause is fixed, replayed.
+type DeadLetterService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewDeadLetterService creates a new DeadLetterService instance.
+func NewDeadLetterService(redisClient *redis.Client, ctx context.Context) *DeadLetterService {
+	return &DeadLetterService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Record stores a rejected message. Failures are only logged: losing a dead
+// letter must never block ingestion.
+func (d *DeadLetterService) Record(msg RawMessage, reason string, cause error) {
+	errText := ""
+	if cause != nil {
+		errText = cause.Error()
+	}
+	log.Printf("🪦 Dead-lettered %s message from %s (%s): %s", msg.Transport, msg.Topic, reason, errText)
+
+	err := d.redisClient.XAdd(d.ctx, &redis.XAddArgs{
+		Stream: deadLetterStream,
+		MaxLen: DEADLETTER_MAX_LEN,
+		Approx: true,
+		Values: map[string]interface{}{
+			"transport":   msg.Transport,
+			"topic":       msg.Topic,
+			"encoding":    string(msg.Encoding),
+			"reason":      reason,
+			"error":       errText,
+			"payload":     msg.Payload,
+			"received_at": time.Now().Unix(),
+		},
+	}).Err()
+	if err != nil {
+		log.Printf("Failed to store dead letter: %v", err)
+	}
+}
+
+// List returns up to limit dead letters, newest first, optionally filtered by
+// reason and starting below the before ID (for pagination).
+func (d *DeadLetterService) List(reason, before string, limit int) ([]DeadLetter, error) {
+	end := "+"
+	if before != "" {
+		end = "(" + before
+	}
+
+	var letters []DeadLetter
+	for len(letters) < limit {
+		msgs, err := d.redisClient.XRevRangeN(d.ctx, deadLetterStream, end, "-", int64(limit)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			letter := deadLetterFromStream(m)
+			if reason == "" || letter.Reason == reason {
+				letters = append(letters, letter)
+				if len(letters) == limit {
+					break
+				}
+			}
+		}
+		if len(msgs) < limit {
+			break
+		}
+		end = "(" + msgs[len(msgs)-1].ID
+	}
+	return letters, nil
+}
+
+// Get returns a single dead letter; ok is false if it doesn't exist (or was
+// trimmed from the stream).
+func (d *DeadLetterService) Get(id string) (DeadLetter, bool, error) {
+	msgs, err := d.redisClient.XRange(d.ctx, deadLetterStream, id, id).Result()
+	if err != nil || len(msgs) == 0 {
+		return DeadLetter{}, false, err
+	}
+	return deadLetterFromStream(msgs[0]), true, nil
+}
+
+// Delete removes a dead letter, e.g. after a successful replay.
+func (d *DeadLetterService) Delete(id string) error {
+	return d.redisClient.XDel(d.ctx, deadLetterStream, id).Err()
+}
+
+func deadLetterFromStream(m redis.XMessage) DeadLetter {
+	str := func(key string) string {
+		v, _ := m.Values[key].(string)
+		return v
+	}
+	receivedAt, _ := strconv.ParseInt(str("received_at"), 10, 64)
+	letter := DeadLetter{
+		ID:         m.ID,
+		Transport:  str("transport"),
+		Topic:      str("topic"),
+		Encoding:   str("encoding"),
+		Reason:     str("reason"),
+		Error:      str("error"),
+		Payload:    []byte(str("payload")),
+		ReceivedAt: receivedAt,
+	}
+	if utf8.Valid(letter.Payload) {
+		letter.PayloadText = string(letter.Payload)
+	}
+	return letter
+}
+
+// RawMessage returns the dead letter as it originally arrived, or with
+// payload swapped in when an operator supplies a fixed version.
+func (l DeadLetter) RawMessage(payload []byte, enc TelemetryEncoding) RawMessage {
+	msg := RawMessage{
+		Transport: l.Transport,
+		Topic:     l.Topic,
+		Encoding:  TelemetryEncoding(l.Encoding),
+		Payload:   l.Payload,
+	}
+	if len(payload) > 0 {
+		msg.Payload = payload
+		msg.Encoding = enc
+	}
+	return msg
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// DedupService drops QoS 1 redeliveries and keeps track of sequence numbers
+// that never arrived. Both checks are opt-in: samples without a message ID
+// or sequence number pass straight through.
+type DedupService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewDedupService creates a new DedupService instance.
+func NewDedupService(redisClient *redis.Client, ctx context.Context) *DedupService {
+	return &DedupService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// IsDuplicate reports whether the sample was already seen within DEDUP_WINDOW
+// and, for sequenced samples, records gaps and late arrivals. The sample is
+// marked seen; if processing it then fails, Forget it so a redelivery or
+// replay isn't dropped.
+func (d *DedupService) IsDuplicate(data Telemetry) bool {
+	device := deviceName(data)
+
+	if data.MessageID != "" {
+		if d.seen(messageKey(data)) {
+			d.countDuplicate(data)
+			return true
+		}
+	}
+
+	if data.Seq != 0 {
+		// A restarted counter reuses numbers, so check for a restart first.
+		epoch := d.sequenceEpoch(data.VehicleID, device, data.Seq)
+		if d.seen(sequenceKey(data, device, epoch)) {
+			d.countDuplicate(data)
+			return true
+		}
+		d.trackSequence(data.VehicleID, device, data.Seq)
+	}
+	return false
+}
+
+// Forget unmarks a sample IsDuplicate marked as seen.
+func (d *DedupService) Forget(data Telemetry) {
+	var keys []string
+	if data.MessageID != "" {
+		keys = append(keys, messageKey(data))
+	}
+	if data.Seq != 0 {
+		device := deviceName(data)
+		epoch, _ := d.redisClient.Get(d.ctx, fmt.Sprintf("seq_epoch:%s:%s", data.VehicleID, device)).Int64()
+		keys = append(keys, sequenceKey(data, device, epoch))
+	}
+	if len(keys) > 0 {
+		d.redisClient.Del(d.ctx, keys...)
+	}
+}
+
+func messageKey(data Telemetry) string {
+	return fmt.Sprintf("dedup:%s:msg:%s", data.VehicleID, data.MessageID)
+}
+
+// sequenceKey includes the device's counter epoch, so numbers from before a
+// restart don't shadow the new ones.
+func sequenceKey(data Telemetry, device string, epoch int64) string {
+	return fmt.Sprintf("dedup:%s:%s:%d:seq:%d", data.VehicleID, device, epoch, data.Seq)
+}
+
+// seen marks key as seen and reports whether it already was.
+func (d *DedupService) seen(key string) bool {
+	isNew, err := d.redisClient.SetNX(d.ctx, key, 1, DEDUP_WINDOW*time.Second).Result()
+	if err != nil {
+		log.Printf("Dedup check failed for %s: %v", key, err)
+		return false // Prefer a possible duplicate over dropping data
+	}
+	return !isNew
+}
+
+// sequenceEpoch returns the device's counter epoch, starting a new one if
+// seq shows the counter restarted: a big jump back, or back to 1.
+func (d *DedupService) sequenceEpoch(vehicleID, device string, seq uint64) int64 {
+	epochKey := fmt.Sprintf("seq_epoch:%s:%s", vehicleID, device)
+	lastKey := fmt.Sprintf("seq_last:%s:%s", vehicleID, device)
+	last, err := d.redisClient.Get(d.ctx, lastKey).Uint64()
+	if err != nil && err != redis.Nil {
+		log.Printf("Error getting last sequence number: %v", err)
+	}
+	if last != 0 && seq < last && (last-seq >= SEQ_RESET_THRESHOLD || seq == 1) {
+		log.Printf("🔄 Sequence counter for %s/%s restarted (%d after %d)", vehicleID, device, seq, last)
+		d.redisClient.Del(d.ctx, lastKey) // trackSequence starts over from seq
+		epoch, err := d.redisClient.Incr(d.ctx, epochKey).Result()
+		if err != nil {
+			log.Printf("Failed to start a new sequence epoch: %v", err)
+		}
+		return epoch
+	}
+	epoch, _ := d.redisClient.Get(d.ctx, epochKey).Int64()
+	return epoch
+}
+
+func (d *DedupService) countDuplicate(data Telemetry) {
+	log.Printf("♻️ Duplicate message from %s (id: %q, seq: %d) dropped", data.VehicleID, data.MessageID, data.Seq)
+	d.redisClient.Incr(d.ctx, fmt.Sprintf("duplicates:%s", data.VehicleID))
+}
+
+// trackSequence compares seq with the highest one seen for the device.
+// Jumps forward open a gap and late arrivals shrink one (restarts are
+// handled by sequenceEpoch).
+func (d *DedupService) trackSequence(vehicleID, device string, seq uint64) {
+	lastKey := fmt.Sprintf("seq_last:%s:%s", vehicleID, device)
+	last, err := d.redisClient.Get(d.ctx, lastKey).Uint64()
+	if err != nil && err != redis.Nil {
+		log.Printf("Error getting last sequence number: %v", err)
+		return
+	}
+
+	switch {
+	case last == 0 || seq == last+1:
+		// First sample seen, or in order
+	case seq > last+1:
+		gap := SequenceGap{DeviceID: device, From: last + 1, To: seq - 1, DetectedAt: time.Now().Unix()}
+		log.Printf("🕳️ Sequence gap for %s/%s: %d-%d missing", vehicleID, device, gap.From, gap.To)
+		d.addGap(vehicleID, gap)
+	default:
+		// Late arrival of a sample we already counted as missing
+		d.fillGap(vehicleID, device, seq)
+		return
+	}
+	d.redisClient.Set(d.ctx, lastKey, strconv.FormatUint(seq, 10), 0)
+}
+
+func (d *DedupService) addGap(vehicleID string, gap SequenceGap) {
+	gapJSON, _ := json.Marshal(gap)
+	gapsKey := fmt.Sprintf("seq_gaps:%s", vehicleID)
+	d.redisClient.RPush(d.ctx, gapsKey, gapJSON)
+	d.redisClient.LTrim(d.ctx, gapsKey, -MAX_SEQUENCE_GAPS, -1)
+	d.redisClient.IncrBy(d.ctx, fmt.Sprintf("seq_missing:%s", vehicleID), int64(gap.To-gap.From+1))
+}
+
+// fillGap removes seq from whichever recorded gap contains it, splitting the
+// gap in two if seq falls in the middle.
+func (d *DedupService) fillGap(vehicleID, device string, seq uint64) {
+	gapsKey := fmt.Sprintf("seq_gaps:%s", vehicleID)
+	vals, err := d.redisClient.LRange(d.ctx, gapsKey, 0, -1).Result()
+	if err != nil {
+		log.Printf("Error reading sequence gaps: %v", err)
+		return
+	}
+
+	for i, v := range vals {
+		var gap SequenceGap
+		if json.Unmarshal([]byte(v), &gap) != nil || gap.DeviceID != device || seq < gap.From || seq > gap.To {
+			continue
+		}
+
+		var pieces []interface{}
+		if seq > gap.From {
+			before, _ := json.Marshal(SequenceGap{DeviceID: device, From: gap.From, To: seq - 1, DetectedAt: gap.DetectedAt})
+			pieces = append(pieces, before)
+		}
+		if seq < gap.To {
+			after, _ := json.Marshal(SequenceGap{DeviceID: device, From: seq + 1, To: gap.To, DetectedAt: gap.DetectedAt})
+			pieces = append(pieces, after)
+		}
+
+		// Rewrite the list with the gap replaced by what is left of it.
+		rewritten := make([]interface{}, 0, len(vals)+1)
+		for _, other := range vals[:i] {
+			rewritten = append(rewritten, other)
+		}
+		rewritten = append(rewritten, pieces...)
+		for _, other := range vals[i+1:] {
+			rewritten = append(rewritten, other)
+		}
+		pipe := d.redisClient.TxPipeline()
+		pipe.Del(d.ctx, gapsKey)
+		if len(rewritten) > 0 {
+			pipe.RPush(d.ctx, gapsKey, rewritten...)
+		}
+		pipe.Decr(d.ctx, fmt.Sprintf("seq_missing:%s", vehicleID))
+		if _, err := pipe.Exec(d.ctx); err != nil {
+			log.Printf("Failed to update sequence gaps: %v", err)
+		}
+		return
+	}
+}
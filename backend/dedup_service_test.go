@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestDedupServiceSequenceGaps(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-dedup")
+	dedup := NewDedupService(rdb, ctx)
+
+	sample := func(seq uint64) Telemetry {
+		return Telemetry{VehicleID: "test-dedup", DeviceID: "pico", Seq: seq}
+	}
+
+	assert.False(t, dedup.IsDuplicate(sample(1)))
+	assert.True(t, dedup.IsDuplicate(sample(1)), "QoS 1 redelivery")
+	assert.False(t, dedup.IsDuplicate(sample(6)), "2-5 lost")
+	assert.False(t, dedup.IsDuplicate(sample(3)), "late arrival splits the gap")
+
+	gaps, _ := rdb.LRange(ctx, "seq_gaps:test-dedup", 0, -1).Result()
+	assert.Len(t, gaps, 2)
+	missing, _ := rdb.Get(ctx, "seq_missing:test-dedup").Int()
+	assert.Equal(t, 3, missing)
+
+	assert.False(t, dedup.IsDuplicate(Telemetry{VehicleID: "test-dedup", MessageID: "abc"}))
+	assert.True(t, dedup.IsDuplicate(Telemetry{VehicleID: "test-dedup", MessageID: "abc"}))
+}
+
+func TestDedupServiceCounterRestart(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-reboot")
+	dedup := NewDedupService(rdb, ctx)
+
+	sample := func(seq uint64) Telemetry {
+		return Telemetry{VehicleID: "test-reboot", DeviceID: "pico", Seq: seq}
+	}
+	for seq := uint64(1); seq <= 5; seq++ {
+		assert.False(t, dedup.IsDuplicate(sample(seq)))
+	}
+
+	// The device reboots within the dedup window and counts from 1 again.
+	for seq := uint64(1); seq <= 5; seq++ {
+		assert.False(t, dedup.IsDuplicate(sample(seq)), "seq %d after the restart", seq)
+	}
+	assert.True(t, dedup.IsDuplicate(sample(5)), "redeliveries are still dropped")
+	missing, _ := rdb.Get(ctx, "seq_missing:test-reboot").Int()
+	assert.Equal(t, 0, missing)
+}
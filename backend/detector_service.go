@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// lowConfidenceVote stands in the detector window for a sample below the
+// source's min_confidence: it counts towards no status.
+const lowConfidenceVote = "?"
+
+// DetectorService debounces noisy sources like the CV model, where glare or
+// a head turn produces single frames of "drowsy" or "distracted". Each
+// vehicle/source pair keeps a window of recent votes and a confirmed status;
+// only the confirmed status reaches live state, streaks and incidents.
+type DetectorService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewDetectorService creates a new DetectorService instance.
+func NewDetectorService(redisClient *redis.Client, ctx context.Context) *DetectorService {
+	return &DetectorService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Confirm records the sample's vote and returns the status in effect after
+// it: the sample's own status once enough recent samples agree, otherwise
+// the previously confirmed one (safe to begin with).
+func (d *DetectorService) Confirm(data Telemetry, rule StatusRule, detector Detector) string {
+	key := fmt.Sprintf("detector:%s:%s", data.VehicleID, data.Source)
+	windowKey := key + ":window"
+	stateKey := key + ":state"
+
+	vote := data.Status
+	if data.Confidence < detector.MinConfidence {
+		vote = lowConfidenceVote
+	}
+
+	pipe := d.redisClient.TxPipeline()
+	pipe.LPush(d.ctx, windowKey, vote)
+	pipe.LTrim(d.ctx, windowKey, 0, int64(max(detector.Window, detector.RecoveryWindow)-1))
+	pipe.Expire(d.ctx, windowKey, DETECTOR_STATE_TTL*time.Second)
+	votes := pipe.LRange(d.ctx, windowKey, 0, -1)
+	state := pipe.Get(d.ctx, stateKey)
+	if _, err := pipe.Exec(d.ctx); err != nil && err != redis.Nil {
+		log.Printf("Detector update failed for %s: %v", key, err)
+		return data.Status // Without history, trust the sample
+	}
+
+	current := state.Val()
+	if current == "" {
+		current = StatusSafe
+	}
+	if vote == lowConfidenceVote || vote == current {
+		d.redisClient.Expire(d.ctx, stateKey, DETECTOR_STATE_TTL*time.Second)
+		return current
+	}
+
+	window, required := detector.Window, detector.Required
+	if rule.Safe {
+		window, required = detector.RecoveryWindow, detector.RecoveryRequired
+	}
+	agreeing := 0
+	for i, v := range votes.Val() {
+		if i < window && v == vote {
+			agreeing++
+		}
+	}
+	if agreeing < required {
+		return current
+	}
+
+	log.Printf("🎯 Detector confirmed %s for %s/%s (%d of last %d samples, was %s)", vote, data.VehicleID, data.Source, agreeing, window, current)
+	d.redisClient.Set(d.ctx, stateKey, vote, DETECTOR_STATE_TTL*time.Second)
+	return vote
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestDetectorServiceHysteresis(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-detector")
+	detectors := NewDetectorService(rdb, ctx)
+
+	rules := defaultRules(t)
+	detector := Detector{MinConfidence: 0.6, Window: 4, Required: 3, RecoveryWindow: 4, RecoveryRequired: 3}
+	confirm := func(status string, confidence float64) string {
+		rule, _ := rules.Lookup(status)
+		return detectors.Confirm(Telemetry{VehicleID: "test-detector", Source: "ai", Status: status, Confidence: confidence}, rule, detector)
+	}
+
+	assert.Equal(t, "safe", confirm("drowsy", 0.9), "a single frame is not enough")
+	assert.Equal(t, "safe", confirm("safe", 0.9))
+	assert.Equal(t, "safe", confirm("drowsy", 0.3), "below min_confidence")
+	assert.Equal(t, "safe", confirm("drowsy", 0.8))
+	assert.Equal(t, "safe", confirm("drowsy", 0.8), "2 of the last 4 confident")
+	assert.Equal(t, "drowsy", confirm("drowsy", 0.8), "3 of the last 4")
+
+	assert.Equal(t, "drowsy", confirm("safe", 0.9), "recovery needs agreement too")
+	assert.Equal(t, "drowsy", confirm("safe", 0.9))
+	assert.Equal(t, "safe", confirm("safe", 0.9))
+}
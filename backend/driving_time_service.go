@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// StatusDrivingTimeViolation is raised when a driver exceeds a driving time
+// limit. Violation says which: continuous, daily or weekly.
+const StatusDrivingTimeViolation = "driving_time_violation"
+
+// Driving time limits that can be violated.
+const (
+	ViolationContinuous = "continuous"
+	ViolationDaily      = "daily"
+	ViolationWeekly     = "weekly"
+)
+
+// DrivingTimeConfig is a rule set for hours of driving, e.g. the EU's 4.5 h
+// then a 45 min break, 9 h a day and 56 h a week.
+type DrivingTimeConfig struct {
+	MaxContinuousMin int64 `json:"max_continuous_min"` // Driving allowed without a break
+	BreakMin         int64 `json:"break_min"`          // Stop that counts as a break and resets continuous driving
+	DailyMaxMin      int64 `json:"daily_max_min"`
+	WeeklyMaxMin     int64 `json:"weekly_max_min"` // Per ISO week
+	ReminderMin      int64 `json:"reminder_min"`   // Remind the driver this long before a break is due
+}
+
+func (c DrivingTimeConfig) validate() error {
+	if c.MaxContinuousMin <= 0 || c.BreakMin <= 0 || c.DailyMaxMin <= 0 || c.WeeklyMaxMin <= 0 {
+		return fmt.Errorf("limits must be positive")
+	}
+	if c.ReminderMin < 0 || c.ReminderMin >= c.MaxContinuousMin {
+		return fmt.Errorf("reminder_min must be between 0 and max_continuous_min")
+	}
+	return nil
+}
+
+// DrivingTime is a driver's hours so far.
+type DrivingTime struct {
+	VehicleID     string           `json:"vehicle_id"`
+	ContinuousSec int64            `json:"continuous_sec"` // Since the last break
+	LastMovingAt  int64            `json:"last_moving_at"`
+	TodaySec      int64            `json:"today_sec"`
+	WeekSec       int64            `json:"week_sec"`
+	DailySec      map[string]int64 `json:"daily_sec"` // UTC date -> seconds, last 7 days
+	BreakDueInSec int64            `json:"break_due_in_sec,omitempty"`
+}
+
+// DrivingTimeService tracks hours of driving per driver (vehicle). Time
+// between two moving samples up to DRIVING_SAMPLE_GAP apart counts as
+// driving; a longer stop of at least break_min is a break. Needs GPS speed.
+type DrivingTimeService struct {
+	redisClient *redis.Client
+	downlink    func(vehicleID string, msg DownlinkMessage) error // nil: no downlink
+	ctx         context.Context
+}
+
+// NewDrivingTimeService creates a new DrivingTimeService instance.
+func NewDrivingTimeService(redisClient *redis.Client, ctx context.Context) *DrivingTimeService {
+	return &DrivingTimeService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Update folds one sample into the driver's hours. It reminds the driver of
+// a due break on the downlink and returns a violation sample per limit
+// exceeded (nil cfg: hours are tracked, limits aren't enforced).
+func (d *DrivingTimeService) Update(data Telemetry, cfg *DrivingTimeConfig) []Telemetry {
+	if data.SpeedKmh < TRIP_MOVING_KMH {
+		return nil // Stops count as breaks once driving resumes
+	}
+	key := fmt.Sprintf("driving:%s", data.VehicleID)
+	state, err := d.redisClient.HGetAll(d.ctx, key).Result()
+	if err != nil {
+		log.Printf("Error getting driving time: %v", err)
+		return nil
+	}
+	num := func(field string) int64 {
+		v, _ := strconv.ParseInt(state[field], 10, 64)
+		return v
+	}
+	lastMovingAt, continuous := num("last_moving_at"), num("continuous_sec")
+	if data.Timestamp <= lastMovingAt {
+		return nil // Backlogged
+	}
+
+	update := map[string]interface{}{"last_moving_at": data.Timestamp}
+	gap := data.Timestamp - lastMovingAt
+	switch {
+	case lastMovingAt != 0 && gap <= DRIVING_SAMPLE_GAP:
+		continuous += gap
+		d.redisClient.HIncrBy(d.ctx, fmt.Sprintf("driving_daily:%s", data.VehicleID), drivingDate(data.Timestamp), gap)
+	case cfg != nil && gap >= cfg.BreakMin*60, lastMovingAt == 0:
+		if continuous > 0 {
+			log.Printf("☕ Break taken by %s (%d min) after %d min of driving", data.VehicleID, gap/60, continuous/60)
+		}
+		continuous = 0
+		update["reminded"], update["violated_continuous"] = 0, 0
+	}
+	update["continuous_sec"] = continuous
+	if err := d.redisClient.HSet(d.ctx, key, update).Err(); err != nil {
+		log.Printf("Failed to update driving time: %v", err)
+	}
+	if cfg == nil {
+		return nil
+	}
+
+	if due := cfg.MaxContinuousMin*60 - continuous; due <= cfg.ReminderMin*60 && due > 0 && state["reminded"] != "1" {
+		d.redisClient.HSet(d.ctx, key, "reminded", 1)
+		d.remind(data.VehicleID, due)
+	}
+
+	var events []Telemetry
+	violation := func(kind, flagField, flagValue string, drivenSec, limitMin int64) {
+		if drivenSec <= limitMin*60 || state[flagField] == flagValue {
+			return
+		}
+		d.redisClient.HSet(d.ctx, key, flagField, flagValue) // Once per period
+		log.Printf("⏱️ Driving time violation (%s) by %s: %d min, limit %d", kind, data.VehicleID, drivenSec/60, limitMin)
+		events = append(events, Telemetry{
+			VehicleID:  data.VehicleID,
+			DeviceID:   data.DeviceID,
+			Timestamp:  data.Timestamp,
+			Status:     StatusDrivingTimeViolation,
+			Lat:        data.Lat,
+			Long:       data.Long,
+			Confidence: 1,
+			SpeedKmh:   data.SpeedKmh,
+			Violation:  kind,
+		})
+	}
+	today, week, err := d.totals(data.VehicleID, data.Timestamp)
+	if err != nil {
+		log.Printf("Error getting driving totals: %v", err)
+	}
+	violation(ViolationContinuous, "violated_continuous", "1", continuous, cfg.MaxContinuousMin)
+	violation(ViolationDaily, "violated_day", drivingDate(data.Timestamp), today, cfg.DailyMaxMin)
+	year, isoWeek := time.Unix(data.Timestamp, 0).UTC().ISOWeek()
+	violation(ViolationWeekly, "violated_week", fmt.Sprintf("%d-W%02d", year, isoWeek), week, cfg.WeeklyMaxMin)
+	return events
+}
+
+// remind pushes a break reminder to the vehicle. It runs inside ingest, so
+// the downlink must only queue the message (see MQTTService.PublishDownlink).
+func (d *DrivingTimeService) remind(vehicleID string, dueInSec int64) {
+	log.Printf("☕ Break reminder for %s: due in %d min", vehicleID, dueInSec/60)
+	if d.downlink == nil {
+		return
+	}
+	msg := DownlinkMessage{
+		Type:       "break_reminder",
+		Message:    fmt.Sprintf("Break due in %d min", (dueInSec+59)/60),
+		TimeoutSec: dueInSec,
+		Timestamp:  time.Now().Unix(),
+	}
+	if err := d.downlink(vehicleID, msg); err != nil {
+		log.Printf("Failed to send break reminder to %s: %v", vehicleID, err)
+	}
+}
+
+// Current returns the driver's hours so far.
+func (d *DrivingTimeService) Current(vehicleID string, cfg *DrivingTimeConfig) (DrivingTime, error) {
+	result := DrivingTime{VehicleID: vehicleID, DailySec: map[string]int64{}}
+	state, err := d.redisClient.HMGet(d.ctx, fmt.Sprintf("driving:%s", vehicleID), "continuous_sec", "last_moving_at").Result()
+	if err != nil {
+		return result, err
+	}
+	if s, ok := state[0].(string); ok {
+		result.ContinuousSec, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s, ok := state[1].(string); ok {
+		result.LastMovingAt, _ = strconv.ParseInt(s, 10, 64)
+	}
+	now := time.Now().Unix()
+	if cfg != nil && now-result.LastMovingAt >= cfg.BreakMin*60 {
+		result.ContinuousSec = 0 // On a break long enough already
+	}
+	if cfg != nil {
+		result.BreakDueInSec = max(0, cfg.MaxContinuousMin*60-result.ContinuousSec)
+	}
+
+	result.TodaySec, result.WeekSec, err = d.totals(vehicleID, now)
+	if err != nil {
+		return result, err
+	}
+	days := make([]string, 7)
+	for i := range days {
+		days[i] = drivingDate(now - int64(i)*24*60*60)
+	}
+	daily, err := d.redisClient.HMGet(d.ctx, fmt.Sprintf("driving_daily:%s", vehicleID), days...).Result()
+	if err != nil {
+		return result, err
+	}
+	for i, v := range daily {
+		sec := int64(0)
+		if s, ok := v.(string); ok {
+			sec, _ = strconv.ParseInt(s, 10, 64)
+		}
+		result.DailySec[days[i]] = sec
+	}
+	return result, nil
+}
+
+// totals returns seconds driven on the UTC day and ISO week of ts.
+func (d *DrivingTimeService) totals(vehicleID string, ts int64) (int64, int64, error) {
+	day := time.Unix(ts, 0).UTC()
+	weekday := (int(day.Weekday()) + 6) % 7 // Monday = 0
+	dates := make([]string, weekday+1)
+	for i := range dates {
+		dates[i] = day.AddDate(0, 0, -i).Format("2006-01-02")
+	}
+	vals, err := d.redisClient.HMGet(d.ctx, fmt.Sprintf("driving_daily:%s", vehicleID), dates...).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	var today, week int64
+	for i, v := range vals {
+		if s, ok := v.(string); ok {
+			sec, _ := strconv.ParseInt(s, 10, 64)
+			week += sec
+			if i == 0 {
+				today = sec
+			}
+		}
+	}
+	return today, week, nil
+}
+
+func drivingDate(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format("2006-01-02")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestDrivingTimeServiceUpdate(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "driving:test-driving", "driving_daily:test-driving")
+	drivingTime := NewDrivingTimeService(rdb, ctx)
+	var sent []DownlinkMessage
+	drivingTime.downlink = func(vehicleID string, msg DownlinkMessage) error {
+		sent = append(sent, msg)
+		return nil
+	}
+
+	cfg := &DrivingTimeConfig{MaxContinuousMin: 10, BreakMin: 5, DailyMaxMin: 15, WeeklyMaxMin: 1000, ReminderMin: 2}
+	const monday = 1704088800 // 2024-01-01 06:00 UTC
+	drive := func(from, to int64) (events []Telemetry) {
+		for ts := from; ts <= to; ts += 60 {
+			data := Telemetry{VehicleID: "test-driving", Timestamp: ts, Status: "safe", Lat: 28.7, Long: 77.1, SpeedKmh: 60}
+			events = append(events, drivingTime.Update(data, cfg)...)
+		}
+		return events
+	}
+
+	// 11 minutes without a break: one reminder, one violation.
+	events := drive(monday, monday+660)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, StatusDrivingTimeViolation, events[0].Status)
+		assert.Equal(t, ViolationContinuous, events[0].Violation)
+		assert.Equal(t, int64(monday+660), events[0].Timestamp)
+	}
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, "break_reminder", sent[0].Type)
+		assert.Equal(t, int64(120), sent[0].TimeoutSec)
+	}
+
+	// Standing still isn't driving, and a 5 minute stop is a break.
+	stopped := Telemetry{VehicleID: "test-driving", Timestamp: monday + 720, Status: "safe", Lat: 28.7, Long: 77.1}
+	assert.Empty(t, drivingTime.Update(stopped, cfg))
+	events = drive(monday+960, monday+1260)
+	if assert.Len(t, events, 1, "over the daily limit, not the continuous one") {
+		assert.Equal(t, ViolationDaily, events[0].Violation)
+	}
+	assert.Empty(t, drive(monday+1320, monday+1380), "violations are raised once per period")
+
+	today, week, err := drivingTime.totals("test-driving", monday+1380)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1080), today)
+	assert.Equal(t, today, week)
+	state, _ := rdb.HGet(ctx, "driving:test-driving", "continuous_sec").Int64()
+	assert.Equal(t, int64(420), state)
+}
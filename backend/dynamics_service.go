@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// Vehicle dynamics statuses raised from raw IMU data. The first two are the
+// labels the Pico buttons used to send.
+const (
+	StatusHardBraking       = "hard braking"
+	StatusHarshTurn         = "harsh turn"
+	StatusHarshAcceleration = "harsh acceleration"
+	StatusSwerve            = "swerve"
+)
+
+// StatusCrash is raised for a high-g impact after which the vehicle stops
+// moving. It is internal: only the backend's own detector may claim a crash.
+const StatusCrash = "CRASH"
+
+var dynamicsStatuses = []string{StatusHardBraking, StatusHarshTurn, StatusHarshAcceleration, StatusSwerve}
+
+// DynamicsConfig holds the g-force thresholds for IMU event detection.
+type DynamicsConfig struct {
+	FilterAlpha    float64 `json:"filter_alpha"`     // Low-pass weight of each new reading (0-1]; 1 = unfiltered
+	BrakeG         float64 `json:"brake_g"`          // Deceleration for hard braking
+	AccelG         float64 `json:"accel_g"`          // Acceleration for harsh acceleration
+	CornerG        float64 `json:"corner_g"`         // Lateral g for harsh cornering
+	MinDurationMs  int64   `json:"min_duration_ms"`  // How long a threshold must hold (filters bumps and potholes)
+	SwerveDps      float64 `json:"swerve_dps"`       // Yaw rate that counts as a steering jerk
+	SwerveWindowMs int64   `json:"swerve_window_ms"` // Max time between opposite jerks of a lane-change swerve
+
+	CrashG       float64 `json:"crash_g,omitempty"`        // Impact that may be a collision; 0 disables crash detection
+	CrashStillMs int64   `json:"crash_still_ms,omitempty"` // How long the vehicle must then lie still to count as a crash
+}
+
+func (c DynamicsConfig) validate() error {
+	switch {
+	case c.FilterAlpha <= 0 || c.FilterAlpha > 1:
+		return fmt.Errorf("filter_alpha must be in (0, 1]")
+	case c.BrakeG <= 0 || c.AccelG <= 0 || c.CornerG <= 0 || c.SwerveDps <= 0:
+		return fmt.Errorf("thresholds must be positive")
+	case c.MinDurationMs < 0 || c.SwerveWindowMs <= 0:
+		return fmt.Errorf("min_duration_ms must not be negative and swerve_window_ms must be positive")
+	case c.CrashG < 0 || (c.CrashG > 0 && c.CrashStillMs <= 0):
+		return fmt.Errorf("crash_g must not be negative and needs a positive crash_still_ms")
+	}
+	return nil
+}
+
+// yawSwerved marks a jerk that already completed a swerve; it must end
+// before the next swerve can start.
+const yawSwerved = 2
+
+// imuState carries filters and detectors across messages, since an event
+// can straddle two chunks of IMU data.
+type imuState struct {
+	LastMs    int64              `json:"last_ms"`
+	Ax        float64            `json:"ax"` // Filtered values
+	Ay        float64            `json:"ay"`
+	Gz        float64            `json:"gz"`
+	Since     map[string]int64   `json:"since"` // Event -> ms its threshold was first exceeded
+	Peak      map[string]float64 `json:"peak"`
+	Fired     map[string]bool    `json:"fired"`   // Already emitted for the current excursion
+	YawDir    int                `json:"yaw_dir"` // Direction of the last steering jerk, or yawSwerved
+	YawLastMs int64              `json:"yaw_last_ms"`
+
+	ImpactMs   int64   `json:"impact_ms,omitempty"` // Unconfirmed crash: when the impact happened...
+	ImpactG    float64 `json:"impact_g,omitempty"`
+	StillSince int64   `json:"still_since,omitempty"` // ...and since when the vehicle has been still
+}
+
+// DynamicsService detects harsh braking, acceleration, cornering,
+// lane-change swerves and crashes from raw accelerometer/gyroscope readings.
+type DynamicsService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewDynamicsService creates a new DynamicsService instance.
+func NewDynamicsService(redisClient *redis.Client, ctx context.Context) *DynamicsService {
+	return &DynamicsService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Detect runs the sample's IMU readings through the detectors and returns one
+// derived sample per event, timestamped when the event started.
+func (d *DynamicsService) Detect(data Telemetry, cfg DynamicsConfig) []Telemetry {
+	key := fmt.Sprintf("imu:%s:%s", data.VehicleID, deviceName(data))
+	var st imuState
+	if val, err := d.redisClient.Get(d.ctx, key).Bytes(); err == nil {
+		json.Unmarshal(val, &st)
+	}
+
+	readings := append([]IMUSample(nil), data.IMU...)
+	sort.SliceStable(readings, func(i, j int) bool { return readings[i].OffsetMs < readings[j].OffsetMs })
+
+	var events []Telemetry
+	emit := func(status string, startMs int64, peak float64) {
+		event := Telemetry{
+			VehicleID:  data.VehicleID,
+			DeviceID:   data.DeviceID,
+			Timestamp:  startMs / 1000,
+			Status:     status,
+			Source:     "iot",
+			Lat:        data.Lat,
+			Long:       data.Long,
+			Confidence: 1, // Measured, not inferred
+			PeakG:      math.Round(peak*100) / 100,
+		}
+		log.Printf("🏎️ IMU detected %s for %s (peak %.2f)", status, data.VehicleID, peak)
+		events = append(events, event)
+	}
+
+	for _, r := range readings {
+		t := data.Timestamp*1000 + r.OffsetMs
+		if st.LastMs == 0 || t-st.LastMs > IMU_MAX_GAP_MS || t < st.LastMs {
+			// Start over after a gap (or out-of-order data) rather than
+			// filtering across it.
+			st = imuState{Ax: r.Ax, Ay: r.Ay, Gz: r.Gz, ImpactMs: st.ImpactMs, ImpactG: st.ImpactG}
+		}
+		st.LastMs = t
+		st.Ax += cfg.FilterAlpha * (r.Ax - st.Ax)
+		st.Ay += cfg.FilterAlpha * (r.Ay - st.Ay)
+		st.Gz += cfg.FilterAlpha * (r.Gz - st.Gz)
+
+		for _, c := range []struct {
+			status    string
+			value     float64
+			threshold float64
+		}{
+			{StatusHardBraking, -st.Ax, cfg.BrakeG},
+			{StatusHarshAcceleration, st.Ax, cfg.AccelG},
+			{StatusHarshTurn, math.Abs(st.Ay), cfg.CornerG},
+		} {
+			if startMs, peak, fire := st.sustained(c.status, c.value, c.threshold, t, cfg.MinDurationMs); fire {
+				emit(c.status, startMs, peak)
+			}
+		}
+
+		// Lane-change swerve: a steering jerk one way, then the other.
+		switch {
+		case math.Abs(st.Gz) < cfg.SwerveDps:
+			if st.YawDir == yawSwerved {
+				st.YawDir = 0
+			}
+		case st.YawDir == yawSwerved:
+			// Still in the jerk that completed the last swerve
+		default:
+			dir := 1
+			if st.Gz < 0 {
+				dir = -1
+			}
+			if st.YawDir == -dir && t-st.YawLastMs <= cfg.SwerveWindowMs {
+				emit(StatusSwerve, st.YawLastMs, math.Abs(st.Gz))
+				st.YawDir = yawSwerved
+			} else {
+				st.YawDir, st.YawLastMs = dir, t
+			}
+		}
+
+		// Crash: an impact (unfiltered, impacts are short), then no movement.
+		if cfg.CrashG > 0 {
+			st.detectCrash(r, t, cfg, emit)
+		}
+	}
+
+	stateJSON, _ := json.Marshal(st)
+	d.redisClient.Set(d.ctx, key, stateJSON, 10*time.Second)
+	return events
+}
+
+// sustained tracks one threshold detector and reports when the value has
+// stayed above the threshold for minMs, once per excursion.
+func (st *imuState) sustained(name string, value, threshold float64, t, minMs int64) (int64, float64, bool) {
+	if st.Since == nil {
+		st.Since, st.Peak, st.Fired = map[string]int64{}, map[string]float64{}, map[string]bool{}
+	}
+	if value < threshold {
+		delete(st.Since, name)
+		delete(st.Peak, name)
+		delete(st.Fired, name)
+		return 0, 0, false
+	}
+	if _, ok := st.Since[name]; !ok {
+		st.Since[name] = t
+	}
+	st.Peak[name] = math.Max(st.Peak[name], value)
+	if st.Fired[name] || t-st.Since[name] < minMs {
+		return 0, 0, false
+	}
+	st.Fired[name] = true
+	return st.Since[name], st.Peak[name], true
+}
+
+// detectCrash tracks a possible collision. Potholes and kerbs can also spike
+// the accelerometer, so an impact only counts once the vehicle has been
+// still for CrashStillMs; one that drives on is dropped after CRASH_SETTLE_MS.
+func (st *imuState) detectCrash(r IMUSample, t int64, cfg DynamicsConfig, emit func(string, int64, float64)) {
+	if g := math.Sqrt(r.Ax*r.Ax + r.Ay*r.Ay + (r.Az-1)*(r.Az-1)); g >= cfg.CrashG {
+		if st.ImpactMs == 0 {
+			st.ImpactMs = t
+		}
+		st.ImpactG = math.Max(st.ImpactG, g)
+		st.StillSince = 0
+		return
+	}
+	if st.ImpactMs == 0 {
+		return
+	}
+
+	still := math.Abs(math.Sqrt(r.Ax*r.Ax+r.Ay*r.Ay+r.Az*r.Az)-1) < CRASH_STILL_G &&
+		math.Max(math.Abs(r.Gx), math.Max(math.Abs(r.Gy), math.Abs(r.Gz))) < CRASH_STILL_DPS
+	switch {
+	case !still:
+		st.StillSince = 0
+	case st.StillSince == 0:
+		st.StillSince = t
+	}
+
+	switch {
+	case st.StillSince != 0 && t-st.StillSince >= cfg.CrashStillMs:
+		emit(StatusCrash, st.ImpactMs, st.ImpactG)
+	case st.StillSince == 0 && t-st.ImpactMs > CRASH_SETTLE_MS:
+		log.Printf("🏎️ IMU impact of %.1fg dropped: vehicle kept moving", st.ImpactG)
+	default:
+		return
+	}
+	st.ImpactMs, st.ImpactG, st.StillSince = 0, 0, 0
+}
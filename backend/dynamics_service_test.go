@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestDynamicsServiceDetect(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "imu:test-imu:pico-w")
+	dynamics := NewDynamicsService(rdb, ctx)
+
+	rules := defaultRules(t)
+	cfg := *rules.Dynamics
+
+	// 50 Hz readings built from fn(ms since the start of the chunk).
+	chunk := func(ts int64, n int, fn func(ms int64) IMUSample) Telemetry {
+		data := Telemetry{VehicleID: "test-imu", DeviceID: "pico-w", Timestamp: ts, Status: "safe_vehicle"}
+		for i := 0; i < n; i++ {
+			r := fn(int64(i) * 20)
+			r.OffsetMs = int64(i) * 20
+			r.Az = 1
+			data.IMU = append(data.IMU, r)
+		}
+		return data
+	}
+
+	// A pothole: one 80 ms spike is filtered out.
+	events := dynamics.Detect(chunk(1000, 50, func(ms int64) IMUSample {
+		if ms >= 200 && ms < 280 {
+			return IMUSample{Ax: -1.2}
+		}
+		return IMUSample{}
+	}), cfg)
+	assert.Empty(t, events)
+
+	// Braking held for 600 ms, spread over two chunks, fires once.
+	braking := func(ms int64) IMUSample {
+		if ms >= 700 {
+			return IMUSample{Ax: -0.7}
+		}
+		return IMUSample{}
+	}
+	events = dynamics.Detect(chunk(1001, 50, braking), cfg)
+	events = append(events, dynamics.Detect(chunk(1002, 15, func(int64) IMUSample { return IMUSample{Ax: -0.7} }), cfg)...)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, StatusHardBraking, events[0].Status)
+		assert.Equal(t, int64(1001), events[0].Timestamp)
+		assert.Equal(t, "iot", events[0].Source)
+		assert.InDelta(t, 0.7, events[0].PeakG, 0.05)
+	}
+
+	// A lane change: steer left, then right within a second.
+	events = dynamics.Detect(chunk(1010, 50, func(ms int64) IMUSample {
+		switch {
+		case ms >= 100 && ms < 400:
+			return IMUSample{Gz: 25}
+		case ms >= 600 && ms < 900:
+			return IMUSample{Gz: -25}
+		}
+		return IMUSample{}
+	}), cfg)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, StatusSwerve, events[0].Status)
+	}
+}
+
+func TestDynamicsServiceCrash(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "imu:test-crash:pico-w")
+	dynamics := NewDynamicsService(rdb, ctx)
+
+	rules := defaultRules(t)
+	cfg := *rules.Dynamics
+
+	// 50 Hz readings for one second; impact is the index of a 6 g hit.
+	second := func(ts int64, impact int, moving bool) Telemetry {
+		data := Telemetry{VehicleID: "test-crash", DeviceID: "pico-w", Timestamp: ts, Status: "safe_vehicle"}
+		for i := 0; i < 50; i++ {
+			r := IMUSample{OffsetMs: int64(i) * 20, Az: 1}
+			if i == impact {
+				r.Ax = -6
+			}
+			if moving {
+				r.Ax, r.Gz = 0.2, 8
+			}
+			data.IMU = append(data.IMU, r)
+		}
+		return data
+	}
+
+	// A kerb strike the vehicle drives on from is not a crash.
+	events := dynamics.Detect(second(2000, 10, false), cfg)
+	for ts := int64(2001); ts < 2008; ts++ {
+		events = append(events, dynamics.Detect(second(ts, -1, true), cfg)...)
+	}
+	assert.Empty(t, events)
+
+	// An impact, then the vehicle lies still.
+	events = nil
+	for ts := int64(2010); ts < 2015; ts++ {
+		impact := -1
+		if ts == 2010 {
+			impact = 25
+		}
+		events = append(events, dynamics.Detect(second(ts, impact, false), cfg)...)
+	}
+	var crashes []Telemetry
+	for _, e := range events {
+		if e.Status == StatusCrash {
+			crashes = append(crashes, e)
+		}
+	}
+	if assert.Len(t, crashes, 1) {
+		assert.Equal(t, int64(2010), crashes[0].Timestamp)
+		assert.Equal(t, 6.0, crashes[0].PeakG)
+	}
+}
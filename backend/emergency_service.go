@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+const (
+	EmergencyAwaiting  = "awaiting_response"
+	EmergencyCancelled = "cancelled"
+	EmergencyEscalated = "escalated"
+)
+
+// pendingEmergenciesKey orders unanswered emergencies by deadline.
+const pendingEmergenciesKey = "emergencies_pending"
+
+var errNoEmergency = errors.New("no active emergency")
+
+// EmergencyService runs the emergency workflow: on a crash (or any status
+// whose rule sets "emergency") it asks the driver "are you OK" on the vehicle
+// downlink, and alerts the vehicle's emergency contacts if nobody cancels
+// within EMERGENCY_RESPONSE_TIMEOUT seconds.
+type EmergencyService struct {
+	redisClient *redis.Client
+	downlink    func(vehicleID string, msg DownlinkMessage) error // nil: no downlink (e.g. MQTT not connected)
+	webhookURL  string                                            // Notification gateway for contacts; empty: log only
+	ctx         context.Context
+}
+
+// NewEmergencyService creates a new EmergencyService instance.
+func NewEmergencyService(redisClient *redis.Client, ctx context.Context) *EmergencyService {
+	return &EmergencyService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Start opens an emergency for an incident and prompts the driver. A vehicle
+// has at most one emergency awaiting a response; a second impact while the
+// first is unanswered is part of the same emergency.
+func (s *EmergencyService) Start(data Telemetry, incidentID string) *Emergency {
+	activeKey := fmt.Sprintf("emergency_active:%s", data.VehicleID)
+	if current, ok := s.Active(data.VehicleID); ok && current.State == EmergencyAwaiting {
+		return nil
+	}
+
+	id, err := newEmergencyID()
+	if err != nil {
+		log.Printf("Failed to start emergency for %s: %v", data.VehicleID, err)
+		return nil
+	}
+	now := time.Now().Unix()
+	emergency := Emergency{
+		ID:         id,
+		VehicleID:  data.VehicleID,
+		IncidentID: incidentID,
+		Type:       data.Status,
+		State:      EmergencyAwaiting,
+		Timestamp:  data.Timestamp,
+		Lat:        data.Lat,
+		Long:       data.Long,
+		PeakG:      data.PeakG,
+		HeartRate:  data.HeartRate,
+		CreatedAt:  now,
+		Deadline:   now + EMERGENCY_RESPONSE_TIMEOUT,
+	}
+	s.save(emergency)
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.Set(s.ctx, activeKey, emergency.ID, EMERGENCY_RETENTION*time.Second)
+	pipe.ZAdd(s.ctx, pendingEmergenciesKey, &redis.Z{Score: float64(emergency.Deadline), Member: emergency.ID})
+	pipe.LPush(s.ctx, fmt.Sprintf("emergencies:%s", data.VehicleID), emergency.ID)
+	pipe.LTrim(s.ctx, fmt.Sprintf("emergencies:%s", data.VehicleID), 0, 19)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Failed to index emergency %s: %v", emergency.ID, err)
+	}
+	log.Printf("🚨 EMERGENCY %s: %s for %s, asking driver (contacts alerted in %ds)", emergency.ID, emergency.Type, emergency.VehicleID, EMERGENCY_RESPONSE_TIMEOUT)
+
+	s.send(emergency, "are_you_ok", EMERGENCY_RESPONSE_TIMEOUT)
+	return &emergency
+}
+
+// Cancel records that the driver is OK. Cancelling after the contacts were
+// alerted tells them to stand down.
+func (s *EmergencyService) Cancel(vehicleID, by string) (Emergency, error) {
+	emergency, ok := s.Active(vehicleID)
+	if !ok || emergency.State == EmergencyCancelled {
+		return Emergency{}, errNoEmergency
+	}
+
+	// Whoever removes it from the pending set first decides between
+	// cancellation and escalation.
+	removed, err := s.redisClient.ZRem(s.ctx, pendingEmergenciesKey, emergency.ID).Result()
+	if err != nil {
+		return Emergency{}, err
+	}
+	escalated := removed == 0
+	if escalated {
+		emergency, _ = s.get(emergency.ID) // Reload what the escalation stored
+	}
+
+	emergency.State = EmergencyCancelled
+	emergency.CancelledAt = time.Now().Unix()
+	emergency.CancelledBy = by
+	s.save(emergency)
+	log.Printf("🙆 Emergency %s cancelled for %s (by %s)", emergency.ID, vehicleID, by)
+
+	s.send(emergency, "emergency_cancelled", 0)
+	if escalated {
+		go s.notify("cancelled", emergency)
+	}
+	return emergency, nil
+}
+
+// EscalateExpired alerts the contacts of every emergency nobody answered in time.
+func (s *EmergencyService) EscalateExpired() {
+	ids, err := s.redisClient.ZRangeByScore(s.ctx, pendingEmergenciesKey, &redis.ZRangeBy{
+		Min: "-inf", Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		log.Printf("Error getting pending emergencies: %v", err)
+		return
+	}
+	for _, id := range ids {
+		if removed, err := s.redisClient.ZRem(s.ctx, pendingEmergenciesKey, id).Result(); err != nil || removed == 0 {
+			continue // Cancelled meanwhile
+		}
+		emergency, ok := s.get(id)
+		if !ok {
+			continue
+		}
+		contacts, err := s.Contacts(emergency.VehicleID)
+		if err != nil {
+			log.Printf("Error getting emergency contacts for %s: %v", emergency.VehicleID, err)
+		}
+
+		emergency.State = EmergencyEscalated
+		emergency.EscalatedAt = time.Now().Unix()
+		emergency.Contacts = contacts
+		s.save(emergency)
+		log.Printf("🆘 EMERGENCY %s ESCALATED: no response from %s, alerting %d contacts", emergency.ID, emergency.VehicleID, len(contacts))
+
+		s.send(emergency, "emergency_escalated", 0)
+		go s.notify("escalated", emergency)
+	}
+}
+
+// WatchForExpired runs EscalateExpired every interval.
+func (s *EmergencyService) WatchForExpired(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.EscalateExpired()
+	}
+}
+
+// Active returns the vehicle's latest emergency, if it is recent enough to
+// still matter.
+func (s *EmergencyService) Active(vehicleID string) (Emergency, bool) {
+	id, err := s.redisClient.Get(s.ctx, fmt.Sprintf("emergency_active:%s", vehicleID)).Result()
+	if err != nil {
+		return Emergency{}, false
+	}
+	return s.get(id)
+}
+
+// Contacts returns who to alert for a vehicle.
+func (s *EmergencyService) Contacts(vehicleID string) ([]EmergencyContact, error) {
+	contacts := []EmergencyContact{}
+	val, err := s.redisClient.Get(s.ctx, fmt.Sprintf("emergency_contacts:%s", vehicleID)).Bytes()
+	if err == redis.Nil {
+		return contacts, nil
+	} else if err != nil {
+		return contacts, err
+	}
+	return contacts, json.Unmarshal(val, &contacts)
+}
+
+// SetContacts replaces the emergency contacts of a vehicle.
+func (s *EmergencyService) SetContacts(vehicleID string, contacts []EmergencyContact) error {
+	contactsJSON, _ := json.Marshal(contacts)
+	return s.redisClient.Set(s.ctx, fmt.Sprintf("emergency_contacts:%s", vehicleID), contactsJSON, 0).Err()
+}
+
+// send publishes an emergency update on the vehicle downlink.
+func (s *EmergencyService) send(emergency Emergency, msgType string, timeoutSec int64) {
+	if s.downlink == nil {
+		log.Printf("No downlink for %s; %s not delivered", emergency.VehicleID, msgType)
+		return
+	}
+	msg := DownlinkMessage{
+		Type:        msgType,
+		EmergencyID: emergency.ID,
+		Status:      emergency.Type,
+		TimeoutSec:  timeoutSec,
+		Timestamp:   time.Now().Unix(),
+	}
+	if err := s.downlink(emergency.VehicleID, msg); err != nil {
+		log.Printf("Failed to send %s to %s: %v", msgType, emergency.VehicleID, err)
+	}
+}
+
+// notify hands the emergency to the notification gateway (SMS, calls, ...),
+// which alerts the contacts listed in it.
+func (s *EmergencyService) notify(event string, emergency Emergency) {
+	if s.webhookURL == "" {
+		log.Printf("📵 No EMERGENCY_WEBHOOK_URL set; contacts of %s not notified (%s)", emergency.VehicleID, event)
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{"event": event, "emergency": emergency})
+	client := http.Client{Timeout: EMERGENCY_WEBHOOK_TIMEOUT * time.Second}
+	resp, err := client.Post(s.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("❌ Emergency notification failed for %s: %v", emergency.ID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("❌ Emergency notification for %s rejected: %s", emergency.ID, resp.Status)
+	}
+}
+
+func (s *EmergencyService) save(emergency Emergency) {
+	emergencyJSON, _ := json.Marshal(emergency)
+	err := s.redisClient.Set(s.ctx, fmt.Sprintf("emergency:%s", emergency.ID), emergencyJSON, EMERGENCY_RETENTION*time.Second).Err()
+	if err != nil {
+		log.Printf("Failed to save emergency %s: %v", emergency.ID, err)
+	}
+}
+
+func (s *EmergencyService) get(id string) (Emergency, bool) {
+	var emergency Emergency
+	val, err := s.redisClient.Get(s.ctx, fmt.Sprintf("emergency:%s", id)).Bytes()
+	if err != nil || json.Unmarshal(val, &emergency) != nil {
+		return emergency, false
+	}
+	return emergency, true
+}
+
+func newEmergencyID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("could not generate emergency id: %v", err)
+	}
+	return "emg_" + hex.EncodeToString(buf), nil
+}
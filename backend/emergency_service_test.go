@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestEmergencyServiceWorkflow(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "emergency_active:test-emergency", "emergencies:test-emergency", pendingEmergenciesKey)
+	emergencies := NewEmergencyService(rdb, ctx)
+
+	var sent []string
+	emergencies.downlink = func(vehicleID string, msg DownlinkMessage) error {
+		assert.Equal(t, "test-emergency", vehicleID)
+		sent = append(sent, msg.Type)
+		return nil
+	}
+	assert.NoError(t, emergencies.SetContacts("test-emergency", []EmergencyContact{{Name: "Asha", Phone: "+910000000000"}}))
+	crash := Telemetry{VehicleID: "test-emergency", Status: StatusCrash, Timestamp: 1000, PeakG: 6}
+
+	// The driver answers in time.
+	emergency := emergencies.Start(crash, "inc_1")
+	if assert.NotNil(t, emergency) {
+		assert.Equal(t, EmergencyAwaiting, emergency.State)
+	}
+	assert.Nil(t, emergencies.Start(crash, "inc_2"), "one emergency at a time")
+	cancelled, err := emergencies.Cancel("test-emergency", "device")
+	assert.NoError(t, err)
+	assert.Equal(t, EmergencyCancelled, cancelled.State)
+	_, err = emergencies.Cancel("test-emergency", "device")
+	assert.Equal(t, errNoEmergency, err)
+
+	// Nobody answers: the contacts are alerted once the deadline passes.
+	emergency = emergencies.Start(crash, "inc_3")
+	if !assert.NotNil(t, emergency) {
+		return
+	}
+	emergencies.EscalateExpired()
+	current, _ := emergencies.Active("test-emergency")
+	assert.Equal(t, EmergencyAwaiting, current.State, "not before the deadline")
+
+	rdb.ZAdd(ctx, pendingEmergenciesKey, &redis.Z{Score: 0, Member: emergency.ID})
+	emergencies.EscalateExpired()
+	current, _ = emergencies.Active("test-emergency")
+	assert.Equal(t, EmergencyEscalated, current.State)
+	assert.Len(t, current.Contacts, 1)
+
+	cancelled, err = emergencies.Cancel("test-emergency", "admin")
+	assert.NoError(t, err)
+	assert.Equal(t, EmergencyCancelled, cancelled.State)
+	assert.NotZero(t, cancelled.EscalatedAt, "stand-down keeps the escalation on record")
+
+	assert.Equal(t, []string{"are_you_ok", "emergency_cancelled", "are_you_ok", "emergency_escalated", "emergency_cancelled"}, sent)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+)
+
+// RunEncode converts a JSON telemetry sample, array or TelemetryBatch read
+// from stdin into the encoding named by args[0] ("json", "cbor", "proto" or
+// "proto-batch")
+// and writes the raw bytes to stdout, e.g.:
+//
+//	echo '{"vehicle_id":"v-101","status":"safe"}' | ./saferide-engine encode cbor | mosquitto_pub -t vehicles/v-101/telemetry/cbor -s
+func RunEncode(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Usage: saferide-engine encode <json|cbor|proto|proto-batch> < sample.json")
+	}
+	enc, ok := ParseTelemetryEncoding(args[0])
+	if !ok {
+		log.Fatalf("Unknown encoding %q (want json, cbor, proto or proto-batch)", args[0])
+	}
+
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Failed to read stdin: %v", err)
+	}
+	batch, err := DecodeTelemetry(input, EncodingJSON)
+	if err != nil {
+		log.Fatalf("Invalid JSON sample: %v", err)
+	}
+
+	// A lone sample stays a Telemetry message; arrays and batches become a
+	// TelemetryBatch, which Protobuf senders must declare as proto-batch.
+	var out []byte
+	trimmed := bytes.TrimSpace(input)
+	lone := len(batch.Samples) == 1 && trimmed[0] == '{' && !bytes.Contains(trimmed, []byte(`"samples"`))
+	switch {
+	case enc == EncodingProtobuf && !lone:
+		log.Fatalf("A batch is a TelemetryBatch message: encode it as proto-batch")
+	case enc != EncodingProtobufBatch && lone:
+		out, err = EncodeTelemetry(batch.Samples[0], enc)
+	default:
+		out, err = EncodeTelemetryBatch(batch, enc)
+	}
+	if err != nil {
+		log.Fatalf("Failed to encode: %v", err)
+	}
+	os.Stdout.Write(out)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// Patterns real devices don't produce but scripts publishing "safe" do.
+// Values a device has never been seen to change (the CV agent's fixed
+// position, a detector's constant confidence) are placeholders, not
+// readings, and aren't checked.
+const (
+	FraudStaticLocation   = "static_location"   // A live GPS stuck on bit-identical fixes; real GPS wanders even when parked
+	FraudFixedConfidence  = "fixed_confidence"  // A varying detector confidence stuck on one value
+	FraudFixedCadence     = "fixed_cadence"     // Messages arriving at a near-perfect interval
+	FraudDuplicatePayload = "duplicate_payload" // Same readings at the same time and live position from several vehicles
+	FraudGPSJump          = "gps_jump"          // Fixes implying impossible speed
+)
+
+const (
+	FraudQuarantined = "quarantined" // Earns no rewards, awaiting review
+	FraudCleared     = "cleared"
+	FraudConfirmed   = "confirmed" // Stays quarantined
+)
+
+// Keys shared by all vehicles: cases awaiting review, ordered by when they
+// were flagged, and the vehicles currently quarantined.
+const (
+	fraudReviewKey      = "fraud_review"
+	fraudQuarantinedKey = "fraud_quarantined"
+)
+
+var errNoFraudCase = errors.New("no fraud case")
+
+// FraudCase is what an admin reviews: which checks fired and why.
+type FraudCase struct {
+	VehicleID  string          `json:"vehicle_id"`
+	State      string          `json:"state"`
+	Signals    map[string]int  `json:"signals"`  // Times each check fired
+	Evidence   []FraudEvidence `json:"evidence"` // Newest first, up to FRAUD_MAX_EVIDENCE
+	FlaggedAt  int64           `json:"flagged_at"`
+	UpdatedAt  int64           `json:"updated_at"`
+	ReviewedAt int64           `json:"reviewed_at,omitempty"`
+	Note       string          `json:"note,omitempty"`   // Reviewer's note
+	Exempt     []string        `json:"exempt,omitempty"` // Signals a reviewer cleared; they don't quarantine the vehicle again
+}
+
+// FraudEvidence is one check firing.
+type FraudEvidence struct {
+	Signal    string `json:"signal"`
+	Detail    string `json:"detail"`
+	Timestamp int64  `json:"timestamp"` // Time of the sample that fired it
+}
+
+// fraudState is what the checks remember about a vehicle between samples.
+type fraudState struct {
+	Lat              float64 `json:"lat"`
+	Long             float64 `json:"long"`
+	FixTs            int64   `json:"fix_ts"`
+	FixVaried        bool    `json:"fix_varied"` // The fix has changed, so it is a live one
+	SameFix          int     `json:"same_fix"`
+	ConfStatus       string  `json:"conf_status"` // Status the confidence was reported for
+	Confidence       float64 `json:"confidence"`
+	ConfidenceVaried bool    `json:"confidence_varied"` // Confidence has changed within one status
+	SameConfidence   int     `json:"same_confidence"`
+	ArrivalMs        int64   `json:"arrival_ms"`
+	IntervalsMs      []int64 `json:"intervals_ms"`
+}
+
+// FraudService looks for point farming: telemetry that is too regular or
+// too repetitive to come from a real vehicle. Flagged vehicles are
+// quarantined from earning rewards until an admin reviews them.
+type FraudService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewFraudService creates a new FraudService instance.
+func NewFraudService(redisClient *redis.Client, ctx context.Context) *FraudService {
+	return &FraudService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Inspect runs the checks on a sample as the device sent it. receivedAtMs
+// is the server time its message arrived.
+func (f *FraudService) Inspect(data Telemetry, receivedAtMs int64) {
+	key := fmt.Sprintf("fraud_state:%s", data.VehicleID)
+	var st fraudState
+	if val, err := f.redisClient.Get(f.ctx, key).Bytes(); err == nil {
+		json.Unmarshal(val, &st)
+	}
+
+	hasFix := data.Lat != 0 || data.Long != 0
+	if hasFix {
+		if st.FixTs != 0 && data.Timestamp > st.FixTs {
+			meters := haversineMeters(st.Lat, st.Long, data.Lat, data.Long)
+			if speed := meters / 1000 / (float64(data.Timestamp-st.FixTs) / 3600); speed > GPS_MAX_SPEED_KMH {
+				f.flag(data, FraudGPSJump, fmt.Sprintf("%.0f m in %ds", meters, data.Timestamp-st.FixTs))
+			}
+		}
+		if data.Lat == st.Lat && data.Long == st.Long {
+			st.SameFix++
+		} else {
+			st.FixVaried = st.FixVaried || st.FixTs != 0
+			st.SameFix = 1
+		}
+		if st.FixVaried && st.SameFix == FRAUD_REPEAT_SAMPLES {
+			f.flag(data, FraudStaticLocation, fmt.Sprintf("%d fixes at exactly %.6f,%.6f", st.SameFix, data.Lat, data.Long))
+		}
+		st.Lat, st.Long, st.FixTs = data.Lat, data.Long, max(st.FixTs, data.Timestamp)
+		if st.FixVaried {
+			f.checkDuplicate(data)
+		}
+	}
+
+	// Confidence is compared within one status: detectors may report a
+	// different fixed value per status.
+	if data.Confidence != 0 {
+		switch {
+		case data.Status != st.ConfStatus:
+			st.ConfStatus, st.Confidence, st.SameConfidence = data.Status, data.Confidence, 1
+		case data.Confidence == st.Confidence:
+			st.SameConfidence++
+		default:
+			st.ConfidenceVaried = true
+			st.Confidence, st.SameConfidence = data.Confidence, 1
+		}
+		if st.ConfidenceVaried && st.SameConfidence == FRAUD_REPEAT_SAMPLES {
+			f.flag(data, FraudFixedConfidence, fmt.Sprintf("%d samples at confidence %.4f", st.SameConfidence, data.Confidence))
+		}
+	}
+
+	// Samples of one message arrive together; only messages have a cadence.
+	if interval := receivedAtMs - st.ArrivalMs; st.ArrivalMs != 0 && interval > 0 {
+		if interval > FRAUD_CADENCE_MAX_MS {
+			st.IntervalsMs = nil
+		} else {
+			st.IntervalsMs = append(st.IntervalsMs, interval)
+		}
+		if len(st.IntervalsMs) >= FRAUD_CADENCE_SAMPLES {
+			lo, hi := st.IntervalsMs[0], st.IntervalsMs[0]
+			for _, ms := range st.IntervalsMs {
+				lo, hi = min(lo, ms), max(hi, ms)
+			}
+			if hi-lo <= FRAUD_CADENCE_JITTER_MS {
+				f.flag(data, FraudFixedCadence, fmt.Sprintf("%d messages %d-%d ms apart", len(st.IntervalsMs)+1, lo, hi))
+			}
+			st.IntervalsMs = nil
+		}
+	}
+	if receivedAtMs > st.ArrivalMs {
+		st.ArrivalMs = receivedAtMs
+	}
+
+	stateJSON, _ := json.Marshal(st)
+	f.redisClient.Set(f.ctx, key, stateJSON, FRAUD_STATE_TTL*time.Second)
+}
+
+// checkDuplicate flags vehicles reporting the same readings for the same
+// second at the same live position, within FRAUD_DUPLICATE_WINDOW seconds.
+func (f *FraudService) checkDuplicate(data Telemetry) {
+	fingerprint := fmt.Sprintf("%d|%s|%.7f|%.7f|%.4f|%d", data.Timestamp, data.Status, data.Lat, data.Long, data.Confidence, data.HeartRate)
+	sum := sha256.Sum256([]byte(fingerprint))
+	key := "fraud_payload:" + hex.EncodeToString(sum[:16])
+
+	pipe := f.redisClient.TxPipeline()
+	pipe.SAdd(f.ctx, key, data.VehicleID)
+	pipe.Expire(f.ctx, key, FRAUD_DUPLICATE_WINDOW*time.Second)
+	members := pipe.SMembers(f.ctx, key)
+	if _, err := pipe.Exec(f.ctx); err != nil {
+		log.Printf("Error checking duplicate payloads: %v", err)
+		return
+	}
+	vehicles := members.Val()
+	if len(vehicles) < 2 {
+		return
+	}
+	for _, vehicleID := range vehicles {
+		other := data
+		other.VehicleID = vehicleID
+		f.flag(other, FraudDuplicatePayload, fmt.Sprintf("%q also sent by %v", fingerprint, vehicles))
+	}
+	f.redisClient.Del(f.ctx, key) // Flag each group once
+}
+
+// flag records a check firing and quarantines the vehicle.
+func (f *FraudService) flag(data Telemetry, signal, detail string) {
+	fraudCase, ok := f.Get(data.VehicleID)
+	now := time.Now().Unix()
+	if slices.Contains(fraudCase.Exempt, signal) {
+		return
+	}
+	if !ok || fraudCase.State == FraudCleared {
+		fraudCase = FraudCase{VehicleID: data.VehicleID, Signals: map[string]int{}, FlaggedAt: now, Exempt: fraudCase.Exempt}
+	}
+	if fraudCase.State == "" {
+		fraudCase.State = FraudQuarantined
+		pipe := f.redisClient.TxPipeline()
+		pipe.SAdd(f.ctx, fraudQuarantinedKey, data.VehicleID)
+		pipe.ZAdd(f.ctx, fraudReviewKey, &redis.Z{Score: float64(now), Member: data.VehicleID})
+		if _, err := pipe.Exec(f.ctx); err != nil {
+			log.Printf("Failed to quarantine %s: %v", data.VehicleID, err)
+		}
+		log.Printf("🕵️ %s quarantined for review: %s (%s)", data.VehicleID, signal, detail)
+	}
+
+	fraudCase.Signals[signal]++
+	fraudCase.Evidence = append([]FraudEvidence{{Signal: signal, Detail: detail, Timestamp: data.Timestamp}}, fraudCase.Evidence...)
+	if len(fraudCase.Evidence) > FRAUD_MAX_EVIDENCE {
+		fraudCase.Evidence = fraudCase.Evidence[:FRAUD_MAX_EVIDENCE]
+	}
+	fraudCase.UpdatedAt = now
+	f.save(fraudCase)
+}
+
+// Quarantined reports whether a vehicle is barred from earning rewards.
+func (f *FraudService) Quarantined(vehicleID string) bool {
+	quarantined, err := f.redisClient.SIsMember(f.ctx, fraudQuarantinedKey, vehicleID).Result()
+	return err == nil && quarantined
+}
+
+// Queue returns the cases awaiting review, oldest first.
+func (f *FraudService) Queue(limit int) ([]FraudCase, error) {
+	ids, err := f.redisClient.ZRange(f.ctx, fraudReviewKey, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	cases := []FraudCase{}
+	for _, id := range ids {
+		if fraudCase, ok := f.Get(id); ok {
+			cases = append(cases, fraudCase)
+		}
+	}
+	return cases, nil
+}
+
+// Get returns a vehicle's fraud case, if it ever had one.
+func (f *FraudService) Get(vehicleID string) (FraudCase, bool) {
+	var fraudCase FraudCase
+	val, err := f.redisClient.Get(f.ctx, fmt.Sprintf("fraud_case:%s", vehicleID)).Bytes()
+	if err != nil || json.Unmarshal(val, &fraudCase) != nil {
+		return fraudCase, false
+	}
+	return fraudCase, true
+}
+
+// Review closes a case. Clearing lifts the quarantine, starts the checks
+// afresh and exempts the vehicle from the signals that fired, so the same
+// pattern doesn't quarantine it again; confirming keeps it quarantined.
+func (f *FraudService) Review(vehicleID string, confirmed bool, note string) (FraudCase, error) {
+	fraudCase, ok := f.Get(vehicleID)
+	if !ok {
+		return fraudCase, errNoFraudCase
+	}
+	fraudCase.State = FraudCleared
+	if confirmed {
+		fraudCase.State = FraudConfirmed
+	} else {
+		for signal := range fraudCase.Signals {
+			if !slices.Contains(fraudCase.Exempt, signal) {
+				fraudCase.Exempt = append(fraudCase.Exempt, signal)
+			}
+		}
+		slices.Sort(fraudCase.Exempt)
+	}
+	fraudCase.ReviewedAt = time.Now().Unix()
+	fraudCase.Note = note
+
+	pipe := f.redisClient.TxPipeline()
+	pipe.ZRem(f.ctx, fraudReviewKey, vehicleID)
+	if !confirmed {
+		pipe.SRem(f.ctx, fraudQuarantinedKey, vehicleID)
+		pipe.Del(f.ctx, fmt.Sprintf("fraud_state:%s", vehicleID))
+	}
+	if _, err := pipe.Exec(f.ctx); err != nil {
+		return fraudCase, err
+	}
+	f.save(fraudCase)
+	log.Printf("🕵️ Fraud case of %s reviewed: %s", vehicleID, fraudCase.State)
+	return fraudCase, nil
+}
+
+func (f *FraudService) save(fraudCase FraudCase) {
+	caseJSON, _ := json.Marshal(fraudCase)
+	if err := f.redisClient.Set(f.ctx, fmt.Sprintf("fraud_case:%s", fraudCase.VehicleID), caseJSON, 0).Err(); err != nil {
+		log.Printf("Failed to save fraud case of %s: %v", fraudCase.VehicleID, err)
+	}
+}
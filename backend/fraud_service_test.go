@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestFraudServiceQuarantine(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	vehicles := []string{"test-fraud", "test-fraud-2", "test-fraud-3"}
+	for _, id := range vehicles {
+		cleanVehicle(t, rdb, id)
+		rdb.SRem(ctx, fraudQuarantinedKey, id)
+		rdb.ZRem(ctx, fraudReviewKey, id)
+	}
+	fraud := NewFraudService(rdb, ctx)
+
+	// A script replaying a recorded drive, then stuck on its last sample:
+	// same position, same confidence, one message a second.
+	for i := int64(0); i < 3; i++ {
+		data := Telemetry{VehicleID: "test-fraud", Timestamp: 997 + i, Status: "safe", Lat: 28.7041 + float64(i)*1e-5, Long: 77.1025, Confidence: 0.9 + float64(i)/100}
+		fraud.Inspect(data, (997+i)*1000)
+	}
+	for i := int64(0); i < FRAUD_REPEAT_SAMPLES; i++ {
+		data := Telemetry{VehicleID: "test-fraud", Timestamp: 1000 + i, Status: "safe", Lat: 28.7041, Long: 77.1025, Confidence: 0.99}
+		fraud.Inspect(data, (1000+i)*1000)
+	}
+	assert.True(t, fraud.Quarantined("test-fraud"))
+	fraudCase, ok := fraud.Get("test-fraud")
+	if assert.True(t, ok) {
+		assert.Equal(t, FraudQuarantined, fraudCase.State)
+		assert.Equal(t, map[string]int{FraudFixedCadence: 1, FraudStaticLocation: 1, FraudFixedConfidence: 1}, fraudCase.Signals)
+	}
+	queue, err := fraud.Queue(500)
+	assert.NoError(t, err)
+	assert.Contains(t, queue, fraudCase)
+
+	// Clearing lifts the quarantine, and the same pattern doesn't bring it back.
+	fraudCase, err = fraud.Review("test-fraud", false, "test bench")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{FraudFixedCadence, FraudFixedConfidence, FraudStaticLocation}, fraudCase.Exempt)
+	assert.False(t, fraud.Quarantined("test-fraud"))
+	for i := int64(0); i < 2*FRAUD_REPEAT_SAMPLES; i++ {
+		data := Telemetry{VehicleID: "test-fraud", Timestamp: 1100 + i, Status: "safe", Lat: 28.7041, Long: 77.1025 + float64(i%2)*1e-5, Confidence: 0.99}
+		fraud.Inspect(data, (1100+i)*1000)
+	}
+	assert.False(t, fraud.Quarantined("test-fraud"))
+	_, err = fraud.Review("test-fraud-3", true, "")
+	assert.Equal(t, errNoFraudCase, err)
+
+	// Two vehicles sending the same readings, one of them teleporting.
+	a := Telemetry{VehicleID: "test-fraud-2", Timestamp: 1990, Status: "drowsy", Lat: 12.9715, Long: 77.5946, Confidence: 0.87, HeartRate: 72}
+	b := a
+	b.VehicleID = "test-fraud-3"
+	fraud.Inspect(a, 0)
+	fraud.Inspect(b, 0)
+	a.Timestamp, a.Lat = 2000, 12.9716
+	b.Timestamp, b.Lat = 2000, 12.9716
+	fraud.Inspect(a, 0)
+	fraud.Inspect(b, 0)
+	assert.True(t, fraud.Quarantined("test-fraud-2"))
+	assert.True(t, fraud.Quarantined("test-fraud-3"))
+
+	a.Timestamp, a.Lat = 2010, 13.9716 // ~111 km in 10s
+	fraud.Inspect(a, 0)
+	fraudCase, _ = fraud.Get("test-fraud-2")
+	assert.Equal(t, map[string]int{FraudDuplicatePayload: 1, FraudGPSJump: 1}, fraudCase.Signals)
+
+	fraudCase, err = fraud.Review("test-fraud-2", true, "farming")
+	assert.NoError(t, err)
+	assert.Equal(t, FraudConfirmed, fraudCase.State)
+	assert.True(t, fraud.Quarantined("test-fraud-2"), "confirmed vehicles stay quarantined")
+}
+
+// The CV agent and the IoT board shipped in this repo send a fixed
+// placeholder position and confidence; neither is farming.
+func TestFraudServiceBundledDevices(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	for _, id := range []string{"test-fraud-cv", "test-fraud-cv-2", "test-fraud-iot"} {
+		cleanVehicle(t, rdb, id)
+		rdb.SRem(ctx, fraudQuarantinedKey, id)
+		rdb.ZRem(ctx, fraudReviewKey, id)
+	}
+	fraud := NewFraudService(rdb, ctx)
+
+	// cv/main.py: every ~0.5 s, paced by the camera's frame rate.
+	for i := int64(0); i < 3*FRAUD_REPEAT_SAMPLES; i++ {
+		status, confidence := "safe", 0.99
+		if i%20 >= 15 {
+			status, confidence = "drowsy", 0.95
+		}
+		arrivalMs := 1_000_000 + i*500 + (i*i*7)%33
+		for _, id := range []string{"test-fraud-cv", "test-fraud-cv-2"} {
+			fraud.Inspect(Telemetry{VehicleID: id, Timestamp: arrivalMs / 1000, Status: status, Lat: 28.7041, Long: 77.1025, Confidence: confidence}, arrivalMs)
+		}
+	}
+	// iot/main.py: a held button, no detector confidence.
+	for i := int64(0); i < 3*FRAUD_REPEAT_SAMPLES; i++ {
+		arrivalMs := 2_000_000 + i*550 + (i*i*13)%50
+		fraud.Inspect(Telemetry{VehicleID: "test-fraud-iot", Timestamp: arrivalMs / 1000, Status: "safe_vehicle", Lat: 28.7041, Long: 77.1025, HeartRate: 60 + int(i%20)}, arrivalMs)
+	}
+
+	for _, id := range []string{"test-fraud-cv", "test-fraud-cv-2", "test-fraud-iot"} {
+		fraudCase, _ := fraud.Get(id)
+		assert.False(t, fraud.Quarantined(id), "%s: %v", id, fraudCase.Signals)
+	}
+}
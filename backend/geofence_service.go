@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// Statuses raised by geofence evaluation.
+const (
+	StatusGeofenceEnter     = "geofence_enter"
+	StatusGeofenceExit      = "geofence_exit"
+	StatusGeofenceViolation = "geofence_violation"
+)
+
+// Geofence violation kinds. Speed caps are enforced by speeding detection.
+const (
+	ViolationNoEntry = "no_entry"
+	ViolationCurfew  = "curfew"
+)
+
+// geofencesKey holds the IDs of all geofences.
+const geofencesKey = "geofences"
+
+var errGeofenceNotFound = errors.New("geofence not found")
+
+// Geofence is a zone as a GeoJSON Feature: a Polygon, or a Point with
+// properties.radius_m for a circle. Coordinates are [long, lat] as GeoJSON
+// requires.
+type Geofence struct {
+	Type       string             `json:"type"` // Always "Feature"
+	ID         string             `json:"id"`
+	Geometry   GeoJSONGeometry    `json:"geometry"`
+	Properties GeofenceProperties `json:"properties"`
+
+	center [2]float64     // Point: [long, lat]
+	rings  [][][2]float64 // Polygon: outer ring, then holes
+}
+
+// GeoJSONGeometry is a GeoJSON geometry object.
+type GeoJSONGeometry struct {
+	Type        string          `json:"type"` // "Polygon" or "Point"
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// GeofenceProperties holds a zone's name and rules.
+type GeofenceProperties struct {
+	Name          string   `json:"name"`
+	RadiusM       float64  `json:"radius_m,omitempty"`        // Circle radius, for Point geometry
+	SpeedLimitKmh float64  `json:"speed_limit_kmh,omitempty"` // Speed cap inside the zone
+	NoEntry       bool     `json:"no_entry,omitempty"`        // Entering is a violation
+	Curfew        *Curfew  `json:"curfew,omitempty"`          // Being inside during these hours is a violation
+	Attest        bool     `json:"attest,omitempty"`          // Attest violations on-chain
+	VehicleIDs    []string `json:"vehicle_ids,omitempty"`     // Vehicles the zone applies to; empty: the whole fleet
+	CreatedAt     int64    `json:"created_at"`
+	UpdatedAt     int64    `json:"updated_at"`
+}
+
+// Curfew is a daily period in fleet time (FLEET_TIMEZONE), e.g. 22:00 to 06:00.
+type Curfew struct {
+	From string `json:"from"` // "15:04"
+	To   string `json:"to"`
+}
+
+// GeoJSONFeatureCollection is the listing format, so map libraries can load
+// it directly.
+type GeoJSONFeatureCollection struct {
+	Type     string     `json:"type"` // Always "FeatureCollection"
+	Features []Geofence `json:"features"`
+}
+
+// parse validates the feature and decodes its coordinates.
+func (g *Geofence) parse() error {
+	if g.Type != "Feature" {
+		return fmt.Errorf("type must be Feature")
+	}
+	if g.Properties.Name == "" {
+		return fmt.Errorf("properties.name is required")
+	}
+	if c := g.Properties.Curfew; c != nil {
+		_, errFrom := time.Parse("15:04", c.From)
+		_, errTo := time.Parse("15:04", c.To)
+		if errFrom != nil || errTo != nil || c.From == c.To {
+			return fmt.Errorf("properties.curfew needs different from and to times as HH:MM")
+		}
+	}
+	if g.Properties.SpeedLimitKmh < 0 {
+		return fmt.Errorf("properties.speed_limit_kmh must not be negative")
+	}
+
+	switch g.Geometry.Type {
+	case "Point":
+		if err := json.Unmarshal(g.Geometry.Coordinates, &g.center); err != nil || !validCoordinates(g.center[1], g.center[0]) {
+			return fmt.Errorf("geometry.coordinates must be a [long, lat] position")
+		}
+		if g.Properties.RadiusM <= 0 {
+			return fmt.Errorf("a Point geofence needs a positive properties.radius_m")
+		}
+	case "Polygon":
+		if err := json.Unmarshal(g.Geometry.Coordinates, &g.rings); err != nil || len(g.rings) == 0 {
+			return fmt.Errorf("geometry.coordinates must be a list of linear rings")
+		}
+		for i, ring := range g.rings {
+			if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+				return fmt.Errorf("ring %d must be closed and have at least 4 positions", i)
+			}
+			for _, p := range ring {
+				if !validCoordinates(p[1], p[0]) {
+					return fmt.Errorf("ring %d has an invalid [long, lat] position", i)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("geometry.type must be Polygon or Point")
+	}
+	return nil
+}
+
+// Contains reports whether a position is inside the zone.
+func (g *Geofence) Contains(lat, long float64) bool {
+	if g.Geometry.Type == "Point" {
+		return haversineMeters(lat, long, g.center[1], g.center[0]) <= g.Properties.RadiusM
+	}
+	if !ringContains(g.rings[0], lat, long) {
+		return false
+	}
+	for _, hole := range g.rings[1:] {
+		if ringContains(hole, lat, long) {
+			return false
+		}
+	}
+	return true
+}
+
+// AppliesTo reports whether the zone's rules cover a vehicle.
+func (g *Geofence) AppliesTo(vehicleID string) bool {
+	if len(g.Properties.VehicleIDs) == 0 {
+		return true
+	}
+	for _, id := range g.Properties.VehicleIDs {
+		if id == vehicleID {
+			return true
+		}
+	}
+	return false
+}
+
+// InCurfew reports whether ts falls in the zone's curfew.
+func (g *Geofence) InCurfew(ts int64) bool {
+	c := g.Properties.Curfew
+	if c == nil {
+		return false
+	}
+	now := time.Unix(ts, 0).In(fleetTimezone).Format("15:04")
+	if c.From < c.To {
+		return now >= c.From && now < c.To
+	}
+	return now >= c.From || now < c.To // Wraps past midnight
+}
+
+// ringContains is the even-odd ray casting test. Zones are small enough to
+// treat long/lat as planar.
+func ringContains(ring [][2]float64, lat, long float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && long < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// geofenceVisit is a vehicle's stay inside one zone.
+type geofenceVisit struct {
+	EnteredAt      int64 `json:"entered_at"`
+	CurfewReported bool  `json:"curfew_reported,omitempty"`
+}
+
+// GeofenceService stores zones and evaluates vehicle positions against
+// them, raising enter, exit and violation events.
+type GeofenceService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewGeofenceService creates a new GeofenceService instance.
+func NewGeofenceService(redisClient *redis.Client, ctx context.Context) *GeofenceService {
+	return &GeofenceService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Evaluate checks a sample's position against every zone that applies to
+// the vehicle. It returns the events to raise and the zones the vehicle is
+// in now.
+func (s *GeofenceService) Evaluate(data Telemetry) ([]Telemetry, []Geofence) {
+	if data.Lat == 0 && data.Long == 0 {
+		return nil, nil // No fix
+	}
+	zones, err := s.List()
+	if err != nil {
+		log.Printf("Error getting geofences: %v", err)
+		return nil, nil
+	}
+	stateKey := fmt.Sprintf("geofence_state:%s", data.VehicleID)
+	visits, err := s.redisClient.HGetAll(s.ctx, stateKey).Result()
+	if err != nil {
+		log.Printf("Error getting geofence state: %v", err)
+		return nil, nil
+	}
+
+	var events []Telemetry
+	var inside []Geofence
+	event := func(status string, zone Geofence, violation string) {
+		log.Printf("📍 Geofence %s: %s %s (%s)", zone.Properties.Name, data.VehicleID, status, violation)
+		events = append(events, Telemetry{
+			VehicleID:  data.VehicleID,
+			DeviceID:   data.DeviceID,
+			Timestamp:  data.Timestamp,
+			Status:     status,
+			Lat:        data.Lat,
+			Long:       data.Long,
+			Confidence: 1,
+			GeofenceID: zone.ID,
+			Violation:  violation,
+		})
+	}
+
+	for _, zone := range zones {
+		if !zone.AppliesTo(data.VehicleID) {
+			continue
+		}
+		stored, wasInside := visits[zone.ID]
+		delete(visits, zone.ID)
+		if !zone.Contains(data.Lat, data.Long) {
+			if wasInside {
+				s.redisClient.HDel(s.ctx, stateKey, zone.ID)
+				event(StatusGeofenceExit, zone, "")
+			}
+			continue
+		}
+		inside = append(inside, zone)
+
+		var visit geofenceVisit
+		json.Unmarshal([]byte(stored), &visit)
+		changed := !wasInside
+		if !wasInside {
+			visit.EnteredAt = data.Timestamp
+			event(StatusGeofenceEnter, zone, "")
+			if zone.Properties.NoEntry {
+				event(StatusGeofenceViolation, zone, ViolationNoEntry)
+			}
+		}
+		if !visit.CurfewReported && zone.InCurfew(data.Timestamp) {
+			visit.CurfewReported = true // Once per stay
+			changed = true
+			event(StatusGeofenceViolation, zone, ViolationCurfew)
+		}
+		if changed {
+			visitJSON, _ := json.Marshal(visit)
+			s.redisClient.HSet(s.ctx, stateKey, zone.ID, visitJSON)
+		}
+	}
+
+	// Zones deleted while the vehicle was inside
+	for id := range visits {
+		s.redisClient.HDel(s.ctx, stateKey, id)
+	}
+	return events, inside
+}
+
+// Create stores a new zone.
+func (s *GeofenceService) Create(zone Geofence) (Geofence, error) {
+	if err := zone.parse(); err != nil {
+		return zone, err
+	}
+	zone.ID = newGeofenceID()
+	zone.Properties.CreatedAt = time.Now().Unix()
+	zone.Properties.UpdatedAt = zone.Properties.CreatedAt
+	if err := s.save(zone); err != nil {
+		return zone, err
+	}
+	log.Printf("📍 Geofence created: %s (%s)", zone.Properties.Name, zone.ID)
+	return zone, nil
+}
+
+// Update replaces a zone's geometry and rules.
+func (s *GeofenceService) Update(id string, zone Geofence) (Geofence, error) {
+	current, err := s.Get(id)
+	if err != nil {
+		return zone, err
+	}
+	if err := zone.parse(); err != nil {
+		return zone, err
+	}
+	zone.ID = id
+	zone.Properties.CreatedAt = current.Properties.CreatedAt
+	zone.Properties.UpdatedAt = time.Now().Unix()
+	return zone, s.save(zone)
+}
+
+// Delete removes a zone.
+func (s *GeofenceService) Delete(id string) error {
+	removed, err := s.redisClient.SRem(s.ctx, geofencesKey, id).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return errGeofenceNotFound
+	}
+	return s.redisClient.Del(s.ctx, fmt.Sprintf("geofence:%s", id)).Err()
+}
+
+// Get returns one zone.
+func (s *GeofenceService) Get(id string) (Geofence, error) {
+	var zone Geofence
+	val, err := s.redisClient.Get(s.ctx, fmt.Sprintf("geofence:%s", id)).Bytes()
+	if err == redis.Nil {
+		return zone, errGeofenceNotFound
+	} else if err != nil {
+		return zone, err
+	}
+	if err := json.Unmarshal(val, &zone); err != nil {
+		return zone, err
+	}
+	return zone, zone.parse()
+}
+
+// List returns all zones.
+func (s *GeofenceService) List() ([]Geofence, error) {
+	ids, err := s.redisClient.SMembers(s.ctx, geofencesKey).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = fmt.Sprintf("geofence:%s", id)
+	}
+	vals, err := s.redisClient.MGet(s.ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	zones := make([]Geofence, 0, len(vals))
+	for _, v := range vals {
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var zone Geofence
+		if json.Unmarshal([]byte(str), &zone) == nil && zone.parse() == nil {
+			zones = append(zones, zone)
+		}
+	}
+	return zones, nil
+}
+
+func (s *GeofenceService) save(zone Geofence) error {
+	zoneJSON, _ := json.Marshal(zone)
+	pipe := s.redisClient.TxPipeline()
+	pipe.Set(s.ctx, fmt.Sprintf("geofence:%s", zone.ID), zoneJSON, 0)
+	pipe.SAdd(s.ctx, geofencesKey, zone.ID)
+	_, err := pipe.Exec(s.ctx)
+	return err
+}
+
+// geofenceSpeedLimit is the lowest speed cap of the zones, if any has one.
+func geofenceSpeedLimit(zones []Geofence) (float64, string) {
+	limit, name := math.Inf(1), ""
+	for _, zone := range zones {
+		if zoneLimit := zone.Properties.SpeedLimitKmh; zoneLimit > 0 && zoneLimit < limit {
+			limit, name = zoneLimit, zone.Properties.Name
+		}
+	}
+	return limit, name
+}
+
+func newGeofenceID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return "geo_" + hex.EncodeToString(buf)
+}
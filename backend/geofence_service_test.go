@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestGeofenceServiceEvaluate(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, geofencesKey, "geofence_state:test-geo")
+	geofences := NewGeofenceService(rdb, ctx)
+
+	feature := func(geometry string, props GeofenceProperties) Geofence {
+		var g GeoJSONGeometry
+		assert.NoError(t, json.Unmarshal([]byte(geometry), &g))
+		return Geofence{Type: "Feature", Geometry: g, Properties: props}
+	}
+
+	// A depot with a yard cut out, and a school zone nearby.
+	depot, err := geofences.Create(feature(`{"type": "Polygon", "coordinates": [
+		[[77.0, 28.0], [77.1, 28.0], [77.1, 28.1], [77.0, 28.1], [77.0, 28.0]],
+		[[77.04, 28.04], [77.06, 28.04], [77.06, 28.06], [77.04, 28.06], [77.04, 28.04]]
+	]}`, GeofenceProperties{Name: "depot", NoEntry: true}))
+	assert.NoError(t, err)
+	school, err := geofences.Create(feature(`{"type": "Point", "coordinates": [77.2, 28.0]}`,
+		GeofenceProperties{Name: "school", RadiusM: 500, SpeedLimitKmh: 30}))
+	assert.NoError(t, err)
+
+	_, err = geofences.Create(feature(`{"type": "Polygon", "coordinates": [[[77.0, 28.0], [77.1, 28.0], [77.0, 28.0]]]}`, GeofenceProperties{Name: "bad"}))
+	assert.Error(t, err, "ring too short")
+	_, err = geofences.Create(feature(`{"type": "Point", "coordinates": [77.2, 28.0]}`, GeofenceProperties{Name: "no radius"}))
+	assert.Error(t, err)
+
+	statuses := func(ts int64, lat, long float64) ([]string, []Geofence) {
+		events, inside := geofences.Evaluate(Telemetry{VehicleID: "test-geo", Timestamp: ts, Lat: lat, Long: long})
+		var out []string
+		for _, e := range events {
+			out = append(out, e.Status+":"+e.Violation)
+		}
+		return out, inside
+	}
+
+	got, inside := statuses(1, 28.2, 77.05)
+	assert.Empty(t, got)
+	assert.Empty(t, inside)
+
+	got, inside = statuses(2, 28.02, 77.02)
+	assert.Equal(t, []string{"geofence_enter:", "geofence_violation:no_entry"}, got)
+	if assert.Len(t, inside, 1) {
+		assert.Equal(t, depot.ID, inside[0].ID)
+	}
+	got, _ = statuses(3, 28.03, 77.02)
+	assert.Empty(t, got, "still inside")
+
+	got, _ = statuses(4, 28.05, 77.05)
+	assert.Equal(t, []string{"geofence_exit:"}, got, "the yard is a hole in the depot")
+
+	got, inside = statuses(5, 28.001, 77.2)
+	assert.Equal(t, []string{"geofence_enter:"}, got)
+	limit, name := geofenceSpeedLimit(inside)
+	assert.Equal(t, 30.0, limit)
+	assert.Equal(t, "school", name)
+
+	assert.NoError(t, geofences.Delete(school.ID))
+	got, _ = statuses(6, 28.001, 77.2)
+	assert.Empty(t, got, "deleted zones are forgotten without an exit")
+}
+
+func TestGeofenceCurfew(t *testing.T) {
+	zone := Geofence{Properties: GeofenceProperties{Curfew: &Curfew{From: "22:00", To: "06:00"}}}
+	at := func(hour int) int64 {
+		return time.Date(2024, 1, 1, hour, 30, 0, 0, time.UTC).Unix()
+	}
+	assert.True(t, zone.InCurfew(at(23)))
+	assert.True(t, zone.InCurfew(at(2)))
+	assert.False(t, zone.InCurfew(at(12)))
+
+	// Curfew hours are the fleet's, not the server's.
+	defer func(loc *time.Location) { fleetTimezone = loc }(fleetTimezone)
+	fleetTimezone = time.FixedZone("IST", 5*60*60+30*60)
+	assert.True(t, zone.InCurfew(at(18)), "midnight where the vehicle drives")
+	assert.False(t, zone.InCurfew(at(1)), "already 7 a.m. there")
+}
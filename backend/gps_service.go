@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// StatusSpeeding is raised by the backend while a vehicle is over the speed
+// limit in force.
+const StatusSpeeding = "speeding"
+
+// SpeedingConfig sets the speed limits. The lowest limit of the zones a fix
+// falls in applies; outside all zones the fleet-wide LimitKmh does.
+type SpeedingConfig struct {
+	LimitKmh       float64     `json:"limit_kmh"`        // Fleet-wide limit
+	ToleranceKmh   float64     `json:"tolerance_kmh"`    // Allowed above the limit, for GPS error
+	MinDurationSec int64       `json:"min_duration_sec"` // How long speeding must last before it counts
+	Zones          []SpeedZone `json:"zones,omitempty"`
+}
+
+// SpeedZone is a circular area with its own limit (school, town centre, ...).
+type SpeedZone struct {
+	Name     string  `json:"name"`
+	Lat      float64 `json:"lat"`
+	Long     float64 `json:"long"`
+	RadiusM  float64 `json:"radius_m"`
+	LimitKmh float64 `json:"limit_kmh"`
+}
+
+func (c SpeedingConfig) validate() error {
+	if c.LimitKmh <= 0 || c.ToleranceKmh < 0 || c.MinDurationSec < 0 {
+		return fmt.Errorf("limit_kmh must be positive, tolerance_kmh and min_duration_sec not negative")
+	}
+	for i, z := range c.Zones {
+		if z.Name == "" || z.RadiusM <= 0 || z.LimitKmh <= 0 || !validCoordinates(z.Lat, z.Long) {
+			return fmt.Errorf("zones[%d]: needs a name, valid coordinates and a positive radius_m and limit_kmh", i)
+		}
+	}
+	return nil
+}
+
+// LimitAt returns the speed limit at a position and the zone it comes from
+// (empty for the fleet-wide limit).
+func (c SpeedingConfig) LimitAt(lat, long float64) (float64, string) {
+	limit, zone := c.LimitKmh, ""
+	for _, z := range c.Zones {
+		if z.LimitKmh < limit && haversineMeters(lat, long, z.Lat, z.Long) <= z.RadiusM {
+			limit, zone = z.LimitKmh, z.Name
+		}
+	}
+	return limit, zone
+}
+
+// gpsState is the per-vehicle position tracker. The anchor is the last fix
+// distance was measured to; fixes within GPS_JITTER_METERS of it don't move
+// it, so a parked vehicle's GPS wander doesn't add up.
+type gpsState struct {
+	Lat       float64 `json:"lat"`
+	Long      float64 `json:"long"`
+	AnchorTs  int64   `json:"anchor_ts"`
+	LastFix   int64   `json:"last_fix"` // Last accepted fix, moved or not
+	SpeedKmh  float64 `json:"speed_kmh"`
+	TotalKm   float64 `json:"total_km"`
+	TripKm    float64 `json:"trip_km"`
+	TripStart int64   `json:"trip_start"`
+	Outliers  int     `json:"outliers"` // Consecutive rejected fixes
+	OverSince int64   `json:"over_since,omitempty"`
+}
+
+// Odometer is a vehicle's GPS-derived distance and speed.
+type Odometer struct {
+	VehicleID    string             `json:"vehicle_id"`
+	SpeedKmh     float64            `json:"speed_kmh"`
+	LastFix      int64              `json:"last_fix"`
+	TotalKm      float64            `json:"total_km"`
+	TripKm       float64            `json:"trip_km"` // Since the vehicle last stood TRIP_GAP seconds without a fix
+	TripStart    int64              `json:"trip_start"`
+	DailyKm      map[string]float64 `json:"daily_km"`      // UTC date -> km, last 7 days
+	OutlierFixes int64              `json:"outlier_fixes"` // Rejected as GPS jumps, all time
+}
+
+// GPSService derives speed and distance from consecutive GPS fixes and
+// detects speeding.
+type GPSService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewGPSService creates a new GPSService instance.
+func NewGPSService(redisClient *redis.Client, ctx context.Context) *GPSService {
+	return &GPSService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Track folds the sample's fix into the vehicle's odometer and sets its
+// SpeedKmh. It returns a speeding sample while the vehicle is over the limit
+// for longer than cfg.MinDurationSec. Speed caps of the geofences the vehicle
+// is in apply on top of cfg; with neither, speeding isn't detected.
+func (g *GPSService) Track(data *Telemetry, cfg *SpeedingConfig, geofences []Geofence) []Telemetry {
+	if data.Lat == 0 && data.Long == 0 {
+		return nil // No fix
+	}
+	key := fmt.Sprintf("gps:%s", data.VehicleID)
+	var st gpsState
+	if val, err := g.redisClient.Get(g.ctx, key).Bytes(); err == nil {
+		json.Unmarshal(val, &st)
+	}
+	if data.Timestamp < st.AnchorTs || data.Timestamp < st.LastFix {
+		return nil // Out of order: can't tell speed
+	}
+	if data.Timestamp == st.AnchorTs {
+		data.SpeedKmh = math.Round(st.SpeedKmh*10) / 10 // Same second: no news
+		return nil
+	}
+	defer func() {
+		stateJSON, _ := json.Marshal(st)
+		g.redisClient.Set(g.ctx, key, stateJSON, 0)
+	}()
+
+	if st.LastFix == 0 || data.Timestamp-st.LastFix > GPS_MAX_GAP || st.Outliers >= GPS_MAX_OUTLIERS {
+		// First fix, or one we can't measure from: start over here. Several
+		// rejected fixes in a row mean the anchor was the bad one.
+		if st.LastFix == 0 || data.Timestamp-st.LastFix > TRIP_GAP {
+			st.TripKm, st.TripStart = 0, data.Timestamp
+		}
+		st.Lat, st.Long, st.AnchorTs, st.LastFix = data.Lat, data.Long, data.Timestamp, data.Timestamp
+		st.SpeedKmh, st.Outliers, st.OverSince = 0, 0, 0
+		return nil
+	}
+
+	meters := haversineMeters(st.Lat, st.Long, data.Lat, data.Long)
+	speed := meters / 1000 / (float64(data.Timestamp-st.AnchorTs) / 3600)
+	switch {
+	case speed > GPS_MAX_SPEED_KMH:
+		st.Outliers++
+		g.redisClient.Incr(g.ctx, fmt.Sprintf("gps_outliers:%s", data.VehicleID))
+		log.Printf("🛰️ GPS outlier for %s: %.0f m in %ds", data.VehicleID, meters, data.Timestamp-st.AnchorTs)
+		return nil
+	case meters < GPS_JITTER_METERS:
+		// Not out of the jitter radius yet. A vehicle can't have been
+		// faster than the radius over the time since the anchor, so the
+		// last speed holds up to that bound: a slow vehicle keeps its
+		// speed until it leaves the radius, a stopped one decays to 0.
+		bound := float64(GPS_JITTER_METERS) / 1000 / (float64(data.Timestamp-st.AnchorTs) / 3600)
+		st.SpeedKmh = math.Min(st.SpeedKmh, bound)
+		if st.SpeedKmh < TRIP_MOVING_KMH {
+			st.SpeedKmh = 0
+		}
+	default:
+		km := meters / 1000
+		st.TotalKm += km
+		st.TripKm += km
+		st.SpeedKmh = speed
+		st.Lat, st.Long, st.AnchorTs = data.Lat, data.Long, data.Timestamp
+		dailyKey := fmt.Sprintf("odometer_daily:%s", data.VehicleID)
+		g.redisClient.HIncrByFloat(g.ctx, dailyKey, time.Unix(data.Timestamp, 0).UTC().Format("2006-01-02"), km)
+	}
+	st.LastFix = data.Timestamp
+	st.Outliers = 0
+	data.SpeedKmh = math.Round(st.SpeedKmh*10) / 10
+
+	geofenceLimit, geofence := geofenceSpeedLimit(geofences)
+	if cfg == nil {
+		if math.IsInf(geofenceLimit, 1) {
+			return nil
+		}
+		cfg = &SpeedingConfig{LimitKmh: geofenceLimit}
+	}
+	limit, zone := cfg.LimitAt(data.Lat, data.Long)
+	if geofenceLimit < limit {
+		limit, zone = geofenceLimit, geofence
+	}
+	if st.SpeedKmh <= limit+cfg.ToleranceKmh {
+		st.OverSince = 0
+		return nil
+	}
+	if st.OverSince == 0 {
+		st.OverSince = data.Timestamp
+	}
+	if data.Timestamp-st.OverSince < cfg.MinDurationSec {
+		return nil
+	}
+	if zone == "" {
+		zone = "fleet"
+	}
+	log.Printf("🚓 Speeding: %s at %.0f km/h (limit %.0f, %s)", data.VehicleID, data.SpeedKmh, limit, zone)
+	return []Telemetry{{
+		VehicleID:     data.VehicleID,
+		DeviceID:      data.DeviceID,
+		Timestamp:     data.Timestamp,
+		Status:        StatusSpeeding,
+		Lat:           data.Lat,
+		Long:          data.Long,
+		Confidence:    1, // Measured, not inferred
+		SpeedKmh:      data.SpeedKmh,
+		SpeedLimitKmh: limit,
+	}}
+}
+
+// Odometer returns a vehicle's distance and speed so far.
+func (g *GPSService) Odometer(vehicleID string) (Odometer, error) {
+	odometer := Odometer{VehicleID: vehicleID, DailyKm: map[string]float64{}}
+	var st gpsState
+	val, err := g.redisClient.Get(g.ctx, fmt.Sprintf("gps:%s", vehicleID)).Bytes()
+	if err != nil && err != redis.Nil {
+		return odometer, err
+	}
+	if err == nil {
+		json.Unmarshal(val, &st)
+	}
+	odometer.SpeedKmh = math.Round(st.SpeedKmh*10) / 10
+	odometer.LastFix = st.LastFix
+	odometer.TotalKm = st.TotalKm
+	odometer.TripKm = st.TripKm
+	odometer.TripStart = st.TripStart
+
+	days := make([]string, 7)
+	for i := range days {
+		days[i] = time.Now().UTC().AddDate(0, 0, -i).Format("2006-01-02")
+	}
+	daily, err := g.redisClient.HMGet(g.ctx, fmt.Sprintf("odometer_daily:%s", vehicleID), days...).Result()
+	if err != nil {
+		return odometer, err
+	}
+	for i, v := range daily {
+		km := 0.0
+		if s, ok := v.(string); ok {
+			km, _ = strconv.ParseFloat(s, 64)
+		}
+		odometer.DailyKm[days[i]] = km
+	}
+	odometer.OutlierFixes, _ = g.redisClient.Get(g.ctx, fmt.Sprintf("gps_outliers:%s", vehicleID)).Int64()
+	return odometer, nil
+}
+
+// TotalKm returns the vehicle's odometer reading.
+func (g *GPSService) TotalKm(vehicleID string) float64 {
+	var st gpsState
+	if val, err := g.redisClient.Get(g.ctx, fmt.Sprintf("gps:%s", vehicleID)).Bytes(); err == nil {
+		json.Unmarshal(val, &st)
+	}
+	return st.TotalKm
+}
+
+// haversineMeters is the great-circle distance between two positions.
+func haversineMeters(lat1, long1, lat2, long2 float64) float64 {
+	const earthRadiusM = 6371000
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLong := (long2 - long1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadiusM * math.Asin(math.Sqrt(a))
+}
+
+func validCoordinates(lat, long float64) bool {
+	return lat >= -90 && lat <= 90 && long >= -180 && long <= 180
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestGPSServiceTrack(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "gps:test-gps", "gps_outliers:test-gps", "odometer_daily:test-gps")
+	gps := NewGPSService(rdb, ctx)
+
+	cfg := &SpeedingConfig{LimitKmh: 100, ToleranceKmh: 5, MinDurationSec: 3,
+		Zones: []SpeedZone{{Name: "school", Lat: 28.8, Long: 77.1, RadiusM: 500, LimitKmh: 30}}}
+	metersPerDegree := haversineMeters(0, 0, 1, 0)
+	fix := func(ts int64, lat float64) (Telemetry, []Telemetry) {
+		data := Telemetry{VehicleID: "test-gps", Timestamp: ts, Lat: lat, Long: 77.1}
+		events := gps.Track(&data, cfg, nil)
+		return data, events
+	}
+
+	// 60 km/h north for a minute, with GPS wander while stopped after.
+	lat := 28.7
+	var speeding []Telemetry
+	for ts := int64(1000); ts <= 1060; ts++ {
+		data, events := fix(ts, lat)
+		if ts > 1000 {
+			assert.InDelta(t, 60, data.SpeedKmh, 0.5)
+		}
+		speeding = append(speeding, events...)
+		lat += 60000.0 / 3600 / metersPerDegree
+	}
+	assert.Empty(t, speeding)
+	lat -= 60000.0 / 3600 / metersPerDegree
+	// Staying within the jitter radius, the speed can only have been so
+	// high: it decays, and 3 m of wander is not driving.
+	speed := 60.0
+	for ts := int64(1061); ts < 1070; ts++ {
+		data, _ := fix(ts, lat+float64(ts%2)*3/metersPerDegree)
+		assert.LessOrEqual(t, data.SpeedKmh, speed)
+		speed = data.SpeedKmh
+		if ts >= 1068 {
+			assert.Zero(t, data.SpeedKmh, "stopped")
+		}
+	}
+
+	odometer, err := gps.Odometer("test-gps")
+	assert.NoError(t, err)
+	assert.InDelta(t, 1.0, odometer.TotalKm, 0.01)
+	assert.InDelta(t, 1.0, odometer.TripKm, 0.01)
+	assert.Equal(t, int64(1000), odometer.TripStart)
+
+	// A jump across town is rejected.
+	data, _ := fix(1070, lat+0.1)
+	assert.Zero(t, data.SpeedKmh)
+	odometer, _ = gps.Odometer("test-gps")
+	assert.InDelta(t, 1.0, odometer.TotalKm, 0.01)
+	assert.Equal(t, int64(1), odometer.OutlierFixes)
+
+	// 120 km/h: speeding once it lasts 3 seconds. The first fix is measured
+	// from where the vehicle stood, so it averages in the stop.
+	for ts := int64(1071); ts <= 1076; ts++ {
+		lat += 120000.0 / 3600 / metersPerDegree
+		_, events := fix(ts, lat)
+		speeding = append(speeding, events...)
+	}
+	if assert.Len(t, speeding, 2) {
+		assert.Equal(t, StatusSpeeding, speeding[0].Status)
+		assert.Equal(t, int64(1075), speeding[0].Timestamp)
+		assert.Equal(t, 100.0, speeding[0].SpeedLimitKmh)
+	}
+}
+
+func TestSpeedingConfigLimitAt(t *testing.T) {
+	cfg := SpeedingConfig{LimitKmh: 100, Zones: []SpeedZone{
+		{Name: "town", Lat: 28.8, Long: 77.1, RadiusM: 5000, LimitKmh: 50},
+		{Name: "school", Lat: 28.8, Long: 77.1, RadiusM: 300, LimitKmh: 30},
+	}}
+	limit, zone := cfg.LimitAt(28.8, 77.1)
+	assert.Equal(t, 30.0, limit)
+	assert.Equal(t, "school", zone)
+	limit, zone = cfg.LimitAt(28.82, 77.1)
+	assert.Equal(t, 50.0, limit)
+	assert.Equal(t, "town", zone)
+	limit, zone = cfg.LimitAt(29.5, 77.1)
+	assert.Equal(t, 100.0, limit)
+	assert.Equal(t, "", zone)
+}
+
+func TestGPSServiceSlowVehicle(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "gps:test-gps-slow", "gps_outliers:test-gps-slow", "odometer_daily:test-gps-slow")
+	gps := NewGPSService(rdb, ctx)
+	metersPerDegree := haversineMeters(0, 0, 1, 0)
+
+	// 15 km/h at 1 Hz moves about 4 m a fix, less than the jitter radius:
+	// the speed must hold between the fixes that leave it.
+	lat := 28.7
+	for ts := int64(1000); ts <= 1030; ts++ {
+		data := Telemetry{VehicleID: "test-gps-slow", Timestamp: ts, Lat: lat, Long: 77.1}
+		gps.Track(&data, nil, nil)
+		if ts >= 1003 { // From the first fix out of the radius
+			assert.InDelta(t, 15, data.SpeedKmh, 0.5, "at %d", ts)
+		}
+
+		// A second fix in the same second keeps the speed too.
+		again := data
+		again.SpeedKmh = 0
+		gps.Track(&again, nil, nil)
+		assert.Equal(t, data.SpeedKmh, again.SpeedKmh)
+
+		lat += 15000.0 / 3600 / metersPerDegree
+	}
+}
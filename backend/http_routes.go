@@ -2,8 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
@@ -31,12 +34,22 @@ func SetupRoutes(router *gin.Engine, redisClient *redis.Client, ctx context.Cont
 
 	// --- Auth Routes ---
 
+	// Signing up pairs the driver with a vehicle, which takes the vehicle's
+	// device token: owning a vehicle can't just be claimed.
 	router.POST("/api/signup", func(c *gin.Context) {
 		var newUser User
 		if err := c.ShouldBindJSON(&newUser); err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
+		if newUser.Email == "" || newUser.VehicleID == "" {
+			c.JSON(400, gin.H{"error": "email and vehicle_id are required"})
+			return
+		}
+		if !verifyDeviceToken(ctx, redisClient, newUser.VehicleID, deviceTokenFromRequest(c)) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid device token for this vehicle"})
+			return
+		}
 
 		// Hash Password
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
@@ -48,11 +61,15 @@ func SetupRoutes(router *gin.Engine, redisClient *redis.Client, ctx context.Cont
 
 		// Store in Redis: user:{email}
 		userData, _ := json.Marshal(newUser)
-		err = redisClient.Set(ctx, "user:"+newUser.Email, userData, 0).Err() // 0 = No expiration
+		created, err := redisClient.SetNX(ctx, "user:"+newUser.Email, userData, 0).Result() // 0 = No expiration
 		if err != nil {
 			c.JSON(500, gin.H{"error": "Database error"})
 			return
 		}
+		if !created {
+			c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+			return
+		}
 
 		c.JSON(201, gin.H{"message": "User created", "vehicle_id": newUser.VehicleID})
 	})
@@ -84,9 +101,15 @@ func SetupRoutes(router *gin.Engine, redisClient *redis.Client, ctx context.Cont
 			return
 		}
 
-		// Return Success (In prod, return JWT. Here, simple user info)
+		token, err := issueSessionToken(ctx, redisClient, storedUser.Email)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to start session"})
+			return
+		}
+
 		c.JSON(200, gin.H{
 			"message":    "Login successful",
+			"token":      token,
 			"vehicle_id": storedUser.VehicleID,
 			"name":       storedUser.Name,
 			"email":      storedUser.Email,
@@ -95,6 +118,7 @@ func SetupRoutes(router *gin.Engine, redisClient *redis.Client, ctx context.Cont
 
 	// --- Core API ---
 
+	risk := NewRiskService(redisClient, ctx)
 	router.GET("/api/status/:vehicle_id", func(c *gin.Context) {
 		vehicleID := c.Param("vehicle_id")
 		val, err := redisClient.Get(ctx, vehicleID).Result()
@@ -117,6 +141,11 @@ func SetupRoutes(router *gin.Engine, redisClient *redis.Client, ctx context.Cont
 			vehicleStatus = "unknown"
 		}
 
+		biometricStatus, err := redisClient.Get(ctx, "biometric_status:"+vehicleID).Result()
+		if err != nil {
+			biometricStatus = "unknown"
+		}
+
 		// Unmarshal existing telemetry to inject new fields
 		var telemetry map[string]interface{}
 		if err := json.Unmarshal([]byte(val), &telemetry); err != nil {
@@ -126,6 +155,10 @@ func SetupRoutes(router *gin.Engine, redisClient *redis.Client, ctx context.Cont
 
 		telemetry["driver_status"] = driverStatus
 		telemetry["vehicle_status"] = vehicleStatus
+		telemetry["biometric_status"] = biometricStatus
+		if riskState, err := risk.Current(vehicleID); err == nil {
+			telemetry["risk"] = riskState // Decayed to now, unlike risk_score of the last sample
+		}
 
 		c.JSON(http.StatusOK, telemetry)
 	})
@@ -170,61 +203,637 @@ func SetupRoutes(router *gin.Engine, redisClient *redis.Client, ctx context.Cont
 		c.String(http.StatusOK, jsonArray)
 	})
 
-	// --- Gamification API ---
+	// Data quality: missing sequence ranges and dropped duplicates, so an empty
+	// alert list can be told apart from lost telemetry.
+	router.GET("/api/gaps/:vehicle_id", func(c *gin.Context) {
+		vehicleID := c.Param("vehicle_id")
+		vals, err := redisClient.LRange(ctx, fmt.Sprintf("seq_gaps:%s", vehicleID), 0, -1).Result()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
 
-	router.GET("/api/points/:vehicle_id", func(c *gin.Context) {
+		gaps := make([]SequenceGap, 0, len(vals))
+		for _, v := range vals {
+			var gap SequenceGap
+			if json.Unmarshal([]byte(v), &gap) == nil {
+				gaps = append(gaps, gap)
+			}
+		}
+
+		missing, _ := redisClient.Get(ctx, fmt.Sprintf("seq_missing:%s", vehicleID)).Int64()
+		duplicates, _ := redisClient.Get(ctx, fmt.Sprintf("duplicates:%s", vehicleID)).Int64()
+
+		c.JSON(http.StatusOK, gin.H{
+			"vehicle_id": vehicleID,
+			"missing":    missing,
+			"duplicates": duplicates,
+			"gaps":       gaps,
+		})
+	})
+
+	// Learned heart rate baseline and current limits, plus HR sensor faults.
+	biometrics := NewBiometricService(redisClient, ctx)
+	router.GET("/api/biometrics/:vehicle_id", func(c *gin.Context) {
 		vehicleID := c.Param("vehicle_id")
-		key := fmt.Sprintf("points:%s", vehicleID)
+		baseline, faults, err := biometrics.Baseline(vehicleID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"vehicle_id":    vehicleID,
+			"baseline":      baseline,
+			"sensor_faults": faults,
+		})
+	})
 
-		pointsStr, err := redisClient.Get(ctx, key).Result()
-		if err == redis.Nil {
-			// No points yet, return 0
-			c.JSON(200, gin.H{"vehicle_id": vehicleID, "points": 0})
+	// GPS-derived speed and distance: total, current trip and per day.
+	gps := NewGPSService(redisClient, ctx)
+	router.GET("/api/odometer/:vehicle_id", func(c *gin.Context) {
+		odometer, err := gps.Odometer(c.Param("vehicle_id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
 			return
-		} else if err != nil {
+		}
+		c.JSON(http.StatusOK, odometer)
+	})
+
+	// --- Gamification API ---
+
+	points := NewPointsService(redisClient, ctx)
+	router.GET("/api/points/:vehicle_id", func(c *gin.Context) {
+		vehicleID := c.Param("vehicle_id")
+		balance, err := points.Balance(vehicleID)
+		if err != nil {
 			c.JSON(500, gin.H{"error": "Redis error"})
 			return
 		}
+		c.JSON(200, gin.H{"vehicle_id": vehicleID, "points": balance})
+	})
 
-		c.Header("Content-Type", "application/json")
-		c.JSON(200, gin.H{"vehicle_id": vehicleID, "points": pointsStr}) // pointsStr is string representation of int
+	// How the balance came to be, newest first. ?before=<entry id>, ?limit=50
+	router.GET("/api/points/:vehicle_id/ledger", func(c *gin.Context) {
+		vehicleID := c.Param("vehicle_id")
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+			return
+		}
+		entries, err := points.Ledger(vehicleID, c.Query("before"), limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		balance, err := points.Balance(vehicleID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		next := ""
+		if len(entries) == limit {
+			next = entries[len(entries)-1].ID
+		}
+		c.JSON(http.StatusOK, gin.H{"vehicle_id": vehicleID, "balance": balance, "entries": entries, "next_before": next})
 	})
 
-	router.POST("/api/redeem-points", func(c *gin.Context) {
+	// Spends points in one atomic step, for the signed-in owner of the
+	// vehicle only. Retries carrying the same Idempotency-Key header get the
+	// original redemption back instead of spending twice.
+	router.POST("/api/redeem-points", requireSession(ctx, redisClient), func(c *gin.Context) {
 		var req RedeemRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
+		if req.VehicleID == "" || req.Points <= 0 {
+			c.JSON(400, gin.H{"error": "vehicle_id is required and points must be positive"})
+			return
+		}
+		if user := c.MustGet("user").(User); user.VehicleID != req.VehicleID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not your vehicle"})
+			return
+		}
+		idempotencyKey := c.GetHeader("Idempotency-Key")
+		if len(idempotencyKey) > 255 {
+			c.JSON(400, gin.H{"error": "Idempotency-Key is too long"})
+			return
+		}
 
-		key := fmt.Sprintf("points:%s", req.VehicleID)
+		redemption, replayed, err := points.Redeem(req.VehicleID, int64(req.Points), req.Reward, idempotencyKey)
+		switch err {
+		case nil:
+		case errInsufficientPoints:
+			c.JSON(400, gin.H{"error": "Insufficient balance"})
+			return
+		case errIdempotencyConflict:
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "redemption_id": redemption.ID})
+			return
+		default:
+			c.JSON(500, gin.H{"error": "Failed to deduct points"})
+			return
+		}
 
-		// Check balance first
-		currentPointsStr, err := redisClient.Get(ctx, key).Result()
-		if err == redis.Nil {
-			c.JSON(400, gin.H{"error": "No points available"})
+		if replayed {
+			c.Header("Idempotent-Replayed", "true")
+		}
+		c.JSON(200, gin.H{
+			"message":       "Redemption successful",
+			"new_balance":   redemption.Balance,
+			"redemption_id": redemption.ID,
+			"redemption":    redemption,
+		})
+	})
+
+	// Only the vehicle's owner sees a redemption; others get the same 404 as
+	// for an unknown ID.
+	router.GET("/api/redemptions/:id", requireSession(ctx, redisClient), func(c *gin.Context) {
+		redemption, err := points.Redemption(c.Param("id"))
+		if err == errNoRedemption || (err == nil && redemption.VehicleID != c.MustGet("user").(User).VehicleID) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Redemption not found"})
 			return
 		} else if err != nil {
-			c.JSON(500, gin.H{"error": "Redis error"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
 			return
 		}
+		c.JSON(http.StatusOK, redemption)
+	})
 
-		var currentPoints int
-		fmt.Sscanf(currentPointsStr, "%d", &currentPoints)
+}
 
-		if currentPoints < req.Points {
-			c.JSON(400, gin.H{"error": "Insufficient balance"})
+// SetupTelemetryRoutes configures HTTP ingestion for devices that can't speak MQTT.
+func SetupTelemetryRoutes(router *gin.Engine, redisClient *redis.Client, ingestService *IngestService, ctx context.Context) {
+
+	// Accepts a single telemetry sample, an array of them, or a TelemetryBatch,
+	// encoded as JSON, CBOR or Protobuf (selected by Content-Type). The device
+	// token says which vehicle is sending, and every sample must belong to it.
+	// Requests without a valid token are refused before the body is read, so
+	// they can't fill the dead letters.
+	router.POST("/api/v1/telemetry", func(c *gin.Context) {
+		vehicleID, ok := deviceTokenVehicle(ctx, redisClient, deviceTokenFromRequest(c))
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid device token"})
+			return
+		}
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MAX_TELEMETRY_BODY)
+		body, err := c.GetRawData()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Body exceeds %d bytes", MAX_TELEMETRY_BODY)})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read body"})
+			return
+		}
+
+		enc, _ := encodingFromContentType(c.GetHeader("Content-Type")) // Empty: sniffed from the payload
+		raw := RawMessage{Transport: "http", Topic: c.FullPath(), Encoding: enc, Payload: body}
+
+		batch, err := ingestService.DecodePayload(raw)
+		if violations, ok := err.(ValidationErrors); ok {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Schema violation", "violations": violations})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(batch.Samples) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No samples"})
 			return
 		}
 
-		// Atomically decrement
-		newBalance, err := redisClient.DecrBy(ctx, key, int64(req.Points)).Result()
+		claimed := []string{batch.VehicleID}
+		for _, sample := range batch.Samples {
+			claimed = append(claimed, sample.VehicleID)
+		}
+		for _, id := range claimed {
+			if id != "" && id != vehicleID {
+				ingestService.Reject(raw, DeadLetterAuthFailure, fmt.Errorf("device token of %q used for %q", vehicleID, id))
+				c.JSON(http.StatusForbidden, gin.H{"error": "Samples must belong to the token's vehicle"})
+				return
+			}
+		}
+
+		batch.VehicleID = vehicleID
+		result, err := ingestService.IngestBatch(batch)
 		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to deduct points"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "accepted": result.Accepted})
 			return
 		}
 
-		c.JSON(200, gin.H{"message": "Redemption successful", "new_balance": newBalance})
+		c.JSON(http.StatusAccepted, result)
 	})
 
+	// Issues (or rotates) the ingestion token for a vehicle. The token is only shown once.
+	router.POST("/api/v1/devices/:vehicle_id/token", requireAdmin(), func(c *gin.Context) {
+		vehicleID := c.Param("vehicle_id")
+		token, err := issueDeviceToken(ctx, redisClient, vehicleID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"vehicle_id": vehicleID, "token": token})
+	})
+}
+
+// SetupAdminRoutes configures operator-only routes, guarded by requireAdmin.
+func SetupAdminRoutes(router *gin.Engine, ingestService *IngestService, deadLetters *DeadLetterService) {
+	admin := router.Group("/api/admin", requireAdmin())
+
+	// --- Dead Letters ---
+
+	// Lists rejected telemetry, newest first. Filters: ?reason=parse_error, ?before=<id>, ?limit=50
+	admin.GET("/deadletters", func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+			return
+		}
+		letters, err := deadLetters.List(c.Query("reason"), c.Query("before"), limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		if letters == nil {
+			letters = []DeadLetter{}
+		}
+		c.JSON(http.StatusOK, letters)
+	})
+
+	admin.GET("/deadletters/:id", func(c *gin.Context) {
+		letter, ok, err := deadLetters.Get(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+			return
+		}
+		c.JSON(http.StatusOK, letter)
+	})
+
+	// Re-injects a dead letter into the pipeline. An optional request body
+	// replaces the stored payload (encoding taken from its Content-Type).
+	admin.POST("/deadletters/:id/replay", func(c *gin.Context) {
+		fixed, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read body"})
+			return
+		}
+		enc, _ := encodingFromContentType(c.GetHeader("Content-Type"))
+		if len(fixed) > 0 && enc == "" {
+			enc = sniffEncoding(fixed)
+		}
+
+		result, err := ingestService.Replay(c.Param("id"), fixed, enc)
+		if err == errDeadLetterNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "accepted": result.Accepted})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	admin.DELETE("/deadletters/:id", func(c *gin.Context) {
+		if err := deadLetters.Delete(c.Param("id")); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// --- Points ---
+
+	// Support correction: {"amount": -50, "reason": "..."}
+	admin.POST("/points/:vehicle_id/adjust", func(c *gin.Context) {
+		var req struct {
+			Amount int64  `json:"amount" binding:"required"`
+			Reason string `json:"reason" binding:"required"`
+			Ref    string `json:"ref"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		entry, err := ingestService.points.Record(LedgerEntry{
+			VehicleID: c.Param("vehicle_id"),
+			Type:      LedgerAdjust,
+			Amount:    req.Amount,
+			Reason:    req.Reason,
+			Ref:       req.Ref,
+			Actor:     "admin",
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, entry)
+	})
+
+	// --- Fraud Review ---
+
+	// Lists quarantined vehicles awaiting review, oldest first. ?limit=50
+	admin.GET("/fraud", func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+			return
+		}
+		cases, err := ingestService.fraud.Queue(limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, cases)
+	})
+
+	admin.GET("/fraud/:vehicle_id", func(c *gin.Context) {
+		fraudCase, ok := ingestService.fraud.Get(c.Param("vehicle_id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No fraud case for this vehicle"})
+			return
+		}
+		c.JSON(http.StatusOK, fraudCase)
+	})
+
+	// Closes a case: {"decision": "clear" | "confirm", "note": "..."}.
+	// Clearing lets the vehicle earn rewards again.
+	admin.POST("/fraud/:vehicle_id/review", func(c *gin.Context) {
+		var req struct {
+			Decision string `json:"decision" binding:"required"`
+			Note     string `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || (req.Decision != "clear" && req.Decision != "confirm") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "decision must be \"clear\" or \"confirm\""})
+			return
+		}
+		fraudCase, err := ingestService.fraud.Review(c.Param("vehicle_id"), req.Decision == "confirm", req.Note)
+		if err == errNoFraudCase {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No fraud case for this vehicle"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, fraudCase)
+	})
+}
+
+// SetupIncidentRoutes configures the incident history API.
+func SetupIncidentRoutes(router *gin.Engine, incidents *IncidentService) {
+	// Lists a vehicle's incidents, newest first.
+	// Filters: ?type=drowsy, ?state=open|closed, ?from=<unix>, ?to=<unix> (start time), ?limit=50
+	router.GET("/api/incidents/:vehicle_id", func(c *gin.Context) {
+		filter := IncidentFilter{Type: c.Query("type"), State: c.Query("state")}
+		if filter.State != "" && filter.State != IncidentOpen && filter.State != IncidentClosed {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "state must be open or closed"})
+			return
+		}
+
+		var err error
+		if filter.Limit, err = strconv.Atoi(c.DefaultQuery("limit", "50")); err != nil || filter.Limit < 1 || filter.Limit > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+			return
+		}
+		if filter.From, err = strconv.ParseInt(c.DefaultQuery("from", "0"), 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a unix timestamp"})
+			return
+		}
+		if filter.To, err = strconv.ParseInt(c.DefaultQuery("to", "0"), 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a unix timestamp"})
+			return
+		}
+
+		list, err := incidents.List(c.Param("vehicle_id"), filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+}
+
+// SetupEmergencyRoutes configures the emergency workflow API.
+func SetupEmergencyRoutes(router *gin.Engine, redisClient *redis.Client, emergencies *EmergencyService, ctx context.Context) {
+	// The vehicle's latest emergency, or 404 if there hasn't been one recently.
+	router.GET("/api/emergency/:vehicle_id", func(c *gin.Context) {
+		emergency, ok := emergencies.Active(c.Param("vehicle_id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No emergency"})
+			return
+		}
+		c.JSON(http.StatusOK, emergency)
+	})
+
+	// "I'm OK": answers the prompt from the vehicle (device token) or an
+	// operator (admin key).
+	router.POST("/api/emergency/:vehicle_id/cancel", func(c *gin.Context) {
+		vehicleID := c.Param("vehicle_id")
+		by := "device"
+		if !verifyDeviceToken(ctx, redisClient, vehicleID, deviceTokenFromRequest(c)) {
+			if !isAdminRequest(c) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid device token or admin key"})
+				return
+			}
+			by = "admin"
+		}
+
+		emergency, err := emergencies.Cancel(vehicleID, by)
+		if err == errNoEmergency {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No active emergency"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, emergency)
+	})
+
+	router.GET("/api/admin/emergency-contacts/:vehicle_id", requireAdmin(), func(c *gin.Context) {
+		contacts, err := emergencies.Contacts(c.Param("vehicle_id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, contacts)
+	})
+
+	// Replaces the contacts alerted when the driver doesn't answer.
+	router.PUT("/api/admin/emergency-contacts/:vehicle_id", requireAdmin(), func(c *gin.Context) {
+		var contacts []EmergencyContact
+		if err := c.ShouldBindJSON(&contacts); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a list of contacts"})
+			return
+		}
+		for _, contact := range contacts {
+			if contact.Name == "" || (contact.Phone == "" && contact.Email == "") {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Every contact needs a name and a phone or email"})
+				return
+			}
+		}
+		if err := emergencies.SetContacts(c.Param("vehicle_id"), contacts); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, contacts)
+	})
+}
+
+// SetupGeofenceRoutes configures geofence management. Zones are GeoJSON
+// Features; reading is open to the dashboard, changes need the admin key.
+func SetupGeofenceRoutes(router *gin.Engine, geofences *GeofenceService) {
+	router.GET("/api/geofences", func(c *gin.Context) {
+		zones, err := geofences.List()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		if zones == nil {
+			zones = []Geofence{}
+		}
+		c.JSON(http.StatusOK, GeoJSONFeatureCollection{Type: "FeatureCollection", Features: zones})
+	})
+
+	router.GET("/api/geofences/:id", func(c *gin.Context) {
+		zone, err := geofences.Get(c.Param("id"))
+		if err == errGeofenceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Geofence not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, zone)
+	})
+
+	router.POST("/api/geofences", requireAdmin(), func(c *gin.Context) {
+		var zone Geofence
+		if err := c.ShouldBindJSON(&zone); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a GeoJSON Feature"})
+			return
+		}
+		zone, err := geofences.Create(zone)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, zone)
+	})
+
+	router.PUT("/api/geofences/:id", requireAdmin(), func(c *gin.Context) {
+		var zone Geofence
+		if err := c.ShouldBindJSON(&zone); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a GeoJSON Feature"})
+			return
+		}
+		zone, err := geofences.Update(c.Param("id"), zone)
+		if err == errGeofenceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Geofence not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, zone)
+	})
+
+	router.DELETE("/api/geofences/:id", requireAdmin(), func(c *gin.Context) {
+		err := geofences.Delete(c.Param("id"))
+		if err == errGeofenceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Geofence not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
+
+// SetupTripRoutes configures the trip history API.
+func SetupTripRoutes(router *gin.Engine, trips *TripService) {
+	// /api/trips/<trip_id> returns one trip. /api/trips/<vehicle_id> lists
+	// the vehicle's trips, newest first, with the total count.
+	// Filters: ?from=<unix>, ?to=<unix> (start time), ?limit=50
+	router.GET("/api/trips/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		if strings.HasPrefix(id, "trip_") {
+			trip, ok := trips.Get(id)
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Trip not found"})
+				return
+			}
+			c.JSON(http.StatusOK, trip)
+			return
+		}
+
+		var filter TripFilter
+		var err error
+		if filter.Limit, err = strconv.Atoi(c.DefaultQuery("limit", "50")); err != nil || filter.Limit < 1 || filter.Limit > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+			return
+		}
+		if filter.From, err = strconv.ParseInt(c.DefaultQuery("from", "0"), 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a unix timestamp"})
+			return
+		}
+		if filter.To, err = strconv.ParseInt(c.DefaultQuery("to", "0"), 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a unix timestamp"})
+			return
+		}
+
+		list, total, err := trips.List(id, filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"vehicle_id": id, "total_trips": total, "trips": list})
+	})
+}
+
+// SetupDrivingTimeRoutes configures the hours of driving API.
+func SetupDrivingTimeRoutes(router *gin.Engine, drivingTime *DrivingTimeService, rules *StatusRuleEngine) {
+	// Continuous driving since the last break, today's and this week's
+	// totals, and the limits in force.
+	router.GET("/api/driving-time/:vehicle_id", func(c *gin.Context) {
+		cfg := rules.Rules().DrivingTime
+		hours, err := drivingTime.Current(c.Param("vehicle_id"), cfg)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"driving_time": hours, "limits": cfg})
+	})
+}
+
+// SetupRateLimitRoutes configures the suppressed alerts API.
+func SetupRateLimitRoutes(router *gin.Engine, rateLimits *RateLimitService, rules *StatusRuleEngine) {
+	// Alerts held back by rate limits or the daily attestation cap, so the
+	// dashboard can show "12 similar events suppressed".
+	router.GET("/api/suppressed/:vehicle_id", func(c *gin.Context) {
+		counts, err := rateLimits.Suppressed(c.Param("vehicle_id"), rules.Rules())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, counts)
+	})
+}
+
+// SetupStreakRoutes configures the safe streak API.
+func SetupStreakRoutes(router *gin.Engine, streaks *StreakService, rules *StatusRuleEngine) {
+	// Current streak: verified safe driving time and the next milestone.
+	router.GET("/api/streak/:vehicle_id", func(c *gin.Context) {
+		cfg := rules.Rules().Streaks
+		streak, err := streaks.Current(c.Param("vehicle_id"), cfg)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Redis error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"streak": streak, "config": cfg})
+	})
 }
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+const (
+	IncidentOpen   = "open"
+	IncidentClosed = "closed"
+)
+
+// openIncidentsKey holds the IDs of all open incidents, so ones whose vehicle
+// went quiet can still be closed.
+const openIncidentsKey = "incidents_open"
+
+// IncidentFilter narrows an incident listing. Zero values match everything.
+type IncidentFilter struct {
+	Type  string
+	State string
+	From  int64 // Start time, inclusive
+	To    int64 // Start time, inclusive
+	Limit int
+}
+
+// IncidentService groups consecutive samples with the same incident status
+// into one Incident. An incident opens on the first sample and closes once
+// the status has not been seen for INCIDENT_CLOSE_AFTER seconds, so a few
+// missed frames don't split an episode in two.
+type IncidentService struct {
+	redisClient *redis.Client
+	onClose     func(Incident) // Called once per incident, after it is stored as closed
+	ctx         context.Context
+}
+
+// NewIncidentService creates a new IncidentService instance.
+func NewIncidentService(redisClient *redis.Client, onClose func(Incident), ctx context.Context) *IncidentService {
+	return &IncidentService{
+		redisClient: redisClient,
+		onClose:     onClose,
+		ctx:         ctx,
+	}
+}
+
+// Observe feeds one processed sample into the incident model: open incidents
+// the sample proves are over get closed, and an incident status extends or
+// opens its incident. It returns the incident if this sample opened it.
+func (s *IncidentService) Observe(data Telemetry, rule StatusRule) *Incident {
+	openKey := fmt.Sprintf("incidents_open:%s", data.VehicleID)
+	open, err := s.redisClient.HGetAll(s.ctx, openKey).Result()
+	if err != nil {
+		log.Printf("Error getting open incidents: %v", err)
+		return nil
+	}
+
+	var current *Incident
+	for incidentType, id := range open {
+		incident, ok := s.get(id)
+		if !ok {
+			s.redisClient.HDel(s.ctx, openKey, incidentType)
+			continue
+		}
+		if data.Timestamp-incident.EndTime > INCIDENT_CLOSE_AFTER {
+			s.close(incident)
+		} else if rule.ResetsStreak && incidentType == data.Status {
+			current = &incident
+		}
+	}
+
+	if !rule.ResetsStreak {
+		return nil
+	}
+
+	if current != nil && s.extendOpen(current.ID, data) {
+		return nil
+	}
+	// No open incident of this type, or it closed meanwhile: open a new one.
+
+	id, err := newIncidentID()
+	if err != nil {
+		log.Printf("Failed to open incident for %s: %v", data.VehicleID, err)
+		return nil
+	}
+	incident := Incident{
+		ID:        id,
+		VehicleID: data.VehicleID,
+		Type:      data.Status,
+		Category:  rule.Category,
+		Severity:  rule.Severity,
+		State:     IncidentOpen,
+		StartTime: data.Timestamp,
+		EndTime:   data.Timestamp,
+	}
+	s.extend(&incident, data)
+	s.save(incident)
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.HSet(s.ctx, openKey, incident.Type, incident.ID)
+	pipe.SAdd(s.ctx, openIncidentsKey, incident.ID)
+	pipe.ZAdd(s.ctx, fmt.Sprintf("incidents:%s", incident.VehicleID), &redis.Z{Score: float64(incident.StartTime), Member: incident.ID})
+	pipe.ZRemRangeByScore(s.ctx, fmt.Sprintf("incidents:%s", incident.VehicleID), "-inf", strconv.FormatInt(incident.StartTime-INCIDENT_RETENTION, 10))
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Failed to index incident %s: %v", incident.ID, err)
+	}
+	log.Printf("🚩 Incident opened: %s %s (Vehicle: %s)", incident.ID, incident.Type, incident.VehicleID)
+	return &incident
+}
+
+func (s *IncidentService) extend(incident *Incident, data Telemetry) {
+	incident.StartTime = min(incident.StartTime, data.Timestamp) // Backlogged samples may arrive late
+	incident.EndTime = max(incident.EndTime, data.Timestamp)
+	incident.DurationSec = incident.EndTime - incident.StartTime
+	incident.PeakConfidence = max(incident.PeakConfidence, data.Confidence)
+	incident.PeakHeartRate = max(incident.PeakHeartRate, data.HeartRate)
+	incident.PeakG = max(incident.PeakG, data.PeakG)
+	incident.PeakSpeedKmh = max(incident.PeakSpeedKmh, data.SpeedKmh)
+	incident.SampleCount++
+	if len(incident.Samples) < MAX_INCIDENT_SAMPLES {
+		incident.Samples = append(incident.Samples, IncidentSample{
+			Timestamp:  data.Timestamp,
+			Confidence: data.Confidence,
+			HeartRate:  data.HeartRate,
+			MessageID:  data.MessageID,
+			Seq:        data.Seq,
+		})
+	}
+}
+
+// extendOpen adds the sample to the incident if it is still open. It is
+// checked and written in one transaction, so a concurrent close (CloseStale)
+// is never undone by writing back the open incident.
+func (s *IncidentService) extendOpen(id string, data Telemetry) bool {
+	key := fmt.Sprintf("incident:%s", id)
+	extended := false
+	for attempt := 0; attempt < 3; attempt++ {
+		err := s.redisClient.Watch(s.ctx, func(tx *redis.Tx) error {
+			var incident Incident
+			val, err := tx.Get(s.ctx, key).Bytes()
+			if err != nil || json.Unmarshal(val, &incident) != nil || incident.State != IncidentOpen {
+				return nil
+			}
+			s.extend(&incident, data)
+			incident.UpdatedAt = time.Now().Unix()
+			incidentJSON, _ := json.Marshal(incident)
+			_, err = tx.TxPipelined(s.ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(s.ctx, key, incidentJSON, INCIDENT_RETENTION*time.Second)
+				return nil
+			})
+			extended = err == nil
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			if err != nil {
+				log.Printf("Failed to extend incident %s: %v", id, err)
+			}
+			return extended
+		}
+	}
+	return false
+}
+
+// CloseStale closes open incidents that haven't been updated for
+// INCIDENT_CLOSE_AFTER seconds of server time, e.g. because the vehicle
+// stopped sending.
+func (s *IncidentService) CloseStale() {
+	ids, err := s.redisClient.SMembers(s.ctx, openIncidentsKey).Result()
+	if err != nil {
+		log.Printf("Error getting open incidents: %v", err)
+		return
+	}
+	now := time.Now().Unix()
+	for _, id := range ids {
+		incident, ok := s.get(id)
+		if !ok {
+			s.redisClient.SRem(s.ctx, openIncidentsKey, id)
+			continue
+		}
+		if incident.State == IncidentOpen && now-incident.UpdatedAt > INCIDENT_CLOSE_AFTER {
+			s.close(incident)
+		}
+	}
+}
+
+// WatchForStale runs CloseStale every interval.
+func (s *IncidentService) WatchForStale(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.CloseStale()
+	}
+}
+
+// close marks the incident closed and hands it to onClose. Removing it from
+// the open set first makes sure it is only handed over once.
+func (s *IncidentService) close(incident Incident) {
+	removed, err := s.redisClient.SRem(s.ctx, openIncidentsKey, incident.ID).Result()
+	if err != nil || removed == 0 {
+		return // Already closed elsewhere
+	}
+	openKey := fmt.Sprintf("incidents_open:%s", incident.VehicleID)
+	if id, _ := s.redisClient.HGet(s.ctx, openKey, incident.Type).Result(); id == incident.ID {
+		s.redisClient.HDel(s.ctx, openKey, incident.Type)
+	}
+
+	incident.State = IncidentClosed
+	s.save(incident)
+	log.Printf("🏁 Incident closed: %s %s (Vehicle: %s, %ds, %d samples)", incident.ID, incident.Type, incident.VehicleID, incident.DurationSec, incident.SampleCount)
+
+	if s.onClose != nil {
+		s.onClose(incident)
+	}
+}
+
+// MarkAttestedOnOpen records that the incident was attested as it opened, so
+// closing it doesn't attest it a second time.
+func (s *IncidentService) MarkAttestedOnOpen(id string) {
+	incident, ok := s.get(id)
+	if !ok {
+		return
+	}
+	incident.AttestedOnOpen = true
+	s.save(incident)
+}
+
+// SetTxHash records the attestation of a closed incident.
+func (s *IncidentService) SetTxHash(id, txHash string) {
+	incident, ok := s.get(id)
+	if !ok {
+		return
+	}
+	incident.TxHash = txHash
+	s.save(incident)
+}
+
+func (s *IncidentService) save(incident Incident) {
+	incident.UpdatedAt = time.Now().Unix()
+	incidentJSON, _ := json.Marshal(incident)
+	err := s.redisClient.Set(s.ctx, fmt.Sprintf("incident:%s", incident.ID), incidentJSON, INCIDENT_RETENTION*time.Second).Err()
+	if err != nil {
+		log.Printf("Failed to save incident %s: %v", incident.ID, err)
+	}
+}
+
+func (s *IncidentService) get(id string) (Incident, bool) {
+	var incident Incident
+	val, err := s.redisClient.Get(s.ctx, fmt.Sprintf("incident:%s", id)).Bytes()
+	if err != nil || json.Unmarshal(val, &incident) != nil {
+		return incident, false
+	}
+	return incident, true
+}
+
+// List returns a vehicle's incidents, newest first.
+func (s *IncidentService) List(vehicleID string, filter IncidentFilter) ([]Incident, error) {
+	maxStart := "+inf"
+	if filter.To != 0 {
+		maxStart = strconv.FormatInt(filter.To, 10)
+	}
+	minStart := "-inf"
+	if filter.From != 0 {
+		minStart = strconv.FormatInt(filter.From, 10)
+	}
+
+	incidents := []Incident{}
+	for offset := int64(0); len(incidents) < filter.Limit; offset += int64(filter.Limit) {
+		ids, err := s.redisClient.ZRevRangeByScore(s.ctx, fmt.Sprintf("incidents:%s", vehicleID), &redis.ZRangeBy{
+			Max: maxStart, Min: minStart, Offset: offset, Count: int64(filter.Limit),
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			incident, ok := s.get(id)
+			if !ok || (filter.Type != "" && incident.Type != filter.Type) || (filter.State != "" && incident.State != filter.State) {
+				continue
+			}
+			incidents = append(incidents, incident)
+			if len(incidents) == filter.Limit {
+				break
+			}
+		}
+		if len(ids) < filter.Limit {
+			break
+		}
+	}
+	return incidents, nil
+}
+
+func newIncidentID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("could not generate incident id: %v", err)
+	}
+	return "inc_" + hex.EncodeToString(buf), nil
+}
+
+// incidentTelemetry is the sample an attestation of the incident stands for.
+func incidentTelemetry(incident Incident) Telemetry {
+	return Telemetry{
+		VehicleID:  incident.VehicleID,
+		Status:     incident.Type,
+		Timestamp:  incident.StartTime,
+		Confidence: incident.PeakConfidence,
+		HeartRate:  incident.PeakHeartRate,
+	}
+}
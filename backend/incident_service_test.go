@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestIncidentServiceLifecycle(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-incident")
+
+	var closed []Incident
+	incidents := NewIncidentService(rdb, func(incident Incident) { closed = append(closed, incident) }, ctx)
+	rules := defaultRules(t)
+	observe := func(status string, ts int64, confidence float64) *Incident {
+		rule, _ := rules.Lookup(status)
+		return incidents.Observe(Telemetry{VehicleID: "test-incident", Status: status, Timestamp: ts, Confidence: confidence}, rule)
+	}
+
+	const t0 = 1700000000
+	opened := observe("drowsy", t0, 0.7)
+	assert.NotNil(t, opened)
+	for i := int64(1); i <= 20; i++ {
+		assert.Nil(t, observe("drowsy", t0+i/2, 0.8), "a burst stays one incident")
+	}
+	assert.Nil(t, observe("drowsy", t0+10+INCIDENT_CLOSE_AFTER, 0.95), "a short pause is bridged")
+	assert.Nil(t, observe("safe", t0+15, 0.9))
+	assert.Empty(t, closed, "safe frames within the hysteresis keep it open")
+
+	assert.Nil(t, observe("safe", t0+30, 0.9))
+	if assert.Len(t, closed, 1) {
+		assert.Equal(t, opened.ID, closed[0].ID)
+		assert.Equal(t, IncidentClosed, closed[0].State)
+		assert.Equal(t, int64(10+INCIDENT_CLOSE_AFTER), closed[0].DurationSec)
+		assert.Equal(t, 22, closed[0].SampleCount)
+		assert.Equal(t, 0.95, closed[0].PeakConfidence)
+	}
+
+	// A critical incident attested as it opened isn't attested again on close.
+	crash := observe(StatusCrash, t0+32, 1)
+	if assert.NotNil(t, crash) {
+		incidents.MarkAttestedOnOpen(crash.ID)
+	}
+	assert.Nil(t, observe("safe", t0+39, 0.9))
+	if assert.Len(t, closed, 2) {
+		assert.Equal(t, StatusCrash, closed[1].Type)
+		assert.True(t, closed[1].AttestedOnOpen)
+	}
+
+	assert.NotNil(t, observe("hard braking", t0+40, 0.5))
+	list, err := incidents.List("test-incident", IncidentFilter{Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, list, 3)
+	list, _ = incidents.List("test-incident", IncidentFilter{Type: "drowsy", State: IncidentClosed, Limit: 10})
+	assert.Len(t, list, 1)
+}
+
+func TestIncidentServiceExtendAfterClose(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-incident-race")
+	incidents := NewIncidentService(rdb, nil, ctx)
+	rules := defaultRules(t)
+	rule, _ := rules.Lookup("drowsy")
+	sample := Telemetry{VehicleID: "test-incident-race", Status: "drowsy", Timestamp: 1700000000}
+
+	opened := incidents.Observe(sample, rule)
+	if !assert.NotNil(t, opened) {
+		return
+	}
+	assert.True(t, incidents.extendOpen(opened.ID, sample))
+
+	// CloseStale closes it between Observe reading it and extending it.
+	incident, _ := incidents.get(opened.ID)
+	incidents.close(incident)
+	assert.False(t, incidents.extendOpen(opened.ID, sample))
+	incident, _ = incidents.get(opened.ID)
+	assert.Equal(t, IncidentClosed, incident.State, "not re-opened")
+	assert.Equal(t, 2, incident.SampleCount)
+}
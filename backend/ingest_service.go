@@ -0,0 +1,569 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// IngestService runs decoded telemetry through the processing pipeline
+// (status normalization, history, points, attestation). It does not know
+// which transport a sample arrived on, so MQTT and HTTP share one code path.
+type IngestService struct {
+	redisClient       *redis.Client
+	blockchainService *BlockchainService
+	clockService      *ClockService
+	dedupService      *DedupService
+	deadLetters       *DeadLetterService
+	rules             *StatusRuleEngine
+	rateLimits        *RateLimitService
+	incidents         *IncidentService
+	detectors         *DetectorService
+	biometrics        *BiometricService
+	risk              *RiskService
+	dynamics          *DynamicsService
+	emergencies       *EmergencyService
+	gps               *GPSService
+	geofences         *GeofenceService
+	trips             *TripService
+	drivingTime       *DrivingTimeService
+	motion            *MotionService
+	fraud             *FraudService
+	streaks           *StreakService
+	points            *PointsService
+	rewards           *RewardService
+	ctx               context.Context
+}
+
+// NewIngestService creates a new IngestService instance.
+func NewIngestService(redisClient *redis.Client, blockchainService *BlockchainService, deadLetters *DeadLetterService, rules *StatusRuleEngine, ctx context.Context) *IngestService {
+	s := &IngestService{
+		redisClient:       redisClient,
+		blockchainService: blockchainService,
+		clockService:      NewClockService(redisClient, ctx),
+		dedupService:      NewDedupService(redisClient, ctx),
+		deadLetters:       deadLetters,
+		rules:             rules,
+		rateLimits:        NewRateLimitService(redisClient, ctx),
+		detectors:         NewDetectorService(redisClient, ctx),
+		biometrics:        NewBiometricService(redisClient, ctx),
+		risk:              NewRiskService(redisClient, ctx),
+		dynamics:          NewDynamicsService(redisClient, ctx),
+		emergencies:       NewEmergencyService(redisClient, ctx),
+		gps:               NewGPSService(redisClient, ctx),
+		geofences:         NewGeofenceService(redisClient, ctx),
+		trips:             NewTripService(redisClient, ctx),
+		drivingTime:       NewDrivingTimeService(redisClient, ctx),
+		motion:            NewMotionService(redisClient, ctx),
+		fraud:             NewFraudService(redisClient, ctx),
+		streaks:           NewStreakService(redisClient, ctx),
+		points:            NewPointsService(redisClient, ctx),
+		ctx:               ctx,
+	}
+	s.rewards = NewRewardService(redisClient, s.points, s.trips, ctx)
+	s.incidents = NewIncidentService(redisClient, s.attestIncident, ctx)
+	return s
+}
+
+// IngestPayload decodes a raw message and processes it. Messages that can't
+// be decoded or processed are dead-lettered.
+func (s *IngestService) IngestPayload(msg RawMessage) (IngestResult, error) {
+	batch, err := s.DecodePayload(msg)
+	if err != nil {
+		return IngestResult{}, err
+	}
+
+	result, err := s.IngestBatch(batch)
+	if err != nil {
+		s.Reject(msg, DeadLetterIngestError, err)
+	}
+	return result, err
+}
+
+// DecodePayload decodes a raw message into a batch, dead-lettering it if the
+// payload is unreadable or too large.
+func (s *IngestService) DecodePayload(msg RawMessage) (TelemetryBatch, error) {
+	if msg.Encoding == "" {
+		msg.Encoding = sniffEncoding(msg.Payload)
+	}
+	batch, reason, err := decodeRawMessage(msg, s.rules.Rules())
+	if err != nil {
+		s.Reject(msg, reason, err)
+	}
+	return batch, err
+}
+
+// Reject dead-letters a message that failed before or during ingestion.
+func (s *IngestService) Reject(msg RawMessage, reason string, err error) {
+	if s.deadLetters != nil {
+		s.deadLetters.Record(msg, reason, err)
+	}
+}
+
+// Replay re-injects a dead letter into the pipeline, optionally with a fixed
+// payload, and removes it once it goes through. Replays are operator actions,
+// so device authentication is not checked again.
+func (s *IngestService) Replay(id string, fixedPayload []byte, enc TelemetryEncoding) (IngestResult, error) {
+	letter, ok, err := s.deadLetters.Get(id)
+	if err != nil {
+		return IngestResult{}, err
+	}
+	if !ok {
+		return IngestResult{}, errDeadLetterNotFound
+	}
+
+	msg := letter.RawMessage(fixedPayload, enc)
+	if msg.Encoding == "" {
+		msg.Encoding = sniffEncoding(msg.Payload)
+	}
+	batch, _, err := decodeRawMessage(msg, s.rules.Rules())
+	if err != nil {
+		return IngestResult{}, err
+	}
+	result, err := s.IngestBatch(batch)
+	if err != nil {
+		return result, err
+	}
+
+	log.Printf("🔁 Replayed dead letter %s (%d accepted, %d duplicates)", id, result.Accepted, result.Duplicates)
+	if err := s.deadLetters.Delete(id); err != nil {
+		log.Printf("Failed to delete replayed dead letter %s: %v", id, err)
+	}
+	return result, nil
+}
+
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// decodeRawMessage decodes msg and fills in the vehicle ID from an MQTT
+// topic. On failure it also returns the dead-letter reason.
+func decodeRawMessage(msg RawMessage, rules *StatusRuleSet) (TelemetryBatch, string, error) {
+	batch, err := DecodeTelemetry(msg.Payload, msg.Encoding)
+	if err != nil {
+		return batch, DeadLetterParseError, fmt.Errorf("invalid %s payload: %v", msg.Encoding, err)
+	}
+	if len(batch.Samples) > MAX_TELEMETRY_BATCH {
+		return batch, DeadLetterBatchTooLarge, fmt.Errorf("batch of %d samples exceeds %d", len(batch.Samples), MAX_TELEMETRY_BATCH)
+	}
+	if batch.VehicleID == "" {
+		batch.VehicleID = vehicleIDFromTopic(msg.Topic)
+	}
+
+	// Bring every sample up to the current contract, then validate it. One
+	// bad sample rejects the whole message so it can be fixed and replayed.
+	var violations ValidationErrors
+	for i := range batch.Samples {
+		sample := &batch.Samples[i]
+		if sample.VehicleID == "" {
+			sample.VehicleID = batch.VehicleID
+		}
+		err := migrateTelemetry(sample)
+		if err == nil {
+			err = validateTelemetry(*sample, rules)
+		}
+		if errs, ok := err.(ValidationErrors); ok {
+			for _, v := range errs {
+				if len(batch.Samples) > 1 {
+					v.Field = fmt.Sprintf("samples[%d].%s", i, v.Field)
+				}
+				violations = append(violations, v)
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return batch, DeadLetterSchemaViolation, violations
+	}
+	return batch, "", nil
+}
+
+// Ingest processes a single telemetry sample.
+func (s *IngestService) Ingest(data Telemetry) error {
+	_, err := s.IngestBatch(TelemetryBatch{VehicleID: data.VehicleID, Samples: []Telemetry{data}})
+	return err
+}
+
+// pending is a sample of a batch waiting to be processed.
+type pending struct {
+	data      Telemetry
+	derived   bool    // Raised from the IMU data of another sample
+	vibration float64 // imuVibration of the raw IMU data
+}
+
+// IngestBatch drops duplicates, resolves the event time of every sample,
+// then processes them oldest first so backlogged data flows through history,
+// points and alerts in the order it happened.
+func (s *IngestService) IngestBatch(batch TelemetryBatch) (IngestResult, error) {
+	var result IngestResult
+	receivedAtMs := time.Now().UnixMilli()
+
+	samples := make([]pending, 0, len(batch.Samples))
+	for _, data := range batch.Samples {
+		if data.VehicleID == "" {
+			data.VehicleID = batch.VehicleID
+		}
+		if s.dedupService.IsDuplicate(data) {
+			result.Duplicates++
+			continue
+		}
+		s.clockService.Resolve(&data, batch.SentAt, receivedAtMs)
+
+		var events []Telemetry
+		if cfg := s.rules.Rules().Dynamics; cfg != nil && len(data.IMU) > 0 {
+			events = s.dynamics.Detect(data, *cfg)
+		}
+		vibration := imuVibration(data.IMU)
+		data.IMU = nil // Raw motion data isn't stored
+		samples = append(samples, pending{data: data, vibration: vibration})
+		for _, event := range events {
+			samples = append(samples, pending{data: event, derived: true})
+		}
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].data.Timestamp < samples[j].data.Timestamp })
+
+	// Speed, zone changes, driving time and motion state need fixes in time
+	// order, so GPS events are derived here.
+	rules := s.rules.Rules()
+	for i, p := range samples {
+		var events []Telemetry
+		if !p.derived {
+			var inside []Geofence
+			events, inside = s.geofences.Evaluate(p.data)
+			events = append(s.gps.Track(&p.data, rules.Speeding, inside), events...)
+			events = append(events, s.drivingTime.Update(p.data, rules.DrivingTime)...)
+			p.data.Motion = s.motion.Classify(p.data, p.vibration, rules.Motion)
+			s.fraud.Inspect(p.data, receivedAtMs)
+		}
+		if err := s.process(p.data); err != nil {
+			s.forget(samples[i:])
+			return result, err
+		}
+		if p.derived {
+			result.Derived++
+		} else {
+			result.Accepted++
+		}
+		for _, event := range events {
+			if err := s.process(event); err != nil {
+				s.forget(samples[i:])
+				return result, err
+			}
+			if event.GeofenceID != "" {
+				s.reportGeofenceEvent(event, rules)
+			}
+			result.Derived++
+		}
+	}
+	return result, nil
+}
+
+// forget unmarks the samples from the one that failed on, so the dead
+// letter's replay (or a redelivery) isn't dropped as a duplicate.
+func (s *IngestService) forget(samples []pending) {
+	for _, p := range samples {
+		if !p.derived {
+			s.dedupService.Forget(p.data)
+		}
+	}
+}
+
+// deviceName identifies which device on a vehicle sent a sample. Clocks and
+// sequence counters are per device (e.g. the CV host and the Pico).
+func deviceName(data Telemetry) string {
+	if data.DeviceID != "" {
+		return data.DeviceID
+	}
+	if data.Source != "" {
+		return data.Source
+	}
+	return "default"
+}
+
+// process runs one sample through the pipeline. data.Timestamp is the event time.
+func (s *IngestService) process(data Telemetry) error {
+	log.Printf("DEBUG: Ingest for Vehicle: %s, Status: %s at %d", data.VehicleID, data.Status, data.Timestamp)
+
+	// Backlogged samples still count towards history, points and alerts,
+	// but must not overwrite the live state of the vehicle.
+	isLatest := s.markLatest(data.VehicleID, data.Timestamp)
+
+	// --- Status Classification (rules from status_rules.json) ---
+	rules := s.rules.Rules()
+	rule, ok := rules.Lookup(data.Status)
+	if !ok {
+		// Validated on decode, so only a hot reload in between can get here.
+		log.Printf("⚠️ No status rule for %q (Vehicle: %s); skipping sample", data.Status, data.VehicleID)
+		return nil
+	}
+	data.Status = rule.Normalized()
+	if rule.Source != "" {
+		data.Source = rule.Source
+	}
+
+	// --- Detector Stage: N of M confirmation and confidence gating ---
+	if detector, ok := rules.Detectors[data.Source]; ok {
+		if confirmed := s.detectors.Confirm(data, rule, detector); confirmed != data.Status {
+			if confirmedRule, ok := rules.Lookup(confirmed); ok {
+				// An unconfirmed unsafe reading shows as safe, but is no
+				// evidence of safe driving either.
+				data.Pending = !rule.Safe && confirmedRule.Safe
+				data.RawStatus = data.Status
+				data.Status = confirmed
+				rule = confirmedRule
+			}
+		}
+	}
+	if rule.Category == "driver" || rule.Category == "vehicle" {
+		s.setLiveStatus(isLatest, fmt.Sprintf("%s_status:%s", rule.Category, data.VehicleID), data.Status)
+	}
+
+	// --- Biometrics: sustained HR anomalies against the driver's baseline ---
+	assessment := s.biometrics.Assess(data)
+	data.BiometricState = assessment.State
+	if assessment.State != BiometricNoReading {
+		s.setLiveStatus(isLatest, fmt.Sprintf("biometric_status:%s", data.VehicleID), assessment.State)
+	}
+	if assessment.Critical {
+		rule, _ = rules.Lookup(StatusHealthCritical)
+		data.Status = rule.Normalized()
+		data.Source = rule.Source
+		data.Pending = false
+		// Critical severity forces an immediate alert (bypasses rate limits below)
+	}
+
+	// --- Motion: e.g. drowsiness in a parked car isn't an incident ---
+	policy := rules.Motion.Policy(data.Motion)
+	raises := policy.Raises(rule)
+	if !raises {
+		s.rateLimits.suppress(data, SuppressedMotion)
+	}
+
+	// --- Fraud: quarantined vehicles earn no rewards until reviewed ---
+	if s.fraud.Quarantined(data.VehicleID) {
+		policy.Streaks, policy.PeriodicAttestation = false, false
+	}
+
+	// --- Incidents: bursts of one status become one incident ---
+	var opened *Incident
+	if raises {
+		opened = s.incidents.Observe(data, rule)
+	}
+
+	// --- Risk: fused, decaying risk index that escalates on its own ---
+	risk := s.risk.Update(data, opened, assessment) // Each incident counts once
+	data.RiskScore = math.Round(risk.Score*10) / 10
+	if risk.Escalated {
+		s.escalateRisk(data, risk, rules)
+	}
+
+	// Re-marshal payload with normalized status and timestamp
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode sample: %v", err) // Keep the stored state readable
+	}
+
+	// 1. Save Hot State (Latest - Overall)
+	if isLatest {
+		err := s.redisClient.Set(s.ctx, data.VehicleID, payload, time.Hour).Err()
+		if err != nil {
+			return fmt.Errorf("failed to save to Redis: %v", err)
+		}
+	}
+
+	// 2. Save Telemetry History (For Graph)
+	historyKey := fmt.Sprintf("history:%s", data.VehicleID)
+	s.redisClient.RPush(s.ctx, historyKey, payload)
+	s.redisClient.LTrim(s.ctx, historyKey, -50, -1) // Keep last 50 points
+
+	// 3. POINTS SYSTEM (Gamification)
+	lastIncidentTsKey := fmt.Sprintf("last_incident_timestamp:%s", data.VehicleID)
+	lastPeriodicAttestationTsKey := fmt.Sprintf("last_periodic_attestation_timestamp:%s", data.VehicleID)
+
+	s.streaks.SeeSource(data)
+	if rule.Safe && !data.Pending {
+		// Extend the safe streak (verified safe driving time), unless the
+		// motion policy or a fraud quarantine says otherwise
+		var milestone *StreakMilestone
+		if policy.Streaks {
+			milestone = s.streaks.Confirm(data, rules.Streaks)
+		}
+
+		// Milestone reached: award its points, as the reward rules have them
+		if milestone != nil && milestone.Points > 0 {
+			entries := s.rewards.Milestone(data, *milestone, rules.Rewards)
+			var earned int64
+			for _, entry := range entries {
+				earned += entry.Amount
+			}
+			if len(entries) > 0 {
+				balance := entries[len(entries)-1].Balance
+				log.Printf("🎉 Vehicle %s earned %d points for a %d min safe streak! Current total: %d", data.VehicleID, earned, milestone.Minutes, balance)
+
+				// --- Trigger Solana Safe Attestation (Streak-based) ---
+				if milestone.Attest && s.rateLimits.AllowAttestation(data, rule, rules) {
+					go s.blockchainService.sendSolanaSafeAttestation(data, int(earned), int(balance))
+				}
+			}
+		}
+
+		// --- NEW: Time-based Periodic Safe Attestation Logic ---
+		currentTime := data.Timestamp
+
+		// Get last periodic attestation timestamp
+		lastPeriodicAttestationTsStr, err := s.redisClient.Get(s.ctx, lastPeriodicAttestationTsKey).Result()
+		var lastPeriodicAttestationTs int64
+		if err == redis.Nil {
+			lastPeriodicAttestationTs = 0 // Never attested
+		} else if err != nil {
+			log.Printf("Error getting last periodic attestation timestamp: %v", err)
+			lastPeriodicAttestationTs = 0
+		} else {
+			lastPeriodicAttestationTs, _ = strconv.ParseInt(lastPeriodicAttestationTsStr, 10, 64)
+		}
+
+		// Get last incident timestamp
+		lastIncidentTsStr, err := s.redisClient.Get(s.ctx, lastIncidentTsKey).Result()
+		var lastIncidentTs int64
+		if err == redis.Nil {
+			lastIncidentTs = 0 // No incident ever recorded for this vehicle
+		} else if err != nil {
+			log.Printf("Error getting last incident timestamp: %v", err)
+			lastIncidentTs = 0
+		} else {
+			lastIncidentTs, _ = strconv.ParseInt(lastIncidentTsStr, 10, 64)
+		}
+
+		// Check conditions for periodic attestation
+		if policy.PeriodicAttestation &&
+			(currentTime-lastPeriodicAttestationTs >= PERIODIC_SAFE_ATTESTATION_INTERVAL) &&
+			(currentTime-lastIncidentTs >= PERIODIC_SAFE_ATTESTATION_INTERVAL || lastIncidentTs == 0) {
+
+			if s.rateLimits.AllowAttestation(data, rule, rules) {
+				go s.blockchainService.sendSolanaPeriodicSafeAttestation(data)
+				log.Printf("✅ Periodic safe attestation triggered for %s", data.VehicleID)
+			}
+			s.redisClient.Set(s.ctx, lastPeriodicAttestationTsKey, strconv.FormatInt(currentTime, 10), 0) // Store as string
+		}
+
+	} else if rule.ResetsStreak && raises { // data.Status is an incident
+		// Reset safe streak
+		s.streaks.Break(data.VehicleID)
+		// Update last incident timestamp
+		s.redisClient.Set(s.ctx, lastIncidentTsKey, strconv.FormatInt(data.Timestamp, 10), 0) // Store as string
+		// Reset periodic attestation timer if an incident occurs
+		s.redisClient.Set(s.ctx, lastPeriodicAttestationTsKey, 0, 0)
+	}
+
+	// 4. INCIDENTS: opened above, attested once with their summary when
+	// they close (see attestIncident)
+	if opened != nil {
+		s.rewards.Penalize(data, opened, rules.Rewards)
+	}
+	if opened != nil && rule.Attest && rule.IsCritical() {
+		// Critical incidents can't wait for the summary (Immediate Trigger)
+		log.Printf("⚠️ INCIDENT DETECTED: %s (Vehicle: %s, Severity: %s)", data.Status, data.VehicleID, rule.Severity)
+		s.incidents.MarkAttestedOnOpen(opened.ID)
+		go s.blockchainService.sendSolanaAlert(data)
+	}
+
+	// 5. EMERGENCY: ask the driver, alert contacts if nobody answers
+	if opened != nil && rule.Emergency {
+		s.emergencies.Start(data, opened.ID)
+	}
+
+	// 6. TRIPS: segment drives and keep their summaries
+	s.trips.Observe(data, rule, opened, s.gps.TotalKm(data.VehicleID))
+
+	return nil
+}
+
+// escalateRisk records a risk level escalation and raises HIGH_RISK through
+// the alert path, if the rules define it.
+func (s *IngestService) escalateRisk(data Telemetry, risk RiskState, rules *StatusRuleSet) {
+	log.Printf("📈 RISK ESCALATION: %s is %s (score %.0f, trigger: %s)", data.VehicleID, risk.Level, risk.Score, data.Status)
+	escalationJSON, _ := json.Marshal(RiskEscalation{
+		Timestamp: data.Timestamp,
+		Score:     data.RiskScore,
+		Level:     risk.Level,
+		Trigger:   data.Status,
+	})
+	escalationsKey := fmt.Sprintf("risk_escalations:%s", data.VehicleID)
+	s.redisClient.RPush(s.ctx, escalationsKey, escalationJSON)
+	s.redisClient.LTrim(s.ctx, escalationsKey, -50, -1)
+
+	rule, ok := rules.Lookup(StatusHighRisk)
+	if !ok || !rule.Attest {
+		return
+	}
+	alert := data
+	alert.Status = rule.Normalized()
+	if s.rateLimits.AllowAlert(alert, rule, rules) {
+		go s.blockchainService.sendSolanaAlert(alert)
+	}
+}
+
+// reportGeofenceEvent lists a geofence event with the vehicle's alerts, and
+// attests violations of zones that ask for it.
+func (s *IngestService) reportGeofenceEvent(event Telemetry, rules *StatusRuleSet) {
+	if event.Status == StatusGeofenceViolation {
+		zone, err := s.geofences.Get(event.GeofenceID)
+		rule, ok := rules.Lookup(event.Status)
+		if err == nil && ok && zone.Properties.Attest && s.rateLimits.AllowAlert(event, rule, rules) {
+			go s.blockchainService.sendSolanaAlert(event) // Lists it once it has a signature
+			return
+		}
+	}
+	eventJSON, _ := json.Marshal(event)
+	alertKey := fmt.Sprintf("alerts:%s", event.VehicleID)
+	s.redisClient.RPush(s.ctx, alertKey, eventJSON)
+	s.redisClient.LTrim(s.ctx, alertKey, -20, -1)
+}
+
+// attestIncident logs a closed incident on-chain, within the status/category
+// token buckets and the daily cap. Critical incidents were already attested
+// as they opened.
+func (s *IngestService) attestIncident(incident Incident) {
+	rules := s.rules.Rules()
+	rule, ok := rules.Lookup(incident.Type)
+	if !ok {
+		// Rule removed by a reload while the incident was open
+		rule = StatusRule{Status: incident.Type, Category: incident.Category, Severity: incident.Severity, Attest: true}
+	}
+	if incident.AttestedOnOpen || !rule.Attest || !s.rateLimits.AllowAlert(incidentTelemetry(incident), rule, rules) {
+		return
+	}
+
+	go func() {
+		if sig := s.blockchainService.sendSolanaIncident(incident); sig != "" {
+			s.incidents.SetTxHash(incident.ID, sig)
+		}
+	}()
+}
+
+// markLatest records ts as the newest event time seen for the vehicle and
+// reports whether the sample is at least as new as everything before it.
+func (s *IngestService) markLatest(vehicleID string, ts int64) bool {
+	key := fmt.Sprintf("last_event_timestamp:%s", vehicleID)
+	last, err := s.redisClient.Get(s.ctx, key).Int64()
+	if err != nil && err != redis.Nil {
+		log.Printf("Error getting last event timestamp: %v", err)
+	}
+	if ts < last {
+		return false
+	}
+	s.redisClient.Set(s.ctx, key, strconv.FormatInt(ts, 10), 0)
+	return true
+}
+
+// setLiveStatus updates a driver/vehicle status key unless the sample is backlogged.
+func (s *IngestService) setLiveStatus(isLatest bool, key, status string) {
+	if isLatest {
+		s.redisClient.Set(s.ctx, key, status, 0)
+	}
+}
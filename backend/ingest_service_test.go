@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// failingSet makes saving a vehicle's live state fail while failing is set.
+type failingSet struct {
+	vehicleID string
+	failing   *bool
+}
+
+func (h failingSet) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if args := cmd.Args(); *h.failing && cmd.Name() == "set" && len(args) > 1 && args[1] == h.vehicleID {
+		return ctx, fmt.Errorf("injected failure")
+	}
+	return ctx, nil
+}
+func (h failingSet) AfterProcess(ctx context.Context, cmd redis.Cmder) error { return nil }
+func (h failingSet) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+func (h failingSet) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error { return nil }
+
+func TestReplayAfterFailedIngest(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-replay")
+	rdb.Del(ctx, deadLetterStream)
+	now := time.Now().Unix()
+	rdb.Set(ctx, "last_periodic_attestation_timestamp:test-replay", now, 0) // No attestation without a chain
+
+	failing := true
+	rdb.AddHook(failingSet{vehicleID: "test-replay", failing: &failing})
+	deadLetters := NewDeadLetterService(rdb, ctx)
+	ingest := NewIngestService(rdb, nil, deadLetters, testStatusRules(t), ctx)
+
+	payload := fmt.Sprintf(`{"vehicle_id": "test-replay", "status": "safe", "timestamp": %d, "message_id": "m-1", "seq": 1}`, now)
+	_, err := ingest.IngestPayload(RawMessage{Transport: "http", Encoding: EncodingJSON, Payload: []byte(payload)})
+	assert.Error(t, err)
+	letters, _ := deadLetters.List(DeadLetterIngestError, "", 10)
+	if !assert.Len(t, letters, 1) {
+		return
+	}
+
+	// Once the store is back, the replay goes through instead of being
+	// dropped as a duplicate of the failed attempt.
+	failing = false
+	result, err := ingest.Replay(letters[0].ID, nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Accepted)
+	assert.Equal(t, 0, result.Duplicates)
+	stored, err := rdb.Get(ctx, "test-replay").Result()
+	if assert.NoError(t, err) {
+		assert.Contains(t, stored, strconv.FormatInt(now, 10))
+	}
+}
+
+func TestHeldBackSamplesArePending(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-pending")
+	now := time.Now().Unix()
+	rdb.Set(ctx, "last_periodic_attestation_timestamp:test-pending", now, 0) // No attestation without a chain
+
+	engine := testStatusRules(t)
+	rules := *engine.Rules()
+	streakCfg := *rules.Streaks
+	streakCfg.RequireMoving = false // No GPS in this test
+	rules.Streaks = &streakCfg
+	engine.current.Store(&rules)
+	ingest := NewIngestService(rdb, nil, NewDeadLetterService(rdb, ctx), engine, ctx)
+
+	// Samples taken ageSec ago, so the clock stage keeps them apart.
+	send := func(status string, ageSec int64) Telemetry {
+		payload := fmt.Sprintf(`{"vehicle_id": "test-pending", "status": %q, "age_ms": %d, "source": "ai", "confidence": 0.9}`, status, ageSec*1000)
+		_, err := ingest.IngestPayload(RawMessage{Transport: "http", Encoding: EncodingJSON, Payload: []byte(payload)})
+		assert.NoError(t, err)
+		var stored Telemetry
+		raw, _ := rdb.Get(ctx, "test-pending").Bytes()
+		assert.NoError(t, json.Unmarshal(raw, &stored))
+		return stored
+	}
+
+	send("safe", 60)
+	lastSafe := send("safe", 50)
+	stored := send("drowsy", 40)
+	assert.Equal(t, "safe", stored.Status)
+	assert.Equal(t, "drowsy", stored.RawStatus)
+	assert.True(t, stored.Pending)
+
+	// An unconfirmed drowsy frame is not verified safe driving time.
+	streak, err := ingest.streaks.Current("test-pending", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, lastSafe.Timestamp, streak.ConfirmedAt)
+
+	stored = send("safe", 30)
+	assert.False(t, stored.Pending)
+	streak, _ = ingest.streaks.Current("test-pending", nil)
+	assert.Equal(t, stored.Timestamp, streak.ConfirmedAt)
+}
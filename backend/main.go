@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/gagliardetto/solana-go"
 	"github.com/gagliardetto/solana-go/rpc"
@@ -15,6 +16,7 @@ import (
 
 var (
 	blockchainService *BlockchainService // Global for blockchain service
+	ingestService     *IngestService     // Global for telemetry ingestion
 	mqttService       *MQTTService       // Global for MQTT service
 	redisService      *RedisService      // Global for Redis service
 	ctx               = context.Background()
@@ -23,6 +25,12 @@ var (
 // --- Main ---
 
 func main() {
+	// --- Tool Subcommands ---
+	if len(os.Args) > 1 && os.Args[1] == "encode" {
+		RunEncode(os.Args[2:])
+		return
+	}
+
 	// --- Environment Variables ---
 	redisAddr := os.Getenv("REDIS_ADDR")
 	if redisAddr == "" {
@@ -34,6 +42,14 @@ func main() {
 		mqttBroker = "tcp://localhost:1883"
 	}
 
+	if tz := os.Getenv("FLEET_TIMEZONE"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatalf("❌ FATAL: Invalid FLEET_TIMEZONE %q: %v", tz, err)
+		}
+		fleetTimezone = loc
+	}
+
 	log.Println("SafeRide Backend v4.0 (Auth + Gamification)")
 
 	// --- Load Solana Wallet ---
@@ -60,8 +76,29 @@ func main() {
 	// --- Init Blockchain Service ---
 	blockchainService = NewBlockchainService(solanaClient, solanaWallet, redisService.Client(), redisService.Context())
 
+	// --- Load Status Rules (hot-reloaded) ---
+	rulesFile := os.Getenv("STATUS_RULES_FILE")
+	if rulesFile == "" {
+		rulesFile = "status_rules.json"
+	}
+	statusRules, err := NewStatusRuleEngine(rulesFile)
+	if err != nil {
+		log.Fatalf("❌ FATAL: %v", err)
+	}
+	go statusRules.WatchForChanges(STATUS_RULES_RELOAD_INTERVAL * time.Second)
+
+	// --- Init Ingest Service (shared by MQTT and HTTP) ---
+	deadLetterService := NewDeadLetterService(redisService.Client(), redisService.Context())
+	ingestService = NewIngestService(redisService.Client(), blockchainService, deadLetterService, statusRules, redisService.Context())
+	go ingestService.incidents.WatchForStale(INCIDENT_SWEEP_INTERVAL * time.Second)
+	go ingestService.trips.WatchForStale(TRIP_SWEEP_INTERVAL * time.Second)
+
 	// --- Init MQTT Service ---
-	mqttService = NewMQTTService(mqttBroker, redisService.Client(), blockchainService, redisService.Context())
+	mqttService = NewMQTTService(mqttBroker, ingestService, redisService.Context())
+	ingestService.emergencies.downlink = mqttService.PublishDownlink
+	ingestService.drivingTime.downlink = mqttService.PublishDownlink
+	ingestService.emergencies.webhookURL = os.Getenv("EMERGENCY_WEBHOOK_URL")
+	go ingestService.emergencies.WatchForExpired(EMERGENCY_SWEEP_INTERVAL * time.Second)
 	if err := mqttService.ConnectAndSubscribe(); err != nil {
 		log.Fatalf("Could not connect to MQTT Broker: %v", err)
 	}
@@ -75,8 +112,8 @@ func main() {
 	router.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-Device-Token, X-Admin-Key, Idempotency-Key")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -86,6 +123,15 @@ func main() {
 	})
 
 	SetupRoutes(router, redisService.Client(), ctx) // Pass redisService.Client() and ctx
+	SetupTelemetryRoutes(router, redisService.Client(), ingestService, ctx)
+	SetupAdminRoutes(router, ingestService, deadLetterService)
+	SetupIncidentRoutes(router, ingestService.incidents)
+	SetupEmergencyRoutes(router, redisService.Client(), ingestService.emergencies, ctx)
+	SetupGeofenceRoutes(router, ingestService.geofences)
+	SetupTripRoutes(router, ingestService.trips)
+	SetupDrivingTimeRoutes(router, ingestService.drivingTime, ingestService.rules)
+	SetupStreakRoutes(router, ingestService.streaks, ingestService.rules)
+	SetupRateLimitRoutes(router, ingestService.rateLimits, ingestService.rules)
 
 	go func() {
 		if err := router.Run(":8080"); err != nil {
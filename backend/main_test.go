@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -35,3 +36,143 @@ func TestStatusEndpoint(t *testing.T) {
 	assert.Equal(t, 200, w.Code)
 	assert.Contains(t, w.Body.String(), "safe")
 }
+
+func TestTelemetryEndpointRejectsBadToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+
+	SetupTelemetryRoutes(router, rdb, NewIngestService(rdb, nil, nil, testStatusRules(t), context.Background()), context.Background())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/telemetry", strings.NewReader(`{"vehicle_id":"test-car","status":"safe"}`))
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestRejectedTelemetryIsDeadLettered(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	rdb.Del(context.Background(), deadLetterStream)
+	token, _ := issueDeviceToken(context.Background(), rdb, "test-car")
+
+	deadLetters := NewDeadLetterService(rdb, context.Background())
+	SetupTelemetryRoutes(router, rdb, NewIngestService(rdb, nil, deadLetters, testStatusRules(t), context.Background()), context.Background())
+
+	// Without a token, nothing is read or kept.
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/telemetry", strings.NewReader(`{"vehicle_id": "test-car", "status": `))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+	count, _ := rdb.XLen(context.Background(), deadLetterStream).Result()
+	assert.Zero(t, count)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/telemetry", strings.NewReader(strings.Repeat(" ", MAX_TELEMETRY_BODY+1)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/telemetry", strings.NewReader(`{"vehicle_id": "test-car", "status": `))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	letters, err := deadLetters.List("", "", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, DeadLetterParseError, letters[0].Reason)
+		assert.Equal(t, `{"vehicle_id": "test-car", "status": `, letters[0].PayloadText)
+	}
+}
+
+func TestRedeemRequiresOwner(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "points_ledger:test-redeem-auth", "redemption_key:test-redeem-auth:intent-1")
+	rdb.Set(ctx, "points:test-redeem-auth", 100, 0)
+	rdb.Set(ctx, "user:owner@test", `{"email":"owner@test","vehicle_id":"test-redeem-auth"}`, 0)
+	rdb.Set(ctx, "user:other@test", `{"email":"other@test","vehicle_id":"test-redeem-other"}`, 0)
+	owner, _ := issueSessionToken(ctx, rdb, "owner@test")
+	other, _ := issueSessionToken(ctx, rdb, "other@test")
+
+	SetupRoutes(router, rdb, ctx)
+	redeem := func(token string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/redeem-points", strings.NewReader(`{"vehicle_id":"test-redeem-auth","points":30,"reward":"Coffee"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "intent-1")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 401, redeem(""))
+	assert.Equal(t, 401, redeem("not-a-token"))
+	assert.Equal(t, 403, redeem(other))
+	assert.Equal(t, 200, redeem(owner))
+	assert.Equal(t, 200, redeem(owner), "same intent replays")
+
+	balance, _ := rdb.Get(ctx, "points:test-redeem-auth").Int64()
+	assert.Equal(t, int64(70), balance)
+
+	// Only the owner can look the redemption up.
+	id, _ := rdb.Get(ctx, "redemption_key:test-redeem-auth:intent-1").Result()
+	lookup := func(token string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/redemptions/"+id, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, 401, lookup(""))
+	assert.Equal(t, 404, lookup(other))
+	assert.Equal(t, 200, lookup(owner))
+}
+
+func TestSignupNeedsDeviceToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "user:driver@test")
+	token, _ := issueDeviceToken(ctx, rdb, "test-signup")
+
+	SetupRoutes(router, rdb, ctx)
+	signup := func(deviceToken string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/signup", strings.NewReader(`{"email":"driver@test","password":"secret","vehicle_id":"test-signup"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Device-Token", deviceToken)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 401, signup(""), "vehicles can't be claimed")
+	assert.Equal(t, 201, signup(token))
+	assert.Equal(t, 409, signup(token), "existing users aren't overwritten")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// Motion states. A sample without GPS or IMU data has none, and no policy
+// applies to it. Neither has a fix that never changes: that is a placeholder
+// (the CV agent sends one), not a position.
+const (
+	MotionMoving  = "moving"
+	MotionIdling  = "idling" // Stopped, engine running or only briefly stopped
+	MotionParked  = "parked"
+	MotionUnknown = ""
+)
+
+var motionStates = map[string]bool{MotionMoving: true, MotionIdling: true, MotionParked: true}
+
+// MotionConfig sets how motion states are derived and what a sample may do
+// in each of them.
+type MotionConfig struct {
+	ParkAfterSec   int64                   `json:"park_after_sec"`   // Standing still this long without engine vibration is parked
+	IdleVibrationG float64                 `json:"idle_vibration_g"` // IMU vibration (std dev of |a|) from which the engine counts as running
+	Policies       map[string]MotionPolicy `json:"policies"`         // By state; states not listed allow everything
+}
+
+// MotionPolicy says what samples may do in a motion state. Critical
+// statuses (crashes, medical emergencies) are always raised.
+type MotionPolicy struct {
+	SuppressCategories  []string `json:"suppress_categories"`  // Incidents of these categories aren't raised
+	Streaks             bool     `json:"streaks"`              // Safe samples accrue streaks
+	PeriodicAttestation bool     `json:"periodic_attestation"` // Safe samples can trigger the periodic safe attestation
+}
+
+// allowAll is the policy where none is configured: the behaviour without
+// motion states.
+var allowAll = MotionPolicy{Streaks: true, PeriodicAttestation: true}
+
+func (c MotionConfig) validate() error {
+	if c.ParkAfterSec <= 0 || c.IdleVibrationG <= 0 {
+		return fmt.Errorf("park_after_sec and idle_vibration_g must be positive")
+	}
+	for state, policy := range c.Policies {
+		if !motionStates[state] {
+			return fmt.Errorf("policies: unknown motion state %q", state)
+		}
+		for _, category := range policy.SuppressCategories {
+			if !statusCategories[category] {
+				return fmt.Errorf("policies[%q]: unknown category %q", state, category)
+			}
+		}
+	}
+	return nil
+}
+
+// Policy returns the policy for a motion state (nil config: allow everything).
+func (c *MotionConfig) Policy(state string) MotionPolicy {
+	if c == nil {
+		return allowAll
+	}
+	if policy, ok := c.Policies[state]; ok {
+		return policy
+	}
+	return allowAll
+}
+
+// Raises reports whether a sample with this rule may raise an incident.
+func (p MotionPolicy) Raises(rule StatusRule) bool {
+	if rule.Safe || rule.IsCritical() {
+		return true
+	}
+	for _, category := range p.SuppressCategories {
+		if category == rule.Category {
+			return false
+		}
+	}
+	return true
+}
+
+// MotionService derives whether a vehicle is moving, idling or parked from
+// GPS speed and IMU vibration. It errs towards moving: a stopped vehicle
+// needs a real fix or a still IMU to be told apart.
+type MotionService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewMotionService creates a new MotionService instance.
+func NewMotionService(redisClient *redis.Client, ctx context.Context) *MotionService {
+	return &MotionService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Classify returns the vehicle's motion state at the sample. vibration is
+// imuVibration of the sample's IMU data, negative without any. SpeedKmh must
+// already be derived.
+func (m *MotionService) Classify(data Telemetry, vibration float64, cfg *MotionConfig) string {
+	if cfg == nil {
+		return MotionUnknown
+	}
+	hasFix := data.Lat != 0 || data.Long != 0
+	hasIMU := vibration >= 0
+	if !hasFix && !hasIMU {
+		return MotionUnknown
+	}
+
+	key := fmt.Sprintf("motion:%s", data.VehicleID)
+	stored, err := m.redisClient.HGetAll(m.ctx, key).Result()
+	if err != nil {
+		log.Printf("Error getting motion state: %v", err)
+		return MotionUnknown
+	}
+	lastTs, _ := strconv.ParseInt(stored["ts"], 10, 64)
+	if data.Timestamp < lastTs {
+		return stored["state"] // Backlogged: no speed was derived for it
+	}
+
+	// Only a fix that has changed at some point is a real one.
+	fix, fixVaried := stored["fix"], stored["fix_varied"] == "1"
+	if hasFix {
+		fix = strconv.FormatFloat(data.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(data.Long, 'f', -1, 64)
+		fixVaried = fixVaried || (stored["fix"] != "" && fix != stored["fix"])
+		if !fixVaried {
+			hasFix = false
+			m.redisClient.HSet(m.ctx, key, "fix", fix)
+		}
+	}
+	if !hasFix && !hasIMU {
+		return MotionUnknown
+	}
+	stillSince, _ := strconv.ParseInt(stored["still_since"], 10, 64)
+
+	engineOn := hasIMU && vibration >= cfg.IdleVibrationG
+	var state string
+	switch {
+	case hasFix && data.SpeedKmh >= TRIP_MOVING_KMH, !hasFix && engineOn:
+		// Without a fix, a running engine may as well be driving.
+		state, stillSince = MotionMoving, 0
+	default:
+		if stillSince == 0 {
+			stillSince = data.Timestamp
+		}
+		state = MotionIdling
+		if !engineOn && data.Timestamp-stillSince >= cfg.ParkAfterSec {
+			state = MotionParked
+		}
+	}
+
+	if state != stored["state"] {
+		log.Printf("🅿️ %s is now %s", data.VehicleID, state)
+	}
+	err = m.redisClient.HSet(m.ctx, key, "state", state, "ts", data.Timestamp, "still_since", stillSince, "fix", fix, "fix_varied", fixVaried).Err()
+	if err != nil {
+		log.Printf("Failed to save motion state: %v", err)
+	}
+	return state
+}
+
+// imuVibration is the standard deviation of the acceleration magnitude over
+// the readings: road and engine vibration, not sustained manoeuvres. -1
+// without enough readings.
+func imuVibration(readings []IMUSample) float64 {
+	if len(readings) < 2 {
+		return -1
+	}
+	var sum, sumSq float64
+	for _, r := range readings {
+		a := math.Sqrt(r.Ax*r.Ax + r.Ay*r.Ay + r.Az*r.Az)
+		sum += a
+		sumSq += a * a
+	}
+	n := float64(len(readings))
+	mean := sum / n
+	return math.Sqrt(math.Max(0, sumSq/n-mean*mean))
+}
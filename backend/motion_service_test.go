@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestMotionServiceClassify(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "motion:test-motion")
+	motion := NewMotionService(rdb, ctx)
+
+	cfg := &MotionConfig{ParkAfterSec: 120, IdleVibrationG: 0.02}
+	sample := func(ts int64, speed float64) Telemetry {
+		// A real fix wanders a little even when standing still.
+		return Telemetry{VehicleID: "test-motion", Timestamp: ts, Status: "safe", Lat: 28.7 + float64(ts%7)*1e-6, Long: 77.1, SpeedKmh: speed}
+	}
+	still := []IMUSample{{Az: 1}, {Az: 1.001}, {Az: 0.999}}
+	running := []IMUSample{{Az: 1}, {Az: 1.05}, {Az: 0.95}, {Az: 1.04}}
+
+	assert.Equal(t, MotionUnknown, motion.Classify(sample(1000, 50), -1, nil))
+	assert.Equal(t, MotionUnknown, motion.Classify(sample(999, 0), -1, cfg), "one fix could be a placeholder")
+	assert.Equal(t, MotionMoving, motion.Classify(sample(1000, 50), -1, cfg))
+	assert.Equal(t, MotionIdling, motion.Classify(sample(1010, 0), -1, cfg))
+	assert.Equal(t, MotionIdling, motion.Classify(sample(1200, 0), imuVibration(running), cfg), "engine running")
+	assert.Equal(t, MotionParked, motion.Classify(sample(1200, 0), imuVibration(still), cfg))
+	assert.Equal(t, MotionParked, motion.Classify(sample(1100, 40), -1, cfg), "backlogged sample keeps the state")
+
+	// Without a fix, a running engine can't be told from driving.
+	noFix := Telemetry{VehicleID: "test-motion", Timestamp: 1300, Status: "safe"}
+	assert.Equal(t, MotionMoving, motion.Classify(noFix, imuVibration(running), cfg))
+	assert.Equal(t, MotionUnknown, motion.Classify(noFix, -1, cfg))
+}
+
+// The CV agent sends a fixed placeholder position and no IMU data: that
+// says nothing about motion, so its drowsiness alerts must still be raised.
+func TestMotionCVAgent(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-motion-cv")
+	rdb.Set(ctx, "last_periodic_attestation_timestamp:test-motion-cv", time.Now().Unix(), 0) // No attestation without a chain
+	ingest := NewIngestService(rdb, nil, nil, testStatusRules(t), ctx)
+
+	cv := func(ts int64, status string, confidence float64) Telemetry {
+		// cv/main.py, twice a second
+		return Telemetry{VehicleID: "test-motion-cv", Timestamp: ts, Status: status, Lat: 28.7041, Long: 77.1025, Confidence: confidence}
+	}
+	start := time.Now().Unix() - 300
+	for ts := start; ts < start+250; ts++ {
+		_, err := ingest.IngestBatch(TelemetryBatch{VehicleID: "test-motion-cv", Samples: []Telemetry{cv(ts, "safe", 0.99), cv(ts, "safe", 0.99)}})
+		assert.NoError(t, err)
+	}
+	state, _ := rdb.HGet(ctx, "motion:test-motion-cv", "state").Result()
+	assert.NotEqual(t, MotionParked, state, "a placeholder fix is not standing still")
+
+	for ts := start + 250; ts < start+256; ts++ {
+		_, err := ingest.IngestBatch(TelemetryBatch{VehicleID: "test-motion-cv", Samples: []Telemetry{cv(ts, "drowsy", 0.95), cv(ts, "drowsy", 0.95)}})
+		assert.NoError(t, err)
+	}
+	open, _ := rdb.HGetAll(ctx, "incidents_open:test-motion-cv").Result()
+	assert.Contains(t, open, "drowsy")
+}
+
+func TestMotionPolicy(t *testing.T) {
+	rules := defaultRules(t)
+	drowsy, _ := rules.Lookup("drowsy")
+	safe, _ := rules.Lookup("safe")
+	crash, _ := rules.Lookup(StatusCrash)
+
+	parked := rules.Motion.Policy(MotionParked)
+	assert.False(t, parked.Raises(drowsy))
+	assert.True(t, parked.Raises(safe))
+	assert.True(t, parked.Raises(crash), "critical statuses are always raised")
+	assert.False(t, parked.Streaks)
+	assert.True(t, rules.Motion.Policy(MotionMoving).Raises(drowsy))
+	assert.True(t, rules.Motion.Policy(MotionUnknown).Streaks)
+
+	var none *MotionConfig
+	assert.Equal(t, allowAll, none.Policy(MotionParked))
+}
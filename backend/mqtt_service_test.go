@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// orderedClient behaves like paho with ordered delivery: no PUBACK gets
+// through while a message handler is running.
+type orderedClient struct {
+	mqtt.Client
+	handlerDone chan struct{}
+	published   chan string
+}
+
+func (c *orderedClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.published <- topic
+	return ackToken{c.handlerDone}
+}
+
+type ackToken struct{ acked chan struct{} }
+
+func (t ackToken) Wait() bool { <-t.acked; return true }
+func (t ackToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.acked:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+func (t ackToken) Done() <-chan struct{} { return t.acked }
+func (t ackToken) Error() error          { return nil }
+
+func newTestMQTTService() (*MQTTService, *orderedClient) {
+	client := &orderedClient{handlerDone: make(chan struct{}), published: make(chan string, 10)}
+	mqtts := &MQTTService{client: client, downlinks: make(chan outboundDownlink, DOWNLINK_QUEUE_SIZE), ctx: context.Background()}
+	go mqtts.publishDownlinks()
+	return mqtts, client
+}
+
+// inHandler runs fn the way onMessageReceived would and fails if it blocks.
+func inHandler(t *testing.T, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocked inside the message handler")
+	}
+}
+
+func TestEmergencyDownlinkFromHandler(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "emergency_active:test-downlink", "emergencies:test-downlink")
+	mqtts, client := newTestMQTTService()
+	emergencies := NewEmergencyService(rdb, ctx)
+	emergencies.downlink = mqtts.PublishDownlink
+
+	inHandler(t, func() {
+		assert.NotNil(t, emergencies.Start(Telemetry{VehicleID: "test-downlink", Status: StatusCrash, Timestamp: 1000}, "inc_1"))
+	})
+	close(client.handlerDone)
+	select {
+	case topic := <-client.published:
+		assert.Equal(t, "vehicles/test-downlink/downlink", topic)
+	case <-time.After(2 * time.Second):
+		t.Fatal("downlink never published")
+	}
+	rdb.ZRem(ctx, pendingEmergenciesKey, rdb.Get(ctx, "emergency_active:test-downlink").Val())
+}
+
+func TestBreakReminderFromHandler(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "driving:test-downlink-break", "driving_daily:test-downlink-break")
+	mqtts, client := newTestMQTTService()
+	drivingTime := NewDrivingTimeService(rdb, ctx)
+	drivingTime.downlink = mqtts.PublishDownlink
+
+	cfg := &DrivingTimeConfig{MaxContinuousMin: 10, BreakMin: 5, DailyMaxMin: 600, WeeklyMaxMin: 1000, ReminderMin: 2}
+	inHandler(t, func() {
+		for ts := int64(1704088800); ts <= 1704088800+540; ts += 60 {
+			drivingTime.Update(Telemetry{VehicleID: "test-downlink-break", Timestamp: ts, Lat: 28.7, Long: 77.1, SpeedKmh: 60}, cfg)
+		}
+	})
+	close(client.handlerDone)
+	select {
+	case topic := <-client.published:
+		assert.Equal(t, "vehicles/test-downlink-break/downlink", topic)
+	case <-time.After(2 * time.Second):
+		t.Fatal("break reminder never published")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// Ledger entry types.
+const (
+	LedgerEarn    = "earn"
+	LedgerRedeem  = "redeem"
+	LedgerPenalty = "penalty"
+	LedgerAdjust  = "adjust" // Support correction, either sign
+	LedgerExpire  = "expire"
+)
+
+var ledgerTypes = map[string]bool{LedgerEarn: true, LedgerRedeem: true, LedgerPenalty: true, LedgerAdjust: true, LedgerExpire: true}
+
+var (
+	errInsufficientPoints  = errors.New("insufficient balance")
+	errIdempotencyConflict = errors.New("idempotency key already used for a different redemption")
+	errNoRedemption        = errors.New("redemption not found")
+)
+
+// ledgerOpeningLua books a balance from before the ledger existed as an
+// opening entry. Expects KEYS[1] balance and KEYS[2] ledger, and leaves the
+// balance in the local "balance"; ARGV[6] is the timestamp.
+const ledgerOpeningLua = `
+local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+if balance ~= 0 and redis.call('XLEN', KEYS[2]) == 0 then
+	redis.call('XADD', KEYS[2], '*', 'type', 'adjust', 'amount', balance, 'balance', balance,
+		'reason', 'opening balance', 'ref', '', 'actor', 'system', 'timestamp', ARGV[6])
+end
+`
+
+// appendLedgerScript appends an entry to the ledger (KEYS[2]) and updates the
+// cached balance (KEYS[1]) together. ARGV: type, amount, reason, ref, actor,
+// timestamp, rule ID. Redemptions can't overdraw; other debits take at most what is
+// there. Returns {entry ID, amount booked, balance}, with an empty ID if a
+// redemption exceeds the balance.
+var appendLedgerScript = redis.NewScript(ledgerOpeningLua + `
+local amount = tonumber(ARGV[2])
+if balance + amount < 0 then
+	if ARGV[1] == 'redeem' then
+		return {'', 0, balance}
+	end
+	amount = -balance
+end
+balance = balance + amount
+redis.call('SET', KEYS[1], balance)
+local id = redis.call('XADD', KEYS[2], '*', 'type', ARGV[1], 'amount', amount, 'balance', balance,
+	'reason', ARGV[3], 'ref', ARGV[4], 'actor', ARGV[5], 'timestamp', ARGV[6], 'rule', ARGV[7])
+return {id, amount, balance}
+`)
+
+// redeemScript redeems points in one step: idempotency check, balance check,
+// ledger entry, redemption record (KEYS[4]) and idempotency key (KEYS[3]).
+// ARGV: points, redemption ID, reward, actor, idempotency key ("" for none),
+// timestamp, idempotency TTL, vehicle ID. Returns {redemption ID, 1 if it
+// is an earlier redemption with the same key}, with an empty ID if the
+// balance is insufficient.
+var redeemScript = redis.NewScript(`
+if ARGV[5] ~= '' then
+	local existing = redis.call('GET', KEYS[3])
+	if existing then
+		return {existing, 1}
+	end
+end
+` + ledgerOpeningLua + `
+local amount = tonumber(ARGV[1])
+if balance < amount then
+	return {'', 0}
+end
+balance = balance - amount
+redis.call('SET', KEYS[1], balance)
+local entry = redis.call('XADD', KEYS[2], '*', 'type', 'redeem', 'amount', -amount, 'balance', balance,
+	'reason', 'redemption: ' .. ARGV[3], 'ref', ARGV[2], 'actor', ARGV[4], 'timestamp', ARGV[6])
+redis.call('HSET', KEYS[4], 'id', ARGV[2], 'vehicle_id', ARGV[8], 'points', amount, 'reward', ARGV[3],
+	'ledger_entry', entry, 'balance', balance, 'idempotency_key', ARGV[5], 'created_at', ARGV[6])
+if ARGV[5] ~= '' then
+	redis.call('SET', KEYS[3], ARGV[2], 'EX', ARGV[7])
+end
+return {ARGV[2], 0}
+`)
+
+// Redemption is a completed redemption of points.
+type Redemption struct {
+	ID             string `json:"id"`
+	VehicleID      string `json:"vehicle_id"`
+	Points         int64  `json:"points"`
+	Reward         string `json:"reward"`
+	LedgerEntry    string `json:"ledger_entry"`
+	Balance        int64  `json:"balance"` // After the redemption
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	CreatedAt      int64  `json:"created_at"`
+}
+
+// LedgerEntry is one change to a vehicle's points.
+type LedgerEntry struct {
+	ID        string `json:"id"`
+	VehicleID string `json:"vehicle_id"`
+	Type      string `json:"type"`
+	Amount    int64  `json:"amount"`  // Credits positive, debits negative
+	Balance   int64  `json:"balance"` // After this entry
+	Reason    string `json:"reason"`
+	Ref       string `json:"ref,omitempty"`  // Related incident, attestation or redemption
+	RuleID    string `json:"rule,omitempty"` // Reward rule that produced the change (see reward_service.go)
+	Actor     string `json:"actor"`          // "system", "driver" or "admin"
+	Timestamp int64  `json:"timestamp"`      // Server time
+}
+
+// PointsService keeps each vehicle's points as an append-only ledger
+// (points_ledger:{vehicle} stream, never trimmed). points:{vehicle} is a
+// cache of the balance it adds up to.
+type PointsService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewPointsService creates a new PointsService instance.
+func NewPointsService(redisClient *redis.Client, ctx context.Context) *PointsService {
+	return &PointsService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Record books an entry (VehicleID, Type, Amount, Reason, Ref, RuleID,
+// Actor) and returns it as booked. The sign of Amount follows the type:
+// earnings are credits; redemptions, penalties and expiries debits;
+// adjustments either.
+func (p *PointsService) Record(entry LedgerEntry) (LedgerEntry, error) {
+	if !ledgerTypes[entry.Type] {
+		return LedgerEntry{}, fmt.Errorf("unknown ledger entry type %q", entry.Type)
+	}
+	switch entry.Type {
+	case LedgerEarn:
+		entry.Amount = max(entry.Amount, -entry.Amount)
+	case LedgerRedeem, LedgerPenalty, LedgerExpire:
+		entry.Amount = min(entry.Amount, -entry.Amount)
+	}
+
+	entry.Timestamp = time.Now().Unix()
+	keys := []string{fmt.Sprintf("points:%s", entry.VehicleID), fmt.Sprintf("points_ledger:%s", entry.VehicleID)}
+	res, err := appendLedgerScript.Run(p.ctx, p.redisClient, keys,
+		entry.Type, entry.Amount, entry.Reason, entry.Ref, entry.Actor, entry.Timestamp, entry.RuleID).Slice()
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	entry.ID, _ = res[0].(string)
+	entry.Amount, _ = res[1].(int64)
+	entry.Balance, _ = res[2].(int64)
+	if entry.ID == "" {
+		return LedgerEntry{VehicleID: entry.VehicleID, Balance: entry.Balance}, errInsufficientPoints
+	}
+	log.Printf("💰 %s %s %+d points (%s), balance %d", entry.VehicleID, entry.Type, entry.Amount, entry.Reason, entry.Balance)
+	return entry, nil
+}
+
+// Redeem spends points atomically. A retry with the same idempotencyKey
+// returns the original redemption (replayed true) instead of spending again.
+func (p *PointsService) Redeem(vehicleID string, points int64, reward, idempotencyKey string) (Redemption, bool, error) {
+	if points <= 0 {
+		return Redemption{}, false, fmt.Errorf("points must be positive")
+	}
+	if reward == "" {
+		reward = "unspecified"
+	}
+	id, err := newRedemptionID()
+	if err != nil {
+		return Redemption{}, false, err
+	}
+	keys := []string{
+		fmt.Sprintf("points:%s", vehicleID),
+		fmt.Sprintf("points_ledger:%s", vehicleID),
+		fmt.Sprintf("redemption_key:%s:%s", vehicleID, idempotencyKey),
+		fmt.Sprintf("redemption:%s", id),
+	}
+	res, err := redeemScript.Run(p.ctx, p.redisClient, keys,
+		points, id, reward, "driver", idempotencyKey, time.Now().Unix(), REDEMPTION_IDEMPOTENCY_TTL, vehicleID).Slice()
+	if err != nil {
+		return Redemption{}, false, err
+	}
+	id, _ = res[0].(string)
+	replayed := res[1] == int64(1)
+	if id == "" {
+		return Redemption{}, false, errInsufficientPoints
+	}
+
+	redemption, err := p.Redemption(id)
+	if err != nil {
+		return redemption, replayed, err
+	}
+	if replayed && (redemption.Points != points || redemption.Reward != reward) {
+		return redemption, true, errIdempotencyConflict
+	}
+	if !replayed {
+		log.Printf("🎁 %s redeemed %d points for %s (%s), balance %d", vehicleID, points, reward, id, redemption.Balance)
+	}
+	return redemption, replayed, nil
+}
+
+// Redemption returns a redemption record.
+func (p *PointsService) Redemption(id string) (Redemption, error) {
+	stored, err := p.redisClient.HGetAll(p.ctx, fmt.Sprintf("redemption:%s", id)).Result()
+	if err != nil {
+		return Redemption{}, err
+	}
+	if len(stored) == 0 {
+		return Redemption{}, errNoRedemption
+	}
+	num := func(field string) int64 {
+		v, _ := strconv.ParseInt(stored[field], 10, 64)
+		return v
+	}
+	return Redemption{
+		ID:             stored["id"],
+		VehicleID:      stored["vehicle_id"],
+		Points:         num("points"),
+		Reward:         stored["reward"],
+		LedgerEntry:    stored["ledger_entry"],
+		Balance:        num("balance"),
+		IdempotencyKey: stored["idempotency_key"],
+		CreatedAt:      num("created_at"),
+	}, nil
+}
+
+// Balance returns the vehicle's points, rebuilding the cache from the
+// ledger if it is missing.
+func (p *PointsService) Balance(vehicleID string) (int64, error) {
+	balance, err := p.redisClient.Get(p.ctx, fmt.Sprintf("points:%s", vehicleID)).Int64()
+	if err != redis.Nil {
+		return balance, err
+	}
+	return p.Rebuild(vehicleID)
+}
+
+// Rebuild recomputes the cached balance from the ledger.
+func (p *PointsService) Rebuild(vehicleID string) (int64, error) {
+	msgs, err := p.redisClient.XRange(p.ctx, fmt.Sprintf("points_ledger:%s", vehicleID), "-", "+").Result()
+	if err != nil {
+		return 0, err
+	}
+	var balance int64
+	for _, m := range msgs {
+		balance += ledgerEntryFromStream(vehicleID, m).Amount
+	}
+	if len(msgs) > 0 {
+		err = p.redisClient.Set(p.ctx, fmt.Sprintf("points:%s", vehicleID), balance, 0).Err()
+	}
+	return balance, err
+}
+
+// Ledger returns up to limit entries, newest first, starting below the before
+// ID (for pagination).
+func (p *PointsService) Ledger(vehicleID, before string, limit int) ([]LedgerEntry, error) {
+	end := "+"
+	if before != "" {
+		end = "(" + before
+	}
+	msgs, err := p.redisClient.XRevRangeN(p.ctx, fmt.Sprintf("points_ledger:%s", vehicleID), end, "-", int64(limit)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LedgerEntry, 0, len(msgs))
+	for _, m := range msgs {
+		entries = append(entries, ledgerEntryFromStream(vehicleID, m))
+	}
+	return entries, nil
+}
+
+func ledgerEntryFromStream(vehicleID string, m redis.XMessage) LedgerEntry {
+	str := func(key string) string {
+		v, _ := m.Values[key].(string)
+		return v
+	}
+	num := func(key string) int64 {
+		v, _ := strconv.ParseInt(str(key), 10, 64)
+		return v
+	}
+	return LedgerEntry{
+		ID:        m.ID,
+		VehicleID: vehicleID,
+		Type:      str("type"),
+		Amount:    num("amount"),
+		Balance:   num("balance"),
+		Reason:    str("reason"),
+		Ref:       str("ref"),
+		RuleID:    str("rule"),
+		Actor:     str("actor"),
+		Timestamp: num("timestamp"),
+	}
+}
+
+func newRedemptionID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("could not generate redemption id: %v", err)
+	}
+	return "rdm_" + hex.EncodeToString(buf), nil
+}
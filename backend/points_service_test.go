@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestPointsServiceLedger(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "points_ledger:test-points")
+	rdb.Set(ctx, "points:test-points", 25, 0) // From before the ledger
+	points := NewPointsService(rdb, ctx)
+
+	earned, err := points.Record(LedgerEntry{VehicleID: "test-points", Type: LedgerEarn, Amount: 10, Reason: "15 min safe streak", Actor: "system"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(35), earned.Balance)
+
+	_, err = points.Record(LedgerEntry{VehicleID: "test-points", Type: LedgerRedeem, Amount: 50, Reason: "redemption", Actor: "driver"})
+	assert.Equal(t, errInsufficientPoints, err)
+	redeemed, err := points.Record(LedgerEntry{VehicleID: "test-points", Type: LedgerRedeem, Amount: 30, Reason: "redemption", Actor: "driver"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-30), redeemed.Amount)
+	penalty, err := points.Record(LedgerEntry{VehicleID: "test-points", Type: LedgerPenalty, Amount: 20, Reason: "fraud confirmed", Actor: "admin"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-5), penalty.Amount, "penalties take at most the balance")
+	_, err = points.Record(LedgerEntry{VehicleID: "test-points", Type: "gift", Amount: 5, Actor: "admin"})
+	assert.Error(t, err)
+
+	entries, err := points.Ledger("test-points", "", 2)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, penalty.ID, entries[0].ID)
+		assert.Equal(t, LedgerRedeem, entries[1].Type)
+		assert.Equal(t, "driver", entries[1].Actor)
+	}
+	older, err := points.Ledger("test-points", entries[1].ID, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, older, 2) {
+		assert.Equal(t, LedgerEarn, older[0].Type)
+		assert.Equal(t, "opening balance", older[1].Reason)
+		assert.Equal(t, int64(25), older[1].Amount)
+	}
+
+	// The balance is derived from the ledger.
+	rdb.Del(ctx, "points:test-points")
+	balance, err := points.Balance("test-points")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), balance)
+	rdb.Set(ctx, "points:test-points", 999, 0)
+	balance, err = points.Rebuild("test-points")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), balance)
+}
+
+func TestPointsServiceRedeem(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "points_ledger:test-redeem", "points:test-redeem", "redemption_key:test-redeem:retry-1")
+	points := NewPointsService(rdb, ctx)
+	_, err := points.Record(LedgerEntry{VehicleID: "test-redeem", Type: LedgerEarn, Amount: 100, Reason: "test", Actor: "system"})
+	assert.NoError(t, err)
+
+	first, replayed, err := points.Redeem("test-redeem", 40, "Coffee", "retry-1")
+	assert.NoError(t, err)
+	assert.False(t, replayed)
+	assert.Equal(t, int64(60), first.Balance)
+
+	// A retry gets the same redemption and spends nothing.
+	again, replayed, err := points.Redeem("test-redeem", 40, "Coffee", "retry-1")
+	assert.NoError(t, err)
+	assert.True(t, replayed)
+	assert.Equal(t, first, again)
+	_, _, err = points.Redeem("test-redeem", 50, "Fuel", "retry-1")
+	assert.Equal(t, errIdempotencyConflict, err)
+
+	_, _, err = points.Redeem("test-redeem", 0, "Coffee", "")
+	assert.Error(t, err)
+
+	// Concurrent redemptions can't overdraw.
+	results := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, _, err := points.Redeem("test-redeem", 20, "Coffee", "")
+			results <- err
+		}()
+	}
+	failed := 0
+	for i := 0; i < 5; i++ {
+		if err := <-results; err == errInsufficientPoints {
+			failed++
+		}
+	}
+	assert.Equal(t, 2, failed)
+	balance, _ := points.Balance("test-redeem")
+	assert.Equal(t, int64(0), balance)
+
+	entries, _ := points.Ledger("test-redeem", "", 500)
+	assert.Len(t, entries, 5, "earn, then four redemptions")
+	stored, err := points.Redemption(first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, first.LedgerEntry, entries[len(entries)-2].ID)
+	assert.Equal(t, first.ID, entries[len(entries)-2].Ref)
+	assert.Equal(t, "Coffee", stored.Reward)
+}
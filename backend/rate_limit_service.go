@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// Reasons an event was not attested.
+const (
+	SuppressedStatusLimit   = "status_limit"
+	SuppressedCategoryLimit = "category_limit"
+	SuppressedDailyCap      = "daily_cap"
+	SuppressedMotion        = "motion" // Not raised at all in the vehicle's motion state
+)
+
+// takeTokensScript takes one token from every bucket in KEYS, or from none
+// of them. ARGV is burst and refill seconds per bucket, then the event time.
+// Buckets refill only when time moves forward, so replayed backlogs drain
+// them instead of refilling. Returns 0 if allowed, otherwise the 1-based
+// index of the first empty bucket.
+var takeTokensScript = redis.NewScript(`
+local now = tonumber(ARGV[#ARGV])
+local tokens, stamps = {}, {}
+for i, key in ipairs(KEYS) do
+	local burst = tonumber(ARGV[2*i-1])
+	local refill = tonumber(ARGV[2*i])
+	local t = tonumber(redis.call('HGET', key, 'tokens'))
+	local ts = tonumber(redis.call('HGET', key, 'ts'))
+	if t == nil then
+		t, ts = burst, now
+	end
+	if now > ts then
+		t = math.min(burst, t + (now - ts) / refill)
+		ts = now
+	end
+	if t < 1 then
+		return i
+	end
+	tokens[i], stamps[i] = t, ts
+end
+for i, key in ipairs(KEYS) do
+	redis.call('HSET', key, 'tokens', tostring(tokens[i] - 1), 'ts', tostring(stamps[i]))
+	redis.call('EXPIRE', key, 86400)
+end
+return 0
+`)
+
+// SuppressedCounts is what the dashboard shows next to an alert ("12 similar
+// events suppressed").
+type SuppressedCounts struct {
+	VehicleID      string           `json:"vehicle_id"`
+	Total          int64            `json:"total"`
+	ByStatus       map[string]int64 `json:"by_status"`
+	ByReason       map[string]int64 `json:"by_reason"`
+	SinceLastAlert map[string]int64 `json:"since_last_alert"` // Per status, reset whenever one is attested
+	AttestedToday  int64            `json:"attested_today"`
+	DailyAttestCap int              `json:"daily_attestation_cap"` // 0: no cap
+}
+
+// RateLimitService decides which events are written on-chain. Statuses and
+// categories each get a token bucket from the status rules, and every
+// vehicle has the rules' daily attestation cap. Critical events bypass all
+// of it.
+type RateLimitService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewRateLimitService creates a new RateLimitService instance.
+func NewRateLimitService(redisClient *redis.Client, ctx context.Context) *RateLimitService {
+	return &RateLimitService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// AllowAlert reports whether an attested status may be sent now, counting it
+// as suppressed if not.
+func (r *RateLimitService) AllowAlert(data Telemetry, rule StatusRule, rules *StatusRuleSet) bool {
+	if rule.IsCritical() {
+		return true
+	}
+
+	var keys []string
+	var args []interface{}
+	var reasons []string
+	if rule.RateLimit != nil {
+		keys = append(keys, fmt.Sprintf("alert_bucket:%s:status:%s", data.VehicleID, data.Status))
+		args = append(args, rule.RateLimit.Burst, rule.RateLimit.RefillSeconds)
+		reasons = append(reasons, SuppressedStatusLimit)
+	}
+	if limit, ok := rules.CategoryLimits[rule.Category]; ok {
+		keys = append(keys, fmt.Sprintf("alert_bucket:%s:category:%s", data.VehicleID, rule.Category))
+		args = append(args, limit.Burst, limit.RefillSeconds)
+		reasons = append(reasons, SuppressedCategoryLimit)
+	}
+
+	if len(keys) > 0 {
+		denied, err := takeTokensScript.Run(r.ctx, r.redisClient, keys, append(args, data.Timestamp)...).Int()
+		if err != nil {
+			log.Printf("Rate limit check failed for %s: %v", data.VehicleID, err)
+			return true // Prefer an extra alert over a lost one
+		}
+		if denied > 0 {
+			r.suppress(data, reasons[denied-1])
+			return false
+		}
+	}
+
+	if !r.AllowAttestation(data, rule, rules) {
+		return false
+	}
+	r.redisClient.HDel(r.ctx, fmt.Sprintf("suppressed_since_alert:%s", data.VehicleID), data.Status)
+	return true
+}
+
+// AllowAttestation counts one on-chain write against the vehicle's daily cap
+// (by event date, UTC) and reports whether it fits.
+func (r *RateLimitService) AllowAttestation(data Telemetry, rule StatusRule, rules *StatusRuleSet) bool {
+	if rule.IsCritical() || rules.DailyAttestationCap == 0 {
+		return true
+	}
+	key := dailyAttestationKey(data.VehicleID, data.Timestamp)
+	pipe := r.redisClient.TxPipeline()
+	count := pipe.Incr(r.ctx, key)
+	pipe.Expire(r.ctx, key, 48*time.Hour)
+	if _, err := pipe.Exec(r.ctx); err != nil {
+		log.Printf("Daily attestation cap check failed for %s: %v", data.VehicleID, err)
+		return true
+	}
+	if count.Val() > int64(rules.DailyAttestationCap) {
+		r.suppress(data, SuppressedDailyCap)
+		return false
+	}
+	return true
+}
+
+func (r *RateLimitService) suppress(data Telemetry, reason string) {
+	log.Printf("⚠️ Rate Limit: Suppressed %s for %s (%s)", data.Status, data.VehicleID, reason)
+	pipe := r.redisClient.TxPipeline()
+	pipe.HIncrBy(r.ctx, fmt.Sprintf("suppressed:%s", data.VehicleID), data.Status, 1)
+	pipe.HIncrBy(r.ctx, fmt.Sprintf("suppressed_reasons:%s", data.VehicleID), reason, 1)
+	pipe.HIncrBy(r.ctx, fmt.Sprintf("suppressed_since_alert:%s", data.VehicleID), data.Status, 1)
+	if _, err := pipe.Exec(r.ctx); err != nil {
+		log.Printf("Failed to count suppressed event: %v", err)
+	}
+}
+
+// Suppressed returns the suppression counters for a vehicle.
+func (r *RateLimitService) Suppressed(vehicleID string, rules *StatusRuleSet) (SuppressedCounts, error) {
+	counts := SuppressedCounts{VehicleID: vehicleID, DailyAttestCap: rules.DailyAttestationCap}
+
+	pipe := r.redisClient.Pipeline()
+	byStatus := pipe.HGetAll(r.ctx, fmt.Sprintf("suppressed:%s", vehicleID))
+	byReason := pipe.HGetAll(r.ctx, fmt.Sprintf("suppressed_reasons:%s", vehicleID))
+	sinceAlert := pipe.HGetAll(r.ctx, fmt.Sprintf("suppressed_since_alert:%s", vehicleID))
+	today := pipe.Get(r.ctx, dailyAttestationKey(vehicleID, time.Now().Unix()))
+	if _, err := pipe.Exec(r.ctx); err != nil && err != redis.Nil {
+		return counts, err
+	}
+
+	counts.ByStatus = parseCounts(byStatus.Val())
+	counts.ByReason = parseCounts(byReason.Val())
+	counts.SinceLastAlert = parseCounts(sinceAlert.Val())
+	for _, n := range counts.ByStatus {
+		counts.Total += n
+	}
+	counts.AttestedToday, _ = today.Int64()
+	if cap := int64(rules.DailyAttestationCap); cap > 0 && counts.AttestedToday > cap {
+		counts.AttestedToday = cap // The counter also counts denied attempts
+	}
+	return counts, nil
+}
+
+func dailyAttestationKey(vehicleID string, ts int64) string {
+	return fmt.Sprintf("attestations:%s:%s", vehicleID, time.Unix(ts, 0).UTC().Format("2006-01-02"))
+}
+
+func parseCounts(vals map[string]string) map[string]int64 {
+	counts := make(map[string]int64, len(vals))
+	for k, v := range vals {
+		counts[k], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return counts
+}
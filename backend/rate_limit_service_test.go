@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestRateLimitServiceBuckets(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-limit")
+	limits := NewRateLimitService(rdb, ctx)
+
+	rules := defaultRules(t)
+	alert := func(status string, ts int64) bool {
+		rule, _ := rules.Lookup(status)
+		return limits.AllowAlert(Telemetry{VehicleID: "test-limit", Status: status, Timestamp: ts}, rule, rules)
+	}
+
+	const t0 = 1700000000
+	assert.True(t, alert("drowsy", t0))
+	assert.False(t, alert("drowsy", t0+5), "drowsy bucket still empty")
+	assert.True(t, alert("distracted", t0+5), "other statuses have their own bucket")
+	assert.True(t, alert("drowsy", t0+11), "refilled")
+	assert.False(t, alert("fatigue", t0+12), "driver category bucket exhausted")
+	assert.True(t, alert(StatusHealthCritical, t0+12), "critical is never limited")
+
+	counts, err := limits.Suppressed("test-limit", rules)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), counts.Total)
+	assert.Equal(t, int64(1), counts.ByReason[SuppressedStatusLimit])
+	assert.Equal(t, int64(1), counts.ByReason[SuppressedCategoryLimit])
+	assert.Equal(t, int64(0), counts.SinceLastAlert["drowsy"], "reset by the next attested drowsy alert")
+	assert.Equal(t, int64(1), counts.SinceLastAlert["fatigue"])
+}
+
+func TestRateLimitServiceDailyCap(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-daily-cap")
+	limits := NewRateLimitService(rdb, ctx)
+
+	// The cap comes from the rules, so a reload changes it.
+	rules := defaultRules(t)
+	rules.DailyAttestationCap = 2
+	rule, _ := rules.Lookup("safe")
+	data := Telemetry{VehicleID: "test-daily-cap", Status: "safe", Timestamp: time.Now().Unix()}
+	assert.True(t, limits.AllowAttestation(data, rule, rules))
+	assert.True(t, limits.AllowAttestation(data, rule, rules))
+	assert.False(t, limits.AllowAttestation(data, rule, rules), "over the cap")
+	critical, _ := rules.Lookup(StatusHealthCritical)
+	assert.True(t, limits.AllowAttestation(data, critical, rules), "critical events are exempt")
+
+	counts, err := limits.Suppressed("test-daily-cap", rules)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counts.DailyAttestCap)
+	assert.Equal(t, int64(2), counts.AttestedToday)
+	assert.Equal(t, int64(1), counts.ByReason[SuppressedDailyCap])
+
+	rules.DailyAttestationCap = 0
+	assert.True(t, limits.AllowAttestation(data, rule, rules), "0: no cap")
+}
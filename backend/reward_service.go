@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// Conditions a reward multiplier can apply under.
+const (
+	RewardWhenNight    = "night"     // Event time between midnight and 5:00 (as for risk)
+	RewardWhenLongTrip = "long_trip" // Current trip at least min_trip_min long
+)
+
+// RewardConfig is the reward rules engine's configuration. Streak milestones
+// (streaks section) are the base rewards; multipliers and campaigns add to
+// them, penalties take points for incidents. Every rule has an ID that ends
+// up on the ledger entries it produces.
+type RewardConfig struct {
+	Multipliers     []RewardMultiplier `json:"multipliers"`
+	Penalties       []RewardPenalty    `json:"penalties"`
+	Campaigns       []RewardCampaign   `json:"campaigns"`
+	DailyEarnCap    int64              `json:"daily_earn_cap"`    // Points a vehicle can earn per UTC day; 0: no cap
+	DailyPenaltyCap int64              `json:"daily_penalty_cap"` // Points a vehicle can lose to penalties per UTC day; 0: no cap
+}
+
+// RewardMultiplier raises a milestone reward by Factor while its condition holds.
+type RewardMultiplier struct {
+	ID         string  `json:"id"`
+	When       string  `json:"when"` // "night" or "long_trip"
+	MinTripMin int64   `json:"min_trip_min,omitempty"`
+	Factor     float64 `json:"factor"`
+}
+
+// RewardPenalty takes points when an incident of Status opens.
+type RewardPenalty struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Points int64  `json:"points"`
+}
+
+// RewardCampaign is a promotion: milestone rewards earned between From and To
+// (UTC dates, inclusive) are raised by Factor and/or a flat Bonus.
+type RewardCampaign struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	From   string  `json:"from"` // "2006-01-02"
+	To     string  `json:"to"`
+	Factor float64 `json:"factor,omitempty"`
+	Bonus  int64   `json:"bonus,omitempty"`
+}
+
+func (c RewardConfig) validate(rs *StatusRuleSet) []string {
+	var problems []string
+	ids := map[string]bool{}
+	if rs.Streaks != nil {
+		for _, m := range rs.Streaks.Milestones {
+			ids[m.ID] = true
+		}
+	}
+	id := func(where, ruleID string) {
+		if ruleID == "" {
+			problems = append(problems, fmt.Sprintf("rewards: %s: id is required", where))
+		} else if ids[ruleID] {
+			problems = append(problems, fmt.Sprintf("rewards: %s: id %q is used more than once", where, ruleID))
+		}
+		ids[ruleID] = true
+	}
+
+	for i, m := range c.Multipliers {
+		where := fmt.Sprintf("multipliers[%d]", i)
+		id(where, m.ID)
+		if m.When != RewardWhenNight && m.When != RewardWhenLongTrip {
+			problems = append(problems, fmt.Sprintf("rewards: %s: unknown condition %q", where, m.When))
+		}
+		if m.When == RewardWhenLongTrip && m.MinTripMin <= 0 {
+			problems = append(problems, fmt.Sprintf("rewards: %s: long_trip needs a positive min_trip_min", where))
+		}
+		if m.Factor <= 1 {
+			problems = append(problems, fmt.Sprintf("rewards: %s: factor must be above 1", where))
+		}
+	}
+	for i, p := range c.Penalties {
+		where := fmt.Sprintf("penalties[%d]", i)
+		id(where, p.ID)
+		// Incidents carry the normalized status, so aliases would never match.
+		if rule, ok := rs.byStatus[p.Status]; !ok || rule.Safe || rule.Status != p.Status {
+			problems = append(problems, fmt.Sprintf("rewards: %s: %q must be a defined incident status", where, p.Status))
+		}
+		if p.Points <= 0 {
+			problems = append(problems, fmt.Sprintf("rewards: %s: points must be positive", where))
+		}
+	}
+	for i, camp := range c.Campaigns {
+		where := fmt.Sprintf("campaigns[%d]", i)
+		id(where, camp.ID)
+		from, errFrom := time.Parse("2006-01-02", camp.From)
+		to, errTo := time.Parse("2006-01-02", camp.To)
+		if errFrom != nil || errTo != nil || to.Before(from) {
+			problems = append(problems, fmt.Sprintf("rewards: %s: from and to must be dates (2006-01-02), from first", where))
+		}
+		if camp.Factor < 0 || (camp.Factor > 0 && camp.Factor <= 1) || camp.Bonus < 0 || (camp.Factor == 0 && camp.Bonus == 0) {
+			problems = append(problems, fmt.Sprintf("rewards: %s: needs a factor above 1 or a positive bonus", where))
+		}
+	}
+	if c.DailyEarnCap < 0 || c.DailyPenaltyCap < 0 {
+		problems = append(problems, "rewards: daily caps must not be negative")
+	}
+	return problems
+}
+
+// RewardService evaluates the reward rules for the ingest pipeline and books
+// the outcome on the points ledger, one entry per rule.
+type RewardService struct {
+	redisClient *redis.Client
+	points      *PointsService
+	trips       *TripService
+	ctx         context.Context
+}
+
+// NewRewardService creates a new RewardService instance.
+func NewRewardService(redisClient *redis.Client, points *PointsService, trips *TripService, ctx context.Context) *RewardService {
+	return &RewardService{
+		redisClient: redisClient,
+		points:      points,
+		trips:       trips,
+		ctx:         ctx,
+	}
+}
+
+// Milestone rewards a streak milestone: its base points plus whatever
+// multipliers and campaigns apply, within the daily cap. Returns the entries
+// booked (nil cfg: the base points only).
+func (r *RewardService) Milestone(data Telemetry, milestone StreakMilestone, cfg *RewardConfig) []LedgerEntry {
+	type award struct {
+		ruleID, reason string
+		points         int64
+	}
+	base := int64(milestone.Points)
+	awards := []award{{milestone.ID, fmt.Sprintf("%d min safe streak", milestone.Minutes), base}}
+	if cfg != nil {
+		for _, m := range cfg.Multipliers {
+			if r.applies(data, m) {
+				awards = append(awards, award{m.ID, fmt.Sprintf("%s x%g", m.When, m.Factor), extraPoints(base, m.Factor)})
+			}
+		}
+		date := time.Unix(data.Timestamp, 0).UTC().Format("2006-01-02")
+		for _, camp := range cfg.Campaigns {
+			if date >= camp.From && date <= camp.To {
+				awards = append(awards, award{camp.ID, "campaign: " + camp.Name, extraPoints(base, camp.Factor) + camp.Bonus})
+			}
+		}
+	}
+
+	var entries []LedgerEntry
+	for _, a := range awards {
+		points := a.points
+		if cfg != nil {
+			points = r.withinCap(data, "earned", points, cfg.DailyEarnCap)
+		}
+		if points <= 0 {
+			continue
+		}
+		entry, err := r.points.Record(LedgerEntry{
+			VehicleID: data.VehicleID,
+			Type:      LedgerEarn,
+			Amount:    points,
+			Reason:    a.reason,
+			RuleID:    a.ruleID,
+			Actor:     "system",
+		})
+		if err != nil {
+			log.Printf("Failed to award points (%s): %v", a.ruleID, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Penalize takes the points the rules set for an incident that just opened.
+func (r *RewardService) Penalize(data Telemetry, incident *Incident, cfg *RewardConfig) {
+	if cfg == nil {
+		return
+	}
+	for _, p := range cfg.Penalties {
+		if p.Status != incident.Type {
+			continue
+		}
+		points := r.withinCap(data, "penalized", p.Points, cfg.DailyPenaltyCap)
+		if points <= 0 {
+			continue
+		}
+		_, err := r.points.Record(LedgerEntry{
+			VehicleID: data.VehicleID,
+			Type:      LedgerPenalty,
+			Amount:    points,
+			Reason:    "incident: " + incident.Type,
+			Ref:       incident.ID,
+			RuleID:    p.ID,
+			Actor:     "system",
+		})
+		if err != nil {
+			log.Printf("Failed to apply penalty (%s): %v", p.ID, err)
+		}
+	}
+}
+
+// applies reports whether a multiplier's condition holds at the sample.
+func (r *RewardService) applies(data Telemetry, m RewardMultiplier) bool {
+	switch m.When {
+	case RewardWhenNight:
+		return isNight(data.Timestamp)
+	case RewardWhenLongTrip:
+		trip, ok := r.trips.Active(data.VehicleID)
+		return ok && data.Timestamp-trip.StartTime >= m.MinTripMin*60
+	}
+	return false
+}
+
+// capScript counts points against a daily total, atomically so concurrent
+// samples cannot both pass the cap check. KEYS: daily totals hash. ARGV: kind,
+// points, cap (0: none), TTL seconds. Returns the points that fit.
+var capScript = redis.NewScript(`
+local points = tonumber(ARGV[2])
+local cap = tonumber(ARGV[3])
+if cap > 0 then
+	local counted = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+	points = math.min(points, cap - counted)
+	if points <= 0 then
+		return 0
+	end
+end
+redis.call('HINCRBY', KEYS[1], ARGV[1], points)
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+return points
+`)
+
+// withinCap counts points against the vehicle's daily total of kind ("earned"
+// or "penalized") and returns how many of them fit (all, without a cap).
+func (r *RewardService) withinCap(data Telemetry, kind string, points, cap int64) int64 {
+	key := fmt.Sprintf("rewards_daily:%s:%s", data.VehicleID, time.Unix(data.Timestamp, 0).UTC().Format("2006-01-02"))
+	fit, err := capScript.Run(r.ctx, r.redisClient, []string{key}, kind, points, max(cap, 0), int64((48 * time.Hour).Seconds())).Int64()
+	if err != nil {
+		log.Printf("Failed to count %s points for %s: %v", kind, data.VehicleID, err)
+		return 0
+	}
+	if fit <= 0 {
+		log.Printf("⚠️ Daily %s cap reached for %s", kind, data.VehicleID)
+	}
+	return fit
+}
+
+// extraPoints is what factor adds to base, rounded.
+func extraPoints(base int64, factor float64) int64 {
+	if factor <= 1 {
+		return 0
+	}
+	return int64(math.Round(float64(base) * (factor - 1)))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestRewardServiceMilestone(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	night := time.Date(2026, 3, 10, 2, 0, 0, 0, time.UTC).Unix()
+	day := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC).Unix()
+	rdb.Del(ctx, "points:test-rewards", "points_ledger:test-rewards", "trip_active:test-rewards")
+	for _, ts := range []int64{night, day} {
+		rdb.Del(ctx, "rewards_daily:test-rewards:"+time.Unix(ts, 0).UTC().Format("2006-01-02"))
+	}
+	points := NewPointsService(rdb, ctx)
+	rewards := NewRewardService(rdb, points, NewTripService(rdb, ctx), ctx)
+
+	cfg := &RewardConfig{
+		Multipliers:  []RewardMultiplier{{ID: "night_x1_5", When: RewardWhenNight, Factor: 1.5}},
+		Campaigns:    []RewardCampaign{{ID: "spring", Name: "Spring", From: "2026-03-01", To: "2026-03-31", Bonus: 5}},
+		DailyEarnCap: 40,
+	}
+	milestone := StreakMilestone{ID: "streak_15", Minutes: 15, Points: 10}
+
+	entries := rewards.Milestone(Telemetry{VehicleID: "test-rewards", Timestamp: night}, milestone, cfg)
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, "streak_15", entries[0].RuleID)
+		assert.Equal(t, int64(10), entries[0].Amount)
+		assert.Equal(t, "night_x1_5", entries[1].RuleID)
+		assert.Equal(t, int64(5), entries[1].Amount)
+		assert.Equal(t, "spring", entries[2].RuleID)
+		assert.Equal(t, int64(5), entries[2].Amount)
+	}
+
+	// Outside the campaign and by day, only the base points, up to the cap.
+	cfg.Campaigns[0].To = "2026-03-05"
+	entries = rewards.Milestone(Telemetry{VehicleID: "test-rewards", Timestamp: day}, milestone, cfg)
+	if time.Unix(day, 0).UTC().YearDay() == time.Unix(night, 0).UTC().YearDay() && assert.Len(t, entries, 1) {
+		assert.Equal(t, int64(10), entries[0].Amount)
+		entries = rewards.Milestone(Telemetry{VehicleID: "test-rewards", Timestamp: day}, milestone, cfg)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, int64(10), entries[0].Amount, "capped at 40 a day")
+		}
+		assert.Empty(t, rewards.Milestone(Telemetry{VehicleID: "test-rewards", Timestamp: day}, milestone, cfg))
+	}
+
+	// Without rules, milestones pay their base points.
+	entries = rewards.Milestone(Telemetry{VehicleID: "test-rewards", Timestamp: night}, milestone, nil)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "streak_15", entries[0].RuleID)
+	}
+}
+
+func TestRewardServicePenalize(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	ts := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC).Unix()
+	rdb.Del(ctx, "points_ledger:test-penalty", "rewards_daily:test-penalty:2026-03-10")
+	rdb.Set(ctx, "points:test-penalty", 100, 0)
+	points := NewPointsService(rdb, ctx)
+	rewards := NewRewardService(rdb, points, NewTripService(rdb, ctx), ctx)
+
+	cfg := &RewardConfig{
+		Penalties:       []RewardPenalty{{ID: "penalty_speeding", Status: "speeding", Points: 15}},
+		DailyPenaltyCap: 20,
+	}
+	data := Telemetry{VehicleID: "test-penalty", Timestamp: ts, Status: "speeding"}
+	rewards.Penalize(data, &Incident{ID: "inc-1", Type: "speeding"}, cfg)
+	rewards.Penalize(data, &Incident{ID: "inc-2", Type: "speeding"}, cfg)
+	rewards.Penalize(data, &Incident{ID: "inc-3", Type: "speeding"}, cfg)
+	rewards.Penalize(data, &Incident{ID: "inc-4", Type: "drowsy"}, cfg)
+
+	entries, err := points.Ledger("test-penalty", "", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 3) { // Two penalties and the opening balance
+		assert.Equal(t, "inc-2", entries[0].Ref)
+		assert.Equal(t, int64(-5), entries[0].Amount, "capped at 20 a day")
+		assert.Equal(t, "penalty_speeding", entries[1].RuleID)
+		assert.Equal(t, int64(-15), entries[1].Amount)
+	}
+	balance, _ := points.Balance("test-penalty")
+	assert.Equal(t, int64(80), balance)
+}
+
+func TestRewardServiceCapConcurrent(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	cleanVehicle(t, rdb, "test-cap-race")
+	rewards := NewRewardService(rdb, NewPointsService(rdb, ctx), NewTripService(rdb, ctx), ctx)
+	data := Telemetry{VehicleID: "test-cap-race", Timestamp: time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC).Unix()}
+
+	// Samples handled at the same time must not both pass the cap check.
+	var wg sync.WaitGroup
+	granted := make([]int64, 20)
+	for i := range granted {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			granted[i] = rewards.withinCap(data, "earned", 10, 45)
+		}()
+	}
+	wg.Wait()
+
+	var total int64
+	for _, g := range granted {
+		total += g
+	}
+	assert.Equal(t, int64(45), total)
+	counted, _ := rdb.HGet(ctx, "rewards_daily:test-cap-race:2026-03-10", "earned").Int64()
+	assert.Equal(t, int64(45), counted)
+}
+
+func TestParseStatusRulesRewards(t *testing.T) {
+	rules := defaultRules(t)
+	if assert.NotNil(t, rules.Rewards) {
+		assert.NotEmpty(t, rules.Rewards.Penalties)
+	}
+
+	_, err := ParseStatusRules([]byte(`{"rules": [
+		{"status": "safe", "category": "driver", "severity": "low", "safe": true}
+	], "rewards": {
+		"multipliers": [{"id": "x", "when": "rain", "factor": 0.5}],
+		"penalties": [{"id": "x", "status": "unknown", "points": 5}],
+		"campaigns": [{"id": "c", "from": "2026-04-01", "to": "2026-03-01", "bonus": 5}]
+	}}`))
+	if assert.Error(t, err) {
+		for _, problem := range []string{`unknown condition "rain"`, "factor must be above 1", `id "x" is used more than once`, `"unknown" must be a defined incident status`, "from first"} {
+			assert.Contains(t, err.Error(), problem)
+		}
+	}
+}
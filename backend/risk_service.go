@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// StatusHighRisk is raised by the risk engine when a vehicle's score
+// escalates. It is optional in the rules file; without it escalations are
+// only logged and recorded.
+const StatusHighRisk = "HIGH_RISK"
+
+// Risk levels by score.
+const (
+	RiskLow      = "low"
+	RiskElevated = "elevated"
+	RiskHigh     = "high"
+	RiskCritical = "critical"
+)
+
+var riskLevelRank = map[string]int{RiskLow: 0, RiskElevated: 1, RiskHigh: 2, RiskCritical: 3}
+
+// riskImpulse is what one incident adds to the score, by severity.
+var riskImpulse = map[string]float64{"none": 0, "low": 4, "medium": 10, "high": 18, "critical": 60}
+
+// RiskState is a vehicle's fused risk index.
+type RiskState struct {
+	Score          float64 `json:"score"` // 0-100, decays with RISK_HALF_LIFE
+	Level          string  `json:"level"`
+	UpdatedAt      int64   `json:"updated_at"`
+	DrivingSeconds int64   `json:"driving_seconds"`     // Continuous driving so far
+	Night          bool    `json:"night"`               // Last update fell in night hours
+	Escalated      bool    `json:"escalated,omitempty"` // This update crossed into a higher level
+}
+
+// RiskEscalation records a vehicle crossing into a higher risk level.
+type RiskEscalation struct {
+	Timestamp int64   `json:"timestamp"`
+	Score     float64 `json:"score"`
+	Level     string  `json:"level"`
+	Trigger   string  `json:"trigger"` // Status of the sample that crossed the threshold
+}
+
+// RiskService fuses driver states, vehicle events, biometrics and context
+// (time of day, continuous driving) into one decaying 0-100 score. Every
+// incident, and every heart rate anomaly, adds one impulse weighted by
+// severity and context, however many samples it spans, so chatty sources
+// don't score higher. The score halves every RISK_HALF_LIFE seconds without
+// new ones.
+type RiskService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewRiskService creates a new RiskService instance.
+func NewRiskService(redisClient *redis.Client, ctx context.Context) *RiskService {
+	return &RiskService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Update folds one processed sample into the vehicle's risk score. opened is
+// the incident the sample opened, if any.
+func (r *RiskService) Update(data Telemetry, opened *Incident, biometrics BiometricAssessment) RiskState {
+	key := fmt.Sprintf("risk:%s", data.VehicleID)
+	stored, err := r.redisClient.HGetAll(r.ctx, key).Result()
+	if err != nil {
+		log.Printf("Error getting risk state: %v", err)
+		return RiskState{Level: RiskLow}
+	}
+	num := func(field string) float64 {
+		v, _ := strconv.ParseFloat(stored[field], 64)
+		return v
+	}
+	updatedAt := int64(num("updated_at"))
+	sessionStart := int64(num("session_start"))
+	if updatedAt == 0 || data.Timestamp-updatedAt > RISK_SESSION_GAP {
+		sessionStart = data.Timestamp // New drive
+	}
+
+	now := max(data.Timestamp, updatedAt) // Backlogged samples don't rewind the clock
+	state := RiskState{
+		Score:          decayRisk(num("score"), now-updatedAt),
+		UpdatedAt:      now,
+		DrivingSeconds: now - sessionStart,
+		Night:          isNight(now),
+	}
+
+	impulse := 0.0
+	if opened != nil {
+		impulse = riskImpulse[opened.Severity]
+	}
+	// Biometrics: once as an anomaly starts, not for every reading during it
+	biometricState := stored["biometric_state"]
+	if biometrics.State != BiometricNoReading && biometrics.State != BiometricSensorFault {
+		if biometrics.State != biometricState && (biometrics.State == BiometricTachycardia || biometrics.State == BiometricBradycardia) {
+			impulse += riskImpulse["low"]
+		}
+		biometricState = biometrics.State
+	}
+	if impulse > 0 {
+		state.Score += impulse * riskContextFactor(state)
+	}
+	state.Score = math.Min(100, state.Score)
+	state.Level = riskLevel(state.Score)
+
+	// Escalate once per level; re-arm when the vehicle calms down.
+	escalated := stored["escalated_level"]
+	if state.Level == RiskLow {
+		escalated = ""
+	} else if riskLevelRank[state.Level] >= riskLevelRank[RiskHigh] && riskLevelRank[state.Level] > riskLevelRank[escalated] {
+		escalated = state.Level
+		state.Escalated = true
+	}
+
+	err = r.redisClient.HSet(r.ctx, key,
+		"score", state.Score,
+		"updated_at", state.UpdatedAt,
+		"session_start", sessionStart,
+		"escalated_level", escalated,
+		"biometric_state", biometricState,
+	).Err()
+	if err != nil {
+		log.Printf("Failed to save risk state: %v", err)
+	}
+	return state
+}
+
+// Current returns the vehicle's risk score decayed to now.
+func (r *RiskService) Current(vehicleID string) (RiskState, error) {
+	stored, err := r.redisClient.HMGet(r.ctx, fmt.Sprintf("risk:%s", vehicleID), "score", "updated_at", "session_start").Result()
+	if err != nil {
+		return RiskState{}, err
+	}
+	var vals [3]float64
+	for i, v := range stored {
+		if s, ok := v.(string); ok {
+			vals[i], _ = strconv.ParseFloat(s, 64)
+		}
+	}
+
+	state := RiskState{Level: RiskLow}
+	if vals[1] == 0 {
+		return state, nil
+	}
+	now := time.Now().Unix()
+	state.Score = decayRisk(vals[0], now-int64(vals[1]))
+	state.Level = riskLevel(state.Score)
+	state.UpdatedAt = int64(vals[1])
+	state.DrivingSeconds = int64(vals[1] - vals[2])
+	state.Night = isNight(now)
+	return state, nil
+}
+
+func decayRisk(score float64, elapsed int64) float64 {
+	if elapsed <= 0 {
+		return score
+	}
+	return score * math.Pow(0.5, float64(elapsed)/RISK_HALF_LIFE)
+}
+
+// riskContextFactor weighs an impulse by when it happens: at night and late
+// in a long drive the same event is more dangerous.
+func riskContextFactor(state RiskState) float64 {
+	factor := 1.0
+	if state.Night {
+		factor *= 1.5
+	}
+	switch {
+	case state.DrivingSeconds >= 4*60*60:
+		factor *= 1.5
+	case state.DrivingSeconds >= 2*60*60:
+		factor *= 1.25
+	}
+	return factor
+}
+
+// fleetTimezone is where the vehicles drive, set from FLEET_TIMEZONE. The
+// server's own time zone says nothing about the road's.
+var fleetTimezone = time.UTC
+
+// isNight reports whether ts falls between midnight and 5 a.m. fleet time,
+// when drowsiness-related crashes peak.
+func isNight(ts int64) bool {
+	return time.Unix(ts, 0).In(fleetTimezone).Hour() < 5
+}
+
+func riskLevel(score float64) string {
+	switch {
+	case score >= RISK_CRITICAL_THRESHOLD:
+		return RiskCritical
+	case score >= RISK_HIGH_THRESHOLD:
+		return RiskHigh
+	case score >= RISK_ELEVATED_THRESHOLD:
+		return RiskElevated
+	}
+	return RiskLow
+}
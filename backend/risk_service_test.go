@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestRiskServiceScore(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "risk:test-risk")
+	cleanVehicle(t, rdb, "test-risk")
+	risk := NewRiskService(rdb, ctx)
+	incidents := NewIncidentService(rdb, nil, ctx)
+
+	rules := defaultRules(t)
+	update := func(status string, ts int64) RiskState {
+		rule, _ := rules.Lookup(status)
+		data := Telemetry{VehicleID: "test-risk", Status: status, Timestamp: ts}
+		return risk.Update(data, incidents.Observe(data, rule), BiometricAssessment{State: BiometricNormal})
+	}
+
+	noon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).Unix()
+	assert.Equal(t, RiskLow, update("safe", noon).Level)
+	assert.Equal(t, RiskLow, update("harsh turn", noon+1).Level)
+
+	// A burst of drowsy samples is one incident, one impulse.
+	var state RiskState
+	for i := int64(0); i < 20; i++ {
+		state = update("drowsy", noon+2+i/4)
+	}
+	assert.InDelta(t, riskImpulse["medium"]+riskImpulse["high"], state.Score, 1, "decayed a little")
+	assert.Equal(t, RiskLow, state.Level)
+
+	escalations := 0
+	for i, status := range []string{"swerve", "speeding", "geofence_violation", "drowsy", StatusCrash} {
+		state = update(status, noon+7+int64(i))
+		if state.Escalated {
+			escalations++
+		}
+	}
+	assert.Equal(t, RiskCritical, state.Level)
+	assert.Equal(t, 2, escalations, "once into high, once into critical")
+	assert.Equal(t, int64(11), state.DrivingSeconds)
+
+	state = update("safe", noon+11+3*RISK_HALF_LIFE)
+	assert.InDelta(t, 100.0/8, state.Score, 0.5, "halves every RISK_HALF_LIFE")
+	assert.Equal(t, RiskLow, state.Level)
+
+	night := time.Date(2024, 1, 2, 2, 0, 0, 0, time.UTC).Unix()
+	state = update("harsh turn", night)
+	assert.Equal(t, riskImpulse["medium"]*1.5, state.Score, "new drive at night")
+}
+
+func TestRiskServiceBiometricEpisode(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "risk:test-risk-hr")
+	risk := NewRiskService(rdb, ctx)
+
+	noon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).Unix()
+	var state RiskState
+	for i, hr := range []string{BiometricNormal, BiometricTachycardia, BiometricTachycardia, BiometricNoReading, BiometricTachycardia} {
+		state = risk.Update(Telemetry{VehicleID: "test-risk-hr", Timestamp: noon}, nil, BiometricAssessment{State: hr})
+		if i > 0 {
+			assert.Equal(t, riskImpulse["low"], state.Score, "one impulse per anomaly")
+		}
+	}
+	state = risk.Update(Telemetry{VehicleID: "test-risk-hr", Timestamp: noon}, nil, BiometricAssessment{State: BiometricNormal})
+	state = risk.Update(Telemetry{VehicleID: "test-risk-hr", Timestamp: noon}, nil, BiometricAssessment{State: BiometricBradycardia})
+	assert.Equal(t, 2*riskImpulse["low"], state.Score, "a new anomaly counts again")
+}
+
+func TestIsNightFleetTimezone(t *testing.T) {
+	defer func(loc *time.Location) { fleetTimezone = loc }(fleetTimezone)
+
+	ts := time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC).Unix()
+	assert.False(t, isNight(ts))
+	fleetTimezone = time.FixedZone("IST", 5*60*60+30*60)
+	assert.True(t, isNight(ts), "3:30 a.m. where the vehicle drives")
+	assert.False(t, isNight(ts+6*60*60))
+}
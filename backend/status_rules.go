@@ -0,0 +1,306 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultStatusRules ships inside the binary, so the backend still starts
+// when no rules file is deployed next to it.
+//
+//go:embed status_rules.json
+var defaultStatusRules []byte
+
+// Status categories and severities accepted in the rules file.
+var (
+	statusCategories = map[string]bool{"driver": true, "vehicle": true, "biometric": true, "risk": true, "geofence": true}
+	statusSeverities = map[string]int{"none": 0, "low": 1, "medium": 2, "high": 3, "critical": 4}
+)
+
+// Statuses the pipeline refers to by name, so every rules file must define them.
+const (
+	StatusSafe           = "safe"
+	StatusHealthCritical = "HEALTH_CRITICAL"
+)
+
+// StatusRule says how one raw status from a device is handled.
+type StatusRule struct {
+	Status       string     `json:"status"`
+	Aliases      []string   `json:"aliases,omitempty"`       // Other raw spellings of the same status
+	NormalizeTo  string     `json:"normalize_to,omitempty"`  // Status used downstream (default: Status)
+	Category     string     `json:"category"`                // "driver", "vehicle", "biometric", "risk" or "geofence"
+	Source       string     `json:"source,omitempty"`        // Stamped on the sample (e.g. "ai", "iot")
+	Severity     string     `json:"severity"`                // "none", "low", "medium", "high" or "critical"
+	Safe         bool       `json:"safe,omitempty"`          // Counts towards the safe streak
+	ResetsStreak bool       `json:"resets_streak,omitempty"` // Counts as an incident: resets streak and periodic attestation
+	Attest       bool       `json:"attest,omitempty"`        // Logged on-chain as an alert
+	RateLimit    *RateLimit `json:"rate_limit,omitempty"`    // Token bucket for attested alerts of this status (critical ignores it)
+	Internal     bool       `json:"internal,omitempty"`      // Raised by the backend only; devices may not send it
+
+	// Opening an incident of this status asks the driver "are you OK" and
+	// alerts the emergency contacts if nobody answers (see EmergencyService).
+	Emergency bool `json:"emergency,omitempty"`
+}
+
+// RateLimit is a token bucket: Burst alerts at once, then one more every
+// RefillSeconds.
+type RateLimit struct {
+	Burst         int `json:"burst"`
+	RefillSeconds int `json:"refill_seconds"`
+}
+
+func (l RateLimit) validate() error {
+	if l.Burst < 1 || l.RefillSeconds < 1 {
+		return fmt.Errorf("rate_limit needs burst and refill_seconds of at least 1")
+	}
+	return nil
+}
+
+// Normalized returns the status used downstream.
+func (r StatusRule) Normalized() string {
+	if r.NormalizeTo != "" {
+		return r.NormalizeTo
+	}
+	return r.Status
+}
+
+// IsCritical reports whether the status bypasses rate limits and caps.
+func (r StatusRule) IsCritical() bool {
+	return r.Severity == "critical"
+}
+
+// Detector debounces a noisy source: a status only takes effect once
+// Required of the last Window samples agree with at least MinConfidence, and
+// returning to safe needs RecoveryRequired of the last RecoveryWindow.
+type Detector struct {
+	MinConfidence    float64 `json:"min_confidence"`
+	Window           int     `json:"window"`
+	Required         int     `json:"required"`
+	RecoveryWindow   int     `json:"recovery_window"`
+	RecoveryRequired int     `json:"recovery_required"`
+}
+
+func (d Detector) validate() error {
+	switch {
+	case d.MinConfidence < 0 || d.MinConfidence > 1:
+		return fmt.Errorf("min_confidence must be between 0 and 1")
+	case d.Required < 1 || d.Required > d.Window:
+		return fmt.Errorf("required must be between 1 and window")
+	case d.RecoveryRequired < 1 || d.RecoveryRequired > d.RecoveryWindow:
+		return fmt.Errorf("recovery_required must be between 1 and recovery_window")
+	}
+	return nil
+}
+
+// StatusRuleSet is a validated, immutable set of rules.
+type StatusRuleSet struct {
+	Rules               []StatusRule         `json:"rules"`
+	CategoryLimits      map[string]RateLimit `json:"category_limits"`       // Shared bucket per category, on top of each status's own
+	DailyAttestationCap int                  `json:"daily_attestation_cap"` // On-chain writes per vehicle per UTC day (critical events exempt); 0: no cap
+	Detectors           map[string]Detector  `json:"detectors"`             // Confirmation rules per source (e.g. "ai")
+	Dynamics            *DynamicsConfig      `json:"dynamics"`              // IMU event thresholds; nil ignores raw IMU data
+	Speeding            *SpeedingConfig      `json:"speeding"`              // Speed limits; nil disables speeding detection
+	DrivingTime         *DrivingTimeConfig   `json:"driving_time"`          // Hours of driving limits; nil tracks hours without enforcing them
+	Motion              *MotionConfig        `json:"motion"`                // Motion states and their policies; nil applies no policies
+	Streaks             *StreakConfig        `json:"streaks"`               // Safe streak milestones; nil awards no streak rewards
+	Rewards             *RewardConfig        `json:"rewards"`               // Multipliers, penalties, caps and campaigns; nil awards milestones as they are
+	byStatus            map[string]StatusRule
+}
+
+// ParseStatusRules parses and validates a rules file. Every problem found is
+// reported, not just the first.
+func ParseStatusRules(data []byte) (*StatusRuleSet, error) {
+	var rs StatusRuleSet
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return nil, fmt.Errorf("invalid rules JSON: %v", err)
+	}
+
+	var problems []string
+	rs.byStatus = make(map[string]StatusRule)
+	for i, rule := range rs.Rules {
+		where := fmt.Sprintf("rules[%d] (%q)", i, rule.Status)
+		if rule.Status == "" {
+			problems = append(problems, fmt.Sprintf("rules[%d]: status is required", i))
+		}
+		if !statusCategories[rule.Category] {
+			problems = append(problems, fmt.Sprintf("%s: unknown category %q", where, rule.Category))
+		}
+		if _, ok := statusSeverities[rule.Severity]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: unknown severity %q", where, rule.Severity))
+		}
+		if rule.Safe && (rule.ResetsStreak || rule.Attest) {
+			problems = append(problems, fmt.Sprintf("%s: a safe status cannot reset streaks or be attested", where))
+		}
+		if rule.Emergency && (!rule.IsCritical() || !rule.ResetsStreak) {
+			problems = append(problems, fmt.Sprintf("%s: an emergency status must be critical and reset streaks", where))
+		}
+		if rule.RateLimit != nil {
+			if err := rule.RateLimit.validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", where, err))
+			}
+		}
+		for _, name := range append([]string{rule.Status}, rule.Aliases...) {
+			if _, dup := rs.byStatus[name]; dup {
+				problems = append(problems, fmt.Sprintf("%s: %q is defined more than once", where, name))
+			}
+			rs.byStatus[name] = rule
+		}
+	}
+
+	for category, limit := range rs.CategoryLimits {
+		if !statusCategories[category] {
+			problems = append(problems, fmt.Sprintf("category_limits: unknown category %q", category))
+		} else if err := limit.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("category_limits[%q]: %v", category, err))
+		}
+	}
+	if rs.DailyAttestationCap < 0 {
+		problems = append(problems, "daily_attestation_cap cannot be negative")
+	}
+	for source, detector := range rs.Detectors {
+		if err := detector.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("detectors[%q]: %v", source, err))
+		}
+	}
+	if rs.Dynamics != nil {
+		if err := rs.Dynamics.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("dynamics: %v", err))
+		}
+		for _, status := range dynamicsStatuses {
+			if _, ok := rs.byStatus[status]; !ok {
+				problems = append(problems, fmt.Sprintf("dynamics: %q must be defined to detect it", status))
+			}
+		}
+		if rule, ok := rs.byStatus[StatusCrash]; rs.Dynamics.CrashG > 0 && (!ok || !rule.IsCritical()) {
+			problems = append(problems, fmt.Sprintf("dynamics: %q must be defined with critical severity to detect crashes", StatusCrash))
+		}
+	}
+	if rs.Speeding != nil {
+		if err := rs.Speeding.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("speeding: %v", err))
+		}
+		if _, ok := rs.byStatus[StatusSpeeding]; !ok {
+			problems = append(problems, fmt.Sprintf("speeding: %q must be defined to detect it", StatusSpeeding))
+		}
+	}
+	if rs.DrivingTime != nil {
+		if err := rs.DrivingTime.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("driving_time: %v", err))
+		}
+		if _, ok := rs.byStatus[StatusDrivingTimeViolation]; !ok {
+			problems = append(problems, fmt.Sprintf("driving_time: %q must be defined to enforce limits", StatusDrivingTimeViolation))
+		}
+	}
+	if rs.Motion != nil {
+		if err := rs.Motion.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("motion: %v", err))
+		}
+	}
+	if rs.Streaks != nil {
+		if err := rs.Streaks.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("streaks: %v", err))
+		}
+		if rs.Streaks.RequireMoving && rs.Motion == nil {
+			problems = append(problems, "streaks: require_moving needs the motion section")
+		}
+	}
+	if rs.Rewards != nil {
+		problems = append(problems, rs.Rewards.validate(&rs)...)
+	}
+	for _, rule := range rs.Rules {
+		if target, ok := rs.byStatus[rule.NormalizeTo]; rule.NormalizeTo != "" && (!ok || target.Safe != rule.Safe) {
+			problems = append(problems, fmt.Sprintf("%q: normalize_to %q must be a defined status of the same kind", rule.Status, rule.NormalizeTo))
+		}
+	}
+	if rule, ok := rs.byStatus[StatusSafe]; !ok || !rule.Safe {
+		problems = append(problems, fmt.Sprintf("%q must be defined as a safe status", StatusSafe))
+	}
+	if rule, ok := rs.byStatus[StatusHealthCritical]; !ok || !rule.IsCritical() {
+		problems = append(problems, fmt.Sprintf("%q must be defined with critical severity", StatusHealthCritical))
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	return &rs, nil
+}
+
+// Lookup finds the rule for a raw status or alias.
+func (rs *StatusRuleSet) Lookup(status string) (StatusRule, bool) {
+	rule, ok := rs.byStatus[status]
+	return rule, ok
+}
+
+// StatusRuleEngine holds the active rule set and swaps it when the rules
+// file changes. Readers always get a complete, validated set.
+type StatusRuleEngine struct {
+	path    string
+	current atomic.Pointer[StatusRuleSet]
+	modTime time.Time
+}
+
+// NewStatusRuleEngine loads rules from path, or the built-in defaults if the
+// file doesn't exist. An invalid file is an error: better to refuse to start
+// than to attest the wrong things.
+func NewStatusRuleEngine(path string) (*StatusRuleEngine, error) {
+	e := &StatusRuleEngine{path: path}
+
+	data, modTime, err := readRulesFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("📋 No status rules at %s, using built-in defaults", path)
+		data = defaultStatusRules
+	} else if err != nil {
+		return nil, err
+	}
+
+	rs, err := ParseStatusRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("status rules %s: %v", path, err)
+	}
+	e.current.Store(rs)
+	e.modTime = modTime
+	log.Printf("📋 Loaded %d status rules", len(rs.Rules))
+	return e, nil
+}
+
+// Rules returns the active rule set.
+func (e *StatusRuleEngine) Rules() *StatusRuleSet {
+	return e.current.Load()
+}
+
+// WatchForChanges polls the rules file and hot-reloads it when it changes.
+// A file that fails validation is logged and ignored; the previous rules stay
+// active.
+func (e *StatusRuleEngine) WatchForChanges(interval time.Duration) {
+	for range time.Tick(interval) {
+		data, modTime, err := readRulesFile(e.path)
+		if err != nil || !modTime.After(e.modTime) {
+			continue
+		}
+		e.modTime = modTime
+
+		rs, err := ParseStatusRules(data)
+		if err != nil {
+			log.Printf("❌ Ignoring invalid status rules update: %v", err)
+			continue
+		}
+		e.current.Store(rs)
+		log.Printf("📋 Reloaded %d status rules from %s", len(rs.Rules), e.path)
+	}
+}
+
+func readRulesFile(path string) ([]byte, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := os.ReadFile(path)
+	return data, info.ModTime(), err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultStatusRules(t *testing.T) {
+	rules := defaultRules(t)
+
+	rule, ok := rules.Lookup("safe_vehicle")
+	assert.True(t, ok)
+	assert.Equal(t, "safe", rule.Normalized())
+	assert.True(t, rule.Safe)
+
+	rule, ok = rules.Lookup(StatusHealthCritical)
+	assert.True(t, ok)
+	assert.True(t, rule.IsCritical())
+	assert.True(t, rule.Internal)
+
+	_, ok = rules.Lookup("joyriding")
+	assert.False(t, ok)
+	assert.Equal(t, 500, rules.DailyAttestationCap)
+}
+
+func TestParseStatusRulesRejectsInvalid(t *testing.T) {
+	_, err := ParseStatusRules([]byte(`{"daily_attestation_cap": -1, "rules": [
+		{"status": "safe", "category": "driver", "severity": "none", "safe": true},
+		{"status": "speeding", "category": "vehicle", "severity": "extreme", "attest": true},
+		{"status": "speeding", "category": "road", "severity": "high"}
+	]}`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `unknown severity "extreme"`)
+		assert.Contains(t, err.Error(), `unknown category "road"`)
+		assert.Contains(t, err.Error(), `"speeding" is defined more than once`)
+		assert.Contains(t, err.Error(), `"HEALTH_CRITICAL" must be defined with critical severity`)
+		assert.Contains(t, err.Error(), "daily_attestation_cap cannot be negative")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// StreakConfig defines safe streaks as continuous verified safe driving
+// time, rewarded at milestones.
+type StreakConfig struct {
+	Milestones       []StreakMilestone `json:"milestones"`         // Ascending; after the last one the streak starts over
+	RequiredSources  []string          `json:"required_sources"`   // Sources that must all be reporting for safe time to count
+	SourceTimeoutSec int64             `json:"source_timeout_sec"` // A source is offline after this long without a sample
+	MaxGapSec        int64             `json:"max_gap_sec"`        // Longer without verified safe driving breaks the streak
+	RequireMoving    bool              `json:"require_moving"`     // Only time spent moving counts (needs the motion section)
+}
+
+// StreakMilestone is a reward for reaching a streak length.
+type StreakMilestone struct {
+	ID      string `json:"id"` // Reward rule ID, recorded on the ledger
+	Minutes int64  `json:"minutes"`
+	Points  int    `json:"points"`
+	Attest  bool   `json:"attest"` // Record the reward on-chain
+}
+
+func (c StreakConfig) validate() error {
+	if len(c.Milestones) == 0 {
+		return fmt.Errorf("at least one milestone is required")
+	}
+	for i, m := range c.Milestones {
+		if m.ID == "" {
+			return fmt.Errorf("milestones[%d]: id is required", i)
+		}
+		if m.Minutes <= 0 || m.Points < 0 || (i > 0 && m.Minutes <= c.Milestones[i-1].Minutes) {
+			return fmt.Errorf("milestones[%d]: minutes must be positive and ascending, points not negative", i)
+		}
+	}
+	if c.SourceTimeoutSec <= 0 || c.MaxGapSec <= 0 {
+		return fmt.Errorf("source_timeout_sec and max_gap_sec must be positive")
+	}
+	return nil
+}
+
+// Streak is a vehicle's current safe streak.
+type Streak struct {
+	VehicleID        string `json:"vehicle_id"`
+	StartedAt        int64  `json:"started_at"`   // Event time; 0 without a streak
+	ConfirmedAt      int64  `json:"confirmed_at"` // Last verified safe sample
+	SafeSec          int64  `json:"safe_sec"`     // Verified safe driving time, pauses excluded
+	Milestone        int    `json:"milestone"`    // Milestones reached so far
+	NextMilestoneMin int64  `json:"next_milestone_min,omitempty"`
+}
+
+// StreakService keeps safe streaks. The state lives in the streak:{vehicle}
+// hash, so streaks survive restarts.
+type StreakService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewStreakService creates a new StreakService instance.
+func NewStreakService(redisClient *redis.Client, ctx context.Context) *StreakService {
+	return &StreakService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// SeeSource records that the sample's source is reporting.
+func (s *StreakService) SeeSource(data Telemetry) {
+	if data.Source == "" {
+		return
+	}
+	key := fmt.Sprintf("sources_seen:%s", data.VehicleID)
+	last, _ := s.redisClient.HGet(s.ctx, key, data.Source).Int64()
+	if data.Timestamp > last {
+		s.redisClient.HSet(s.ctx, key, data.Source, data.Timestamp)
+	}
+}
+
+// Confirm extends the streak with a safe sample, if it can be verified:
+// moving, with every required source online. Time between confirmations
+// counts if they are at most STREAK_SAMPLE_GAP apart; a longer pause (a red
+// light, a source reconnecting) doesn't count but keeps the streak, up to
+// cfg.MaxGapSec. Returns the milestone reached, if any.
+func (s *StreakService) Confirm(data Telemetry, cfg *StreakConfig) *StreakMilestone {
+	if cfg == nil || !s.verified(data, cfg) {
+		return nil
+	}
+	key := fmt.Sprintf("streak:%s", data.VehicleID)
+	streak, err := s.load(data.VehicleID)
+	if err != nil {
+		log.Printf("Error getting safe streak: %v", err)
+		return nil
+	}
+	if data.Timestamp <= streak.ConfirmedAt {
+		return nil // Backlogged
+	}
+
+	gap := data.Timestamp - streak.ConfirmedAt
+	switch {
+	case streak.StartedAt == 0 || gap > cfg.MaxGapSec:
+		streak = Streak{StartedAt: data.Timestamp}
+	case gap <= STREAK_SAMPLE_GAP:
+		streak.SafeSec += gap
+	}
+	streak.ConfirmedAt = data.Timestamp
+
+	var reached *StreakMilestone
+	if streak.Milestone < len(cfg.Milestones) && streak.SafeSec >= cfg.Milestones[streak.Milestone].Minutes*60 {
+		reached = &cfg.Milestones[streak.Milestone]
+		streak.Milestone++
+		log.Printf("🔥 %s reached a %d min safe streak", data.VehicleID, reached.Minutes)
+		if streak.Milestone == len(cfg.Milestones) {
+			streak = Streak{StartedAt: data.Timestamp, ConfirmedAt: data.Timestamp} // Start over for the next rewards
+		}
+	}
+
+	err = s.redisClient.HSet(s.ctx, key,
+		"started_at", streak.StartedAt,
+		"confirmed_at", streak.ConfirmedAt,
+		"safe_sec", streak.SafeSec,
+		"milestone", streak.Milestone,
+	).Err()
+	if err != nil {
+		log.Printf("Failed to save safe streak: %v", err)
+	}
+	return reached
+}
+
+// Break ends the vehicle's streak, e.g. on an incident.
+func (s *StreakService) Break(vehicleID string) {
+	if err := s.redisClient.Del(s.ctx, fmt.Sprintf("streak:%s", vehicleID)).Err(); err != nil {
+		log.Printf("Failed to reset safe streak: %v", err)
+	}
+}
+
+// Current returns the vehicle's streak. A streak not confirmed for
+// cfg.MaxGapSec of server time is already broken.
+func (s *StreakService) Current(vehicleID string, cfg *StreakConfig) (Streak, error) {
+	streak, err := s.load(vehicleID)
+	if err != nil {
+		return streak, err
+	}
+	if cfg == nil {
+		return streak, nil
+	}
+	if streak.StartedAt != 0 && time.Now().Unix()-streak.ConfirmedAt > cfg.MaxGapSec {
+		streak = Streak{VehicleID: vehicleID}
+	}
+	if streak.Milestone < len(cfg.Milestones) {
+		streak.NextMilestoneMin = cfg.Milestones[streak.Milestone].Minutes
+	}
+	return streak, nil
+}
+
+// verified reports whether a safe sample shows verified safe driving.
+func (s *StreakService) verified(data Telemetry, cfg *StreakConfig) bool {
+	if cfg.RequireMoving && data.Motion != MotionMoving {
+		return false
+	}
+	if len(cfg.RequiredSources) == 0 {
+		return true
+	}
+	seen, err := s.redisClient.HMGet(s.ctx, fmt.Sprintf("sources_seen:%s", data.VehicleID), cfg.RequiredSources...).Result()
+	if err != nil {
+		return false
+	}
+	for _, v := range seen {
+		str, _ := v.(string)
+		ts, _ := strconv.ParseInt(str, 10, 64)
+		if data.Timestamp-ts > cfg.SourceTimeoutSec {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *StreakService) load(vehicleID string) (Streak, error) {
+	streak := Streak{VehicleID: vehicleID}
+	stored, err := s.redisClient.HGetAll(s.ctx, fmt.Sprintf("streak:%s", vehicleID)).Result()
+	if err != nil {
+		return streak, err
+	}
+	streak.StartedAt, _ = strconv.ParseInt(stored["started_at"], 10, 64)
+	streak.ConfirmedAt, _ = strconv.ParseInt(stored["confirmed_at"], 10, 64)
+	streak.SafeSec, _ = strconv.ParseInt(stored["safe_sec"], 10, 64)
+	streak.Milestone, _ = strconv.Atoi(stored["milestone"])
+	return streak, nil
+}
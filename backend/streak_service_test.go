@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestStreakServiceConfirm(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "streak:test-streak", "sources_seen:test-streak")
+	streaks := NewStreakService(rdb, ctx)
+
+	cfg := &StreakConfig{
+		Milestones:       []StreakMilestone{{Minutes: 2, Points: 10}, {Minutes: 4, Points: 20, Attest: true}},
+		RequiredSources:  []string{"ai"},
+		SourceTimeoutSec: 30,
+		MaxGapSec:        300,
+		RequireMoving:    true,
+	}
+	safe := func(ts int64, motion string) *StreakMilestone {
+		data := Telemetry{VehicleID: "test-streak", Timestamp: ts, Status: "safe", Source: "ai", Motion: motion}
+		streaks.SeeSource(data)
+		return streaks.Confirm(data, cfg)
+	}
+
+	// The rate samples arrive at doesn't matter, only the time they cover.
+	for ts := int64(1000); ts < 1120; ts += 30 {
+		assert.Nil(t, safe(ts, MotionMoving))
+	}
+	if reached := safe(1120, MotionMoving); assert.NotNil(t, reached) {
+		assert.Equal(t, 10, reached.Points)
+	}
+
+	// Idling doesn't count, nor does the pause, but the streak survives it.
+	assert.Nil(t, safe(1150, MotionIdling))
+	assert.Nil(t, safe(1240, MotionMoving))
+	streak, err := streaks.Current("test-streak", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), streak.StartedAt)
+	assert.Equal(t, int64(1240), streak.ConfirmedAt)
+	assert.Equal(t, int64(120), streak.SafeSec)
+
+	// Without the camera reporting, safe samples can't be verified.
+	vehicleOnly := Telemetry{VehicleID: "test-streak", Timestamp: 1300, Status: "safe", Source: "iot", Motion: MotionMoving}
+	streaks.SeeSource(vehicleOnly)
+	assert.Nil(t, streaks.Confirm(vehicleOnly, cfg))
+
+	for ts := int64(1260); ts < 1360; ts += 20 {
+		assert.Nil(t, safe(ts, MotionMoving))
+	}
+	if reached := safe(1360, MotionMoving); assert.NotNil(t, reached) {
+		assert.Equal(t, 20, reached.Points)
+	}
+	streak, _ = streaks.Current("test-streak", nil)
+	assert.Equal(t, 0, streak.Milestone, "starts over after the last milestone")
+
+	// An incident breaks it; so does too long a gap.
+	streaks.Break("test-streak")
+	streak, _ = streaks.Current("test-streak", nil)
+	assert.Zero(t, streak.StartedAt)
+	safe(2000, MotionMoving)
+	safe(2030, MotionMoving)
+	safe(2400, MotionMoving)
+	streak, _ = streaks.Current("test-streak", nil)
+	assert.Equal(t, int64(2400), streak.StartedAt)
+	assert.Zero(t, streak.SafeSec)
+}
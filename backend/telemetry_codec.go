@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/proto"
+
+	"saferide/backend/telemetrypb"
+)
+
+//go:generate protoc --proto_path=../schema --go_out=telemetrypb --go_opt=paths=source_relative telemetry.proto
+
+// TelemetryEncoding identifies the wire format of a telemetry payload.
+// See schema/telemetry.proto for the shared contract.
+type TelemetryEncoding string
+
+const (
+	EncodingJSON     TelemetryEncoding = "json"
+	EncodingCBOR     TelemetryEncoding = "cbor"
+	EncodingProtobuf TelemetryEncoding = "proto" // A Telemetry message
+
+	// EncodingProtobufBatch is a payload declared to be a TelemetryBatch
+	// (topic suffix "proto-batch", or the messageType Content-Type parameter).
+	EncodingProtobufBatch TelemetryEncoding = "proto-batch"
+)
+
+// cborSelfDescribeTag is the RFC 8949 magic prefix (tag 55799) a device may
+// put in front of a CBOR payload to make it unambiguous.
+var cborSelfDescribeTag = []byte{0xd9, 0xd9, 0xf7}
+
+// cborEncMode stores floats in the shortest lossless width to keep payloads small.
+var cborEncMode, _ = cbor.EncOptions{ShortestFloat: cbor.ShortestFloat16}.EncMode()
+
+// ParseTelemetryEncoding maps a topic suffix or format name to an encoding.
+func ParseTelemetryEncoding(name string) (TelemetryEncoding, bool) {
+	switch strings.ToLower(name) {
+	case "json":
+		return EncodingJSON, true
+	case "cbor":
+		return EncodingCBOR, true
+	case "proto", "protobuf", "pb":
+		return EncodingProtobuf, true
+	case "proto-batch", "protobuf-batch", "pb-batch":
+		return EncodingProtobufBatch, true
+	}
+	return "", false
+}
+
+// encodingFromTopic reads the optional suffix of "vehicles/{id}/telemetry/{encoding}".
+// MQTT v5 content-type properties aren't available with the paho v3 client,
+// so the topic suffix is how MQTT publishers declare binary payloads.
+func encodingFromTopic(topic string) (TelemetryEncoding, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 4 {
+		return "", false
+	}
+	return ParseTelemetryEncoding(parts[3])
+}
+
+// encodingFromContentType maps an HTTP Content-Type header to an encoding.
+// Protobuf senders may name the message, e.g.
+// "application/x-protobuf; messageType=saferide.v1.TelemetryBatch".
+func encodingFromContentType(contentType string) (TelemetryEncoding, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	switch mediaType {
+	case "application/json":
+		return EncodingJSON, true
+	case "application/cbor":
+		return EncodingCBOR, true
+	case "application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf":
+		if strings.HasSuffix(params["messagetype"], "TelemetryBatch") {
+			return EncodingProtobufBatch, true
+		}
+		return EncodingProtobuf, true
+	}
+	return "", false
+}
+
+// sniffEncoding guesses the encoding from the first byte of the payload.
+// Whitespace is only skipped in front of JSON: in a binary payload it is
+// data (0x0a is the tag of Telemetry.vehicle_id).
+func sniffEncoding(payload []byte) TelemetryEncoding {
+	if trimmed := bytes.TrimLeft(payload, " \t\r\n"); len(trimmed) == 0 || trimmed[0] == '{' || trimmed[0] == '[' {
+		return EncodingJSON
+	}
+	if bytes.HasPrefix(payload, cborSelfDescribeTag) {
+		return EncodingCBOR
+	}
+	if first := payload[0]; first >= 0x80 && first <= 0xbf { // CBOR major types 4 (array) and 5 (map)
+		return EncodingCBOR
+	}
+	return EncodingProtobuf
+}
+
+// DecodeTelemetry decodes a payload into a batch. JSON and CBOR payloads may
+// hold a single sample, an array of samples, or a TelemetryBatch object;
+// Protobuf payloads hold the message their encoding declares.
+func DecodeTelemetry(payload []byte, enc TelemetryEncoding) (TelemetryBatch, error) {
+	var batch TelemetryBatch
+	switch enc {
+	case EncodingJSON:
+		trimmed := bytes.TrimSpace(payload)
+		if len(trimmed) > 0 && trimmed[0] == '[' {
+			err := json.Unmarshal(trimmed, &batch.Samples)
+			return batch, err
+		}
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			return batch, err
+		}
+		if batch.Samples == nil {
+			var data Telemetry
+			if err := json.Unmarshal(trimmed, &data); err != nil {
+				return batch, err
+			}
+			batch = TelemetryBatch{VehicleID: data.VehicleID, Samples: []Telemetry{data}}
+		}
+		return batch, nil
+
+	case EncodingCBOR:
+		payload = bytes.TrimPrefix(payload, cborSelfDescribeTag)
+		if len(payload) > 0 && payload[0] >= 0x80 && payload[0] <= 0x9f {
+			err := cbor.Unmarshal(payload, &batch.Samples)
+			return batch, err
+		}
+		if err := cbor.Unmarshal(payload, &batch); err != nil {
+			return batch, err
+		}
+		if batch.Samples == nil {
+			var data Telemetry
+			if err := cbor.Unmarshal(payload, &data); err != nil {
+				return batch, err
+			}
+			batch = TelemetryBatch{VehicleID: data.VehicleID, Samples: []Telemetry{data}}
+		}
+		return batch, nil
+
+	case EncodingProtobufBatch:
+		var msg telemetrypb.TelemetryBatch
+		if err := proto.Unmarshal(payload, &msg); err != nil {
+			return batch, err
+		}
+		return batchFromProto(&msg), nil
+
+	case EncodingProtobuf:
+		var msg telemetrypb.Telemetry
+		if err := proto.Unmarshal(payload, &msg); err != nil {
+			return batch, err
+		}
+		data := telemetryFromProto(&msg)
+		return TelemetryBatch{VehicleID: data.VehicleID, Samples: []Telemetry{data}}, nil
+	}
+	return batch, fmt.Errorf("unsupported encoding %q", enc)
+}
+
+// EncodeTelemetry encodes a sample in the given encoding. Test tools use it
+// through the "encode" subcommand to produce binary payloads.
+func EncodeTelemetry(data Telemetry, enc TelemetryEncoding) ([]byte, error) {
+	switch enc {
+	case EncodingJSON:
+		return json.Marshal(data)
+	case EncodingCBOR:
+		return cborEncMode.Marshal(data)
+	case EncodingProtobuf:
+		return proto.Marshal(telemetryToProto(data))
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", enc)
+}
+
+// EncodeTelemetryBatch encodes a batch in the given encoding. A Protobuf
+// batch is a TelemetryBatch message, so it has to be sent as proto-batch.
+func EncodeTelemetryBatch(batch TelemetryBatch, enc TelemetryEncoding) ([]byte, error) {
+	switch enc {
+	case EncodingJSON:
+		return json.Marshal(batch)
+	case EncodingCBOR:
+		return cborEncMode.Marshal(batch)
+	case EncodingProtobufBatch:
+		return proto.Marshal(batchToProto(batch))
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", enc)
+}
+
+// telemetryToProto maps a sample onto the generated Telemetry message. Only
+// the fields in schema/telemetry.proto travel; the rest are set by the
+// backend.
+func telemetryToProto(data Telemetry) *telemetrypb.Telemetry {
+	msg := &telemetrypb.Telemetry{
+		VehicleId:     data.VehicleID,
+		HeartRate:     int32(data.HeartRate),
+		Timestamp:     data.Timestamp,
+		Status:        data.Status,
+		Lat:           data.Lat,
+		Long:          data.Long,
+		Confidence:    data.Confidence,
+		Source:        data.Source,
+		TxHash:        data.TxHash,
+		AgeMs:         data.AgeMs,
+		UptimeMs:      data.UptimeMs,
+		DeviceId:      data.DeviceID,
+		MessageId:     data.MessageID,
+		Seq:           data.Seq,
+		SchemaVersion: uint32(data.SchemaVersion),
+	}
+	for _, sample := range data.IMU {
+		// Floats are plenty for a MEMS sensor at half the size of doubles.
+		msg.Imu = append(msg.Imu, &telemetrypb.IMUSample{
+			T:  sample.OffsetMs,
+			Ax: float32(sample.Ax),
+			Ay: float32(sample.Ay),
+			Az: float32(sample.Az),
+			Gx: float32(sample.Gx),
+			Gy: float32(sample.Gy),
+			Gz: float32(sample.Gz),
+		})
+	}
+	return msg
+}
+
+// telemetryFromProto maps a decoded Telemetry message back onto a sample.
+func telemetryFromProto(msg *telemetrypb.Telemetry) Telemetry {
+	data := Telemetry{
+		VehicleID:     msg.GetVehicleId(),
+		HeartRate:     int(msg.GetHeartRate()),
+		Timestamp:     msg.GetTimestamp(),
+		Status:        msg.GetStatus(),
+		Lat:           msg.GetLat(),
+		Long:          msg.GetLong(),
+		Confidence:    msg.GetConfidence(),
+		Source:        msg.GetSource(),
+		TxHash:        msg.GetTxHash(),
+		AgeMs:         msg.GetAgeMs(),
+		UptimeMs:      msg.GetUptimeMs(),
+		DeviceID:      msg.GetDeviceId(),
+		MessageID:     msg.GetMessageId(),
+		Seq:           msg.GetSeq(),
+		SchemaVersion: int(msg.GetSchemaVersion()),
+	}
+	for _, sample := range msg.GetImu() {
+		data.IMU = append(data.IMU, IMUSample{
+			OffsetMs: sample.GetT(),
+			Ax:       float64(sample.GetAx()),
+			Ay:       float64(sample.GetAy()),
+			Az:       float64(sample.GetAz()),
+			Gx:       float64(sample.GetGx()),
+			Gy:       float64(sample.GetGy()),
+			Gz:       float64(sample.GetGz()),
+		})
+	}
+	return data
+}
+
+func batchToProto(batch TelemetryBatch) *telemetrypb.TelemetryBatch {
+	msg := &telemetrypb.TelemetryBatch{VehicleId: batch.VehicleID, SentAt: batch.SentAt}
+	for _, sample := range batch.Samples {
+		msg.Samples = append(msg.Samples, telemetryToProto(sample))
+	}
+	return msg
+}
+
+func batchFromProto(msg *telemetrypb.TelemetryBatch) TelemetryBatch {
+	batch := TelemetryBatch{VehicleID: msg.GetVehicleId(), SentAt: msg.GetSentAt()}
+	for _, sample := range msg.GetSamples() {
+		batch.Samples = append(batch.Samples, telemetryFromProto(sample))
+	}
+	return batch
+}
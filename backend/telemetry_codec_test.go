@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTelemetryCodecRoundTrip(t *testing.T) {
+	sample := Telemetry{
+		SchemaVersion: 2,
+		VehicleID:     "v-101",
+		HeartRate:     72,
+		Timestamp:     1700000000,
+		Status:        "harsh turn",
+		Lat:           28.7041,
+		Long:          77.1025,
+		Confidence:    0.99,
+		Source:        "iot",
+		DeviceID:      "pico-w",
+		UptimeMs:      123456,
+		MessageID:     "m-42",
+		Seq:           42,
+		IMU: []IMUSample{
+			{OffsetMs: -20, Ax: -0.5, Ay: 0.25, Az: 1, Gz: 12.5},
+			{OffsetMs: 0, Ax: -0.625, Ay: 0.125, Az: 1, Gx: -1.5, Gy: 0.75, Gz: -3},
+		},
+	}
+
+	for _, enc := range []TelemetryEncoding{EncodingJSON, EncodingCBOR, EncodingProtobuf} {
+		payload, err := EncodeTelemetry(sample, enc)
+		assert.NoError(t, err)
+		assert.Equal(t, enc, sniffEncoding(payload), "sniffing %s", enc)
+
+		decoded, err := DecodeTelemetry(payload, enc)
+		assert.NoError(t, err)
+		assert.Equal(t, []Telemetry{sample}, decoded.Samples, "round trip %s", enc)
+	}
+}
+
+func TestTelemetryBatchRoundTrip(t *testing.T) {
+	batch := TelemetryBatch{
+		VehicleID: "v-101",
+		SentAt:    5000,
+		Samples: []Telemetry{
+			{VehicleID: "v-101", Status: "safe", Timestamp: 4990},
+			{VehicleID: "v-101", Status: "hard braking", AgeMs: 2500},
+		},
+	}
+
+	for _, enc := range []TelemetryEncoding{EncodingJSON, EncodingCBOR, EncodingProtobufBatch} {
+		payload, err := EncodeTelemetryBatch(batch, enc)
+		assert.NoError(t, err)
+
+		decoded, err := DecodeTelemetry(payload, enc)
+		assert.NoError(t, err)
+		assert.Equal(t, batch, decoded, "round trip %s", enc)
+	}
+}
+
+func TestTelemetryProtoWithoutVehicleID(t *testing.T) {
+	// The vehicle ID comes from the MQTT topic, so the payload starts with
+	// another field. It is still a single sample, not a batch.
+	sample := Telemetry{Status: "safe", Timestamp: 1700000000, MessageID: "m-7", Seq: 7}
+	payload, err := EncodeTelemetry(sample, EncodingProtobuf)
+	assert.NoError(t, err)
+	decoded, err := DecodeTelemetry(payload, EncodingProtobuf)
+	assert.NoError(t, err)
+	assert.Equal(t, []Telemetry{sample}, decoded.Samples)
+
+	// Likewise a batch without a vehicle ID or sent_at.
+	batchPayload, err := EncodeTelemetryBatch(TelemetryBatch{Samples: []Telemetry{sample}}, EncodingProtobufBatch)
+	assert.NoError(t, err)
+	decoded, err = DecodeTelemetry(batchPayload, EncodingProtobufBatch)
+	assert.NoError(t, err)
+	assert.Equal(t, []Telemetry{sample}, decoded.Samples)
+}
+
+func TestTelemetryProtoBatchMustBeDeclared(t *testing.T) {
+	batch := TelemetryBatch{VehicleID: "v-101", SentAt: 5000, Samples: []Telemetry{{VehicleID: "v-101", Status: "safe"}}}
+	_, err := EncodeTelemetryBatch(batch, EncodingProtobuf)
+	assert.Error(t, err)
+
+	// An undeclared batch is read as one Telemetry message, never guessed
+	// from its fields, so it fails validation instead of being ingested.
+	payload, _ := EncodeTelemetryBatch(batch, EncodingProtobufBatch)
+	decoded, err := DecodeTelemetry(payload, EncodingProtobuf)
+	assert.NoError(t, err)
+	if assert.Len(t, decoded.Samples, 1) {
+		assert.Empty(t, decoded.Samples[0].VehicleID)
+		assert.Error(t, validateTelemetry(decoded.Samples[0], defaultRules(t)))
+	}
+}
+
+func TestTelemetryEncodingDetection(t *testing.T) {
+	payload, _ := EncodeTelemetry(Telemetry{VehicleID: "v-101", Status: "safe"}, EncodingProtobuf)
+	assert.Equal(t, byte(0x0a), payload[0])
+	assert.Equal(t, EncodingProtobuf, sniffEncoding(payload), "0x0a is data, not whitespace")
+	assert.Equal(t, EncodingJSON, sniffEncoding([]byte("\n  {\"status\": \"safe\"}")))
+
+	enc, ok := encodingFromContentType("application/x-protobuf; messageType=saferide.v1.TelemetryBatch")
+	assert.True(t, ok)
+	assert.Equal(t, EncodingProtobufBatch, enc)
+	enc, _ = encodingFromContentType("application/x-protobuf")
+	assert.Equal(t, EncodingProtobuf, enc)
+	enc, _ = encodingFromTopic("vehicles/v-101/telemetry/proto-batch")
+	assert.Equal(t, EncodingProtobufBatch, enc)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// CURRENT_SCHEMA_VERSION is the Telemetry contract the pipeline works with.
+// Payloads without schema_version are version 1 (the original Pico/CV
+// firmware) and are migrated up before validation.
+const CURRENT_SCHEMA_VERSION = 2
+
+// Validation error codes, stable for device developers and dashboards.
+const (
+	ErrCodeRequired           = "required"
+	ErrCodeOutOfRange         = "out_of_range"
+	ErrCodeInvalidFormat      = "invalid_format"
+	ErrCodeUnknownValue       = "unknown_value"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+)
+
+// ValidationError describes one field that breaks the contract.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is returned when one or more fields are invalid.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	parts := make([]string, len(e))
+	for i, v := range e {
+		parts[i] = fmt.Sprintf("%s: %s (%s)", v.Field, v.Message, v.Code)
+	}
+	return "schema violation: " + strings.Join(parts, "; ")
+}
+
+var knownSources = map[string]bool{"": true, "ai": true, "iot": true}
+
+var vehicleIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// telemetryMigrations[n] upgrades a version n payload to version n+1.
+var telemetryMigrations = map[int]func(*Telemetry){
+	// v1 -> v2: early firmware sent upper-case statuses and the button labels
+	// "rash driving" and "stress" for what are now vehicle events.
+	1: func(data *Telemetry) {
+		data.Status = strings.ToLower(strings.TrimSpace(data.Status))
+		switch data.Status {
+		case "rash driving":
+			data.Status = "harsh turn"
+		case "stress":
+			data.Status = "hard braking"
+		}
+		data.Source = strings.ToLower(data.Source)
+	},
+}
+
+// migrateTelemetry upgrades data to CURRENT_SCHEMA_VERSION in place.
+func migrateTelemetry(data *Telemetry) error {
+	if data.SchemaVersion == 0 {
+		data.SchemaVersion = 1
+	}
+	if data.SchemaVersion > CURRENT_SCHEMA_VERSION {
+		return ValidationErrors{{
+			Field:   "schema_version",
+			Code:    ErrCodeUnsupportedVersion,
+			Message: fmt.Sprintf("version %d is newer than supported version %d", data.SchemaVersion, CURRENT_SCHEMA_VERSION),
+		}}
+	}
+	for data.SchemaVersion < CURRENT_SCHEMA_VERSION {
+		if migrate, ok := telemetryMigrations[data.SchemaVersion]; ok {
+			migrate(data)
+		}
+		data.SchemaVersion++
+	}
+	return nil
+}
+
+// validateTelemetry checks a migrated sample against the current contract.
+// Statuses must have a rule in the status rules file. It returns nil or a
+// ValidationErrors listing every broken rule.
+func validateTelemetry(data Telemetry, rules *StatusRuleSet) error {
+	var errs ValidationErrors
+	add := func(field, code, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case data.VehicleID == "":
+		add("vehicle_id", ErrCodeRequired, "is required")
+	case !vehicleIDPattern.MatchString(data.VehicleID):
+		add("vehicle_id", ErrCodeInvalidFormat, "must be 1-64 letters, digits, '-' or '_'")
+	}
+
+	switch {
+	case data.Status == "":
+		add("status", ErrCodeRequired, "is required")
+	default:
+		if rule, ok := rules.Lookup(data.Status); !ok || rule.Internal {
+			add("status", ErrCodeUnknownValue, "%q is not a known status", data.Status)
+		}
+	}
+
+	if !knownSources[data.Source] {
+		add("source", ErrCodeUnknownValue, "%q is not a known source", data.Source)
+	}
+	// CBOR and Protobuf can carry NaN and Inf, which no comparison catches.
+	if !finite(data.Lat) || data.Lat < -90 || data.Lat > 90 {
+		add("lat", ErrCodeOutOfRange, "%v is outside -90..90", data.Lat)
+	}
+	if !finite(data.Long) || data.Long < -180 || data.Long > 180 {
+		add("long", ErrCodeOutOfRange, "%v is outside -180..180", data.Long)
+	}
+	if !finite(data.Confidence) || data.Confidence < 0 || data.Confidence > 1 {
+		add("confidence", ErrCodeOutOfRange, "%v is outside 0..1", data.Confidence)
+	}
+	if !finite(data.SpeedKmh) || data.SpeedKmh < 0 {
+		add("speed_kmh", ErrCodeOutOfRange, "%v is not a speed", data.SpeedKmh)
+	}
+	if data.HeartRate < 0 || data.HeartRate > MAX_HEART_RATE {
+		add("heart_rate", ErrCodeOutOfRange, "%d is outside 0..%d (0 = no reading)", data.HeartRate, MAX_HEART_RATE)
+	}
+	if data.Timestamp < 0 {
+		add("timestamp", ErrCodeOutOfRange, "must not be negative")
+	}
+	if data.AgeMs < 0 {
+		add("age_ms", ErrCodeOutOfRange, "must not be negative")
+	}
+	if data.UptimeMs < 0 {
+		add("uptime_ms", ErrCodeOutOfRange, "must not be negative")
+	}
+	if len(data.IMU) > MAX_IMU_SAMPLES {
+		add("imu", ErrCodeOutOfRange, "%d readings is more than %d", len(data.IMU), MAX_IMU_SAMPLES)
+	}
+	for i, r := range data.IMU {
+		// Report the first bad reading only; a broken sensor breaks them all.
+		field := fmt.Sprintf("imu[%d]", i)
+		if abs64(r.OffsetMs) > MAX_IMU_OFFSET_MS {
+			add(field+".t", ErrCodeOutOfRange, "offset must be within %d ms of timestamp", MAX_IMU_OFFSET_MS)
+			break
+		}
+		if !finite(r.Ax) || !finite(r.Ay) || !finite(r.Az) || !finite(r.Gx) || !finite(r.Gy) || !finite(r.Gz) {
+			add(field, ErrCodeOutOfRange, "readings must be finite numbers")
+			break
+		}
+		if math.Abs(r.Ax) > MAX_IMU_G || math.Abs(r.Ay) > MAX_IMU_G || math.Abs(r.Az) > MAX_IMU_G {
+			add(field, ErrCodeOutOfRange, "acceleration beyond %d g", MAX_IMU_G)
+			break
+		}
+		if math.Abs(r.Gx) > MAX_IMU_DPS || math.Abs(r.Gy) > MAX_IMU_DPS || math.Abs(r.Gz) > MAX_IMU_DPS {
+			add(field, ErrCodeOutOfRange, "rotation beyond %d degrees/s", MAX_IMU_DPS)
+			break
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateV1Telemetry(t *testing.T) {
+	data := Telemetry{VehicleID: "v-101", Status: "RASH DRIVING"}
+	assert.NoError(t, migrateTelemetry(&data))
+	assert.Equal(t, CURRENT_SCHEMA_VERSION, data.SchemaVersion)
+	assert.Equal(t, "harsh turn", data.Status)
+
+	newer := Telemetry{SchemaVersion: CURRENT_SCHEMA_VERSION + 1}
+	assert.Error(t, migrateTelemetry(&newer))
+}
+
+func TestValidateTelemetry(t *testing.T) {
+	rules := defaultRules(t)
+
+	valid := Telemetry{VehicleID: "v-101", Status: "drowsy", Lat: 28.7, Long: 77.1, Confidence: 0.95, HeartRate: 72}
+	assert.NoError(t, validateTelemetry(valid, rules))
+
+	invalid := Telemetry{VehicleID: "v-101", Status: "drowsey", Lat: 91, Confidence: 7, HeartRate: -1}
+	err := validateTelemetry(invalid, rules)
+	if assert.IsType(t, ValidationErrors{}, err) {
+		codes := map[string]string{}
+		for _, v := range err.(ValidationErrors) {
+			codes[v.Field] = v.Code
+		}
+		assert.Equal(t, map[string]string{
+			"status":     ErrCodeUnknownValue,
+			"lat":        ErrCodeOutOfRange,
+			"confidence": ErrCodeOutOfRange,
+			"heart_rate": ErrCodeOutOfRange,
+		}, codes)
+	}
+
+	internal := Telemetry{VehicleID: "v-101", Status: StatusHealthCritical}
+	assert.Error(t, validateTelemetry(internal, rules), "devices may not send backend-only statuses")
+}
+
+func TestValidateTelemetryNonFinite(t *testing.T) {
+	rules := defaultRules(t)
+	nan, inf := math.NaN(), math.Inf(1)
+
+	for field, sample := range map[string]Telemetry{
+		"lat":        {Lat: nan},
+		"long":       {Long: -inf},
+		"confidence": {Confidence: nan},
+		"speed_kmh":  {SpeedKmh: inf},
+		"imu[0]":     {IMU: []IMUSample{{Az: 1, Gy: nan}}},
+	} {
+		sample.VehicleID, sample.Status = "v-101", "safe"
+		err := validateTelemetry(sample, rules)
+		if assert.IsType(t, ValidationErrors{}, err, field) {
+			assert.Equal(t, field, err.(ValidationErrors)[0].Field)
+		}
+	}
+
+	// Binary encodings carry them through to validation.
+	for _, enc := range []TelemetryEncoding{EncodingCBOR, EncodingProtobuf} {
+		payload, err := EncodeTelemetry(Telemetry{VehicleID: "v-101", Status: "safe", Lat: nan, Long: 77.1}, enc)
+		assert.NoError(t, err)
+		_, reason, err := decodeRawMessage(RawMessage{Encoding: enc, Payload: payload}, rules)
+		assert.Error(t, err, enc)
+		assert.Equal(t, DeadLetterSchemaViolation, reason, enc)
+	}
+}
@@ -0,0 +1,462 @@
+// SafeRide device telemetry contract.
+//
+// This is the published Protobuf schema for the `Telemetry` payload that
+// devices send on `vehicles/{vehicle_id}/telemetry`. It mirrors the JSON
+// keys in backend/types.go; the CBOR encoding uses the same keys as JSON.
+//
+// Payload encodings are selected by topic suffix
+// (`vehicles/{id}/telemetry/json|cbor|proto|proto-batch`), by the HTTP
+// Content-Type (`application/json`, `application/cbor`,
+// `application/x-protobuf`, optionally with
+// `; messageType=saferide.v1.TelemetryBatch`), or, failing both, by sniffing
+// the first byte: Protobuf never starts like JSON (`{`, `[`) or CBOR (maps,
+// arrays, and the 0xD9D9F7 self-describe tag) as long as vehicle_id (or, if
+// the topic carries it, another low-numbered field) comes first.
+//
+// A Protobuf payload is a Telemetry unless the topic (`proto-batch`) or the
+// Content-Type (`messageType`) declares a TelemetryBatch. The backend never
+// guesses the message from the fields it contains.
+//
+// The Go types in backend/telemetrypb are generated from this file; run
+// `go generate` in backend after changing it.
+//
+// Field numbers are part of the contract: never renumber or reuse them.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        (unknown)
+// source: telemetry.proto
+
+package telemetrypb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Telemetry struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	VehicleId     string                 `protobuf:"bytes,1,opt,name=vehicle_id,json=vehicleId,proto3" json:"vehicle_id,omitempty"`
+	HeartRate     int32                  `protobuf:"varint,2,opt,name=heart_rate,json=heartRate,proto3" json:"heart_rate,omitempty"`
+	Timestamp     int64                  `protobuf:"varint,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"` // Unix seconds
+	Status        string                 `protobuf:"bytes,4,opt,name=status,proto3" json:"status,omitempty"`        // "safe", "safe_vehicle", "drowsy", "harsh turn", ...
+	Lat           float64                `protobuf:"fixed64,5,opt,name=lat,proto3" json:"lat,omitempty"`
+	Long          float64                `protobuf:"fixed64,6,opt,name=long,proto3" json:"long,omitempty"`
+	Confidence    float64                `protobuf:"fixed64,7,opt,name=confidence,proto3" json:"confidence,omitempty"`                            // 0.0 - 1.0
+	Source        string                 `protobuf:"bytes,8,opt,name=source,proto3" json:"source,omitempty"`                                      // "ai" or "iot"
+	TxHash        string                 `protobuf:"bytes,9,opt,name=tx_hash,json=txHash,proto3" json:"tx_hash,omitempty"`                        // Set by the backend; devices leave it empty
+	AgeMs         int64                  `protobuf:"varint,10,opt,name=age_ms,json=ageMs,proto3" json:"age_ms,omitempty"`                         // Sample taken this long before the message was sent
+	UptimeMs      int64                  `protobuf:"varint,11,opt,name=uptime_ms,json=uptimeMs,proto3" json:"uptime_ms,omitempty"`                // Monotonic ms since boot, for devices without a wall clock
+	DeviceId      string                 `protobuf:"bytes,12,opt,name=device_id,json=deviceId,proto3" json:"device_id,omitempty"`                 // Which device on the vehicle sent it; clock offsets are per device
+	MessageId     string                 `protobuf:"bytes,13,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`              // Unique per message; redeliveries repeat it
+	Seq           uint64                 `protobuf:"varint,14,opt,name=seq,proto3" json:"seq,omitempty"`                                          // Per-device counter starting at 1, for duplicate and gap detection
+	SchemaVersion uint32                 `protobuf:"varint,16,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"` // Contract version; absent = 1. See schema/README.md
+	Imu           []*IMUSample           `protobuf:"bytes,17,rep,name=imu,proto3" json:"imu,omitempty"`                                           // Raw motion data; the backend detects harsh driving from it
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Telemetry) Reset() {
+	*x = Telemetry{}
+	mi := &file_telemetry_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Telemetry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Telemetry) ProtoMessage() {}
+
+func (x *Telemetry) ProtoReflect() protoreflect.Message {
+	mi := &file_telemetry_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Telemetry.ProtoReflect.Descriptor instead.
+func (*Telemetry) Descriptor() ([]byte, []int) {
+	return file_telemetry_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Telemetry) GetVehicleId() string {
+	if x != nil {
+		return x.VehicleId
+	}
+	return ""
+}
+
+func (x *Telemetry) GetHeartRate() int32 {
+	if x != nil {
+		return x.HeartRate
+	}
+	return 0
+}
+
+func (x *Telemetry) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Telemetry) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *Telemetry) GetLat() float64 {
+	if x != nil {
+		return x.Lat
+	}
+	return 0
+}
+
+func (x *Telemetry) GetLong() float64 {
+	if x != nil {
+		return x.Long
+	}
+	return 0
+}
+
+func (x *Telemetry) GetConfidence() float64 {
+	if x != nil {
+		return x.Confidence
+	}
+	return 0
+}
+
+func (x *Telemetry) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *Telemetry) GetTxHash() string {
+	if x != nil {
+		return x.TxHash
+	}
+	return ""
+}
+
+func (x *Telemetry) GetAgeMs() int64 {
+	if x != nil {
+		return x.AgeMs
+	}
+	return 0
+}
+
+func (x *Telemetry) GetUptimeMs() int64 {
+	if x != nil {
+		return x.UptimeMs
+	}
+	return 0
+}
+
+func (x *Telemetry) GetDeviceId() string {
+	if x != nil {
+		return x.DeviceId
+	}
+	return ""
+}
+
+func (x *Telemetry) GetMessageId() string {
+	if x != nil {
+		return x.MessageId
+	}
+	return ""
+}
+
+func (x *Telemetry) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Telemetry) GetSchemaVersion() uint32 {
+	if x != nil {
+		return x.SchemaVersion
+	}
+	return 0
+}
+
+func (x *Telemetry) GetImu() []*IMUSample {
+	if x != nil {
+		return x.Imu
+	}
+	return nil
+}
+
+// One accelerometer/gyroscope reading, in the vehicle frame: x forward,
+// y left, z up.
+type IMUSample struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	T             int64                  `protobuf:"zigzag64,1,opt,name=t,proto3" json:"t,omitempty"`  // ms relative to the sample timestamp
+	Ax            float32                `protobuf:"fixed32,2,opt,name=ax,proto3" json:"ax,omitempty"` // g
+	Ay            float32                `protobuf:"fixed32,3,opt,name=ay,proto3" json:"ay,omitempty"`
+	Az            float32                `protobuf:"fixed32,4,opt,name=az,proto3" json:"az,omitempty"`
+	Gx            float32                `protobuf:"fixed32,5,opt,name=gx,proto3" json:"gx,omitempty"` // degrees/second
+	Gy            float32                `protobuf:"fixed32,6,opt,name=gy,proto3" json:"gy,omitempty"`
+	Gz            float32                `protobuf:"fixed32,7,opt,name=gz,proto3" json:"gz,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IMUSample) Reset() {
+	*x = IMUSample{}
+	mi := &file_telemetry_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IMUSample) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IMUSample) ProtoMessage() {}
+
+func (x *IMUSample) ProtoReflect() protoreflect.Message {
+	mi := &file_telemetry_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IMUSample.ProtoReflect.Descriptor instead.
+func (*IMUSample) Descriptor() ([]byte, []int) {
+	return file_telemetry_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *IMUSample) GetT() int64 {
+	if x != nil {
+		return x.T
+	}
+	return 0
+}
+
+func (x *IMUSample) GetAx() float32 {
+	if x != nil {
+		return x.Ax
+	}
+	return 0
+}
+
+func (x *IMUSample) GetAy() float32 {
+	if x != nil {
+		return x.Ay
+	}
+	return 0
+}
+
+func (x *IMUSample) GetAz() float32 {
+	if x != nil {
+		return x.Az
+	}
+	return 0
+}
+
+func (x *IMUSample) GetGx() float32 {
+	if x != nil {
+		return x.Gx
+	}
+	return 0
+}
+
+func (x *IMUSample) GetGy() float32 {
+	if x != nil {
+		return x.Gy
+	}
+	return 0
+}
+
+func (x *IMUSample) GetGz() float32 {
+	if x != nil {
+		return x.Gz
+	}
+	return 0
+}
+
+// Samples buffered while offline, sent in one message. Sample timestamps on
+// the device clock are corrected using sent_at; age_ms works without a clock.
+// Always declared as a batch (see above). Its field numbers are independent
+// of Telemetry's and keep their published values.
+type TelemetryBatch struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	VehicleId     string                 `protobuf:"bytes,13,opt,name=vehicle_id,json=vehicleId,proto3" json:"vehicle_id,omitempty"`
+	SentAt        int64                  `protobuf:"varint,14,opt,name=sent_at,json=sentAt,proto3" json:"sent_at,omitempty"` // Device clock when the batch was sent
+	Samples       []*Telemetry           `protobuf:"bytes,15,rep,name=samples,proto3" json:"samples,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TelemetryBatch) Reset() {
+	*x = TelemetryBatch{}
+	mi := &file_telemetry_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TelemetryBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TelemetryBatch) ProtoMessage() {}
+
+func (x *TelemetryBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_telemetry_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TelemetryBatch.ProtoReflect.Descriptor instead.
+func (*TelemetryBatch) Descriptor() ([]byte, []int) {
+	return file_telemetry_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *TelemetryBatch) GetVehicleId() string {
+	if x != nil {
+		return x.VehicleId
+	}
+	return ""
+}
+
+func (x *TelemetryBatch) GetSentAt() int64 {
+	if x != nil {
+		return x.SentAt
+	}
+	return 0
+}
+
+func (x *TelemetryBatch) GetSamples() []*Telemetry {
+	if x != nil {
+		return x.Samples
+	}
+	return nil
+}
+
+var File_telemetry_proto protoreflect.FileDescriptor
+
+const file_telemetry_proto_rawDesc = "" +
+	"\n" +
+	"\x0ftelemetry.proto\x12\vsaferide.v1\"\xcf\x03\n" +
+	"\tTelemetry\x12\x1d\n" +
+	"\n" +
+	"vehicle_id\x18\x01 \x01(\tR\tvehicleId\x12\x1d\n" +
+	"\n" +
+	"heart_rate\x18\x02 \x01(\x05R\theartRate\x12\x1c\n" +
+	"\ttimestamp\x18\x03 \x01(\x03R\ttimestamp\x12\x16\n" +
+	"\x06status\x18\x04 \x01(\tR\x06status\x12\x10\n" +
+	"\x03lat\x18\x05 \x01(\x01R\x03lat\x12\x12\n" +
+	"\x04long\x18\x06 \x01(\x01R\x04long\x12\x1e\n" +
+	"\n" +
+	"confidence\x18\a \x01(\x01R\n" +
+	"confidence\x12\x16\n" +
+	"\x06source\x18\b \x01(\tR\x06source\x12\x17\n" +
+	"\atx_hash\x18\t \x01(\tR\x06txHash\x12\x15\n" +
+	"\x06age_ms\x18\n" +
+	" \x01(\x03R\x05ageMs\x12\x1b\n" +
+	"\tuptime_ms\x18\v \x01(\x03R\buptimeMs\x12\x1b\n" +
+	"\tdevice_id\x18\f \x01(\tR\bdeviceId\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\r \x01(\tR\tmessageId\x12\x10\n" +
+	"\x03seq\x18\x0e \x01(\x04R\x03seq\x12%\n" +
+	"\x0eschema_version\x18\x10 \x01(\rR\rschemaVersion\x12(\n" +
+	"\x03imu\x18\x11 \x03(\v2\x16.saferide.v1.IMUSampleR\x03imuJ\x04\b\x0f\x10\x10\"y\n" +
+	"\tIMUSample\x12\f\n" +
+	"\x01t\x18\x01 \x01(\x12R\x01t\x12\x0e\n" +
+	"\x02ax\x18\x02 \x01(\x02R\x02ax\x12\x0e\n" +
+	"\x02ay\x18\x03 \x01(\x02R\x02ay\x12\x0e\n" +
+	"\x02az\x18\x04 \x01(\x02R\x02az\x12\x0e\n" +
+	"\x02gx\x18\x05 \x01(\x02R\x02gx\x12\x0e\n" +
+	"\x02gy\x18\x06 \x01(\x02R\x02gy\x12\x0e\n" +
+	"\x02gz\x18\a \x01(\x02R\x02gz\"z\n" +
+	"\x0eTelemetryBatch\x12\x1d\n" +
+	"\n" +
+	"vehicle_id\x18\r \x01(\tR\tvehicleId\x12\x17\n" +
+	"\asent_at\x18\x0e \x01(\x03R\x06sentAt\x120\n" +
+	"\asamples\x18\x0f \x03(\v2\x16.saferide.v1.TelemetryR\asamplesB\x1eZ\x1csaferide/backend/telemetrypbb\x06proto3"
+
+var (
+	file_telemetry_proto_rawDescOnce sync.Once
+	file_telemetry_proto_rawDescData []byte
+)
+
+func file_telemetry_proto_rawDescGZIP() []byte {
+	file_telemetry_proto_rawDescOnce.Do(func() {
+		file_telemetry_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_telemetry_proto_rawDesc), len(file_telemetry_proto_rawDesc)))
+	})
+	return file_telemetry_proto_rawDescData
+}
+
+var file_telemetry_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_telemetry_proto_goTypes = []any{
+	(*Telemetry)(nil),      // 0: saferide.v1.Telemetry
+	(*IMUSample)(nil),      // 1: saferide.v1.IMUSample
+	(*TelemetryBatch)(nil), // 2: saferide.v1.TelemetryBatch
+}
+var file_telemetry_proto_depIdxs = []int32{
+	1, // 0: saferide.v1.Telemetry.imu:type_name -> saferide.v1.IMUSample
+	0, // 1: saferide.v1.TelemetryBatch.samples:type_name -> saferide.v1.Telemetry
+	2, // [2:2] is the sub-list for method output_type
+	2, // [2:2] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_telemetry_proto_init() }
+func file_telemetry_proto_init() {
+	if File_telemetry_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_telemetry_proto_rawDesc), len(file_telemetry_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_telemetry_proto_goTypes,
+		DependencyIndexes: file_telemetry_proto_depIdxs,
+		MessageInfos:      file_telemetry_proto_msgTypes,
+	}.Build()
+	File_telemetry_proto = out.File
+	file_telemetry_proto_goTypes = nil
+	file_telemetry_proto_depIdxs = nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+// cleanVehicle deletes the keys the services keep for vehicleID: its live
+// state and every key with it as a whole ":" separated part, so cleaning
+// "test-risk" leaves "test-risk-hr" (and other tests' keys) alone.
+func cleanVehicle(t *testing.T, rdb *redis.Client, vehicleID string) {
+	t.Helper()
+	ctx := context.Background()
+	keys, err := rdb.Keys(ctx, "*"+vehicleID+"*").Result()
+	if err != nil {
+		t.Fatalf("listing keys of %s: %v", vehicleID, err)
+	}
+	var own []string
+	for _, key := range keys {
+		for _, part := range strings.Split(key, ":") {
+			if part == vehicleID {
+				own = append(own, key)
+				break
+			}
+		}
+	}
+	if len(own) > 0 {
+		if err := rdb.Del(ctx, own...).Err(); err != nil {
+			t.Fatalf("deleting keys of %s: %v", vehicleID, err)
+		}
+	}
+}
+
+// testStatusRules loads status_rules.json like the server does.
+func testStatusRules(t *testing.T) *StatusRuleEngine {
+	t.Helper()
+	engine, err := NewStatusRuleEngine("status_rules.json")
+	if err != nil {
+		t.Fatalf("status_rules.json: %v", err)
+	}
+	return engine
+}
+
+// defaultRules parses the built-in status rules.
+func defaultRules(t *testing.T) *StatusRuleSet {
+	t.Helper()
+	rules, err := ParseStatusRules(defaultStatusRules)
+	if err != nil {
+		t.Fatalf("default status rules: %v", err)
+	}
+	return rules
+}
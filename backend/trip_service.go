@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+const (
+	TripActive    = "active"
+	TripCompleted = "completed"
+)
+
+// activeTripsKey holds the IDs of all active trips, so trips of vehicles
+// that went quiet can still be completed.
+const activeTripsKey = "trips_active"
+
+// tripPenalty is what one incident takes off a trip's safety score, by severity.
+var tripPenalty = map[string]float64{"none": 0, "low": 2, "medium": 5, "high": 10, "critical": 30}
+
+// Trip is one drive, from the vehicle starting to move until it stands still
+// for TRIP_STOP_SECONDS or stops sending for TRIP_GAP seconds.
+type Trip struct {
+	ID             string         `json:"id"`
+	VehicleID      string         `json:"vehicle_id"`
+	State          string         `json:"state"` // "active" or "completed"
+	StartTime      int64          `json:"start_time"`
+	EndTime        int64          `json:"end_time"` // Last sample so far while active
+	DurationSec    int64          `json:"duration_sec"`
+	StartLat       float64        `json:"start_lat,omitempty"`
+	StartLong      float64        `json:"start_long,omitempty"`
+	EndLat         float64        `json:"end_lat,omitempty"`
+	EndLong        float64        `json:"end_long,omitempty"`
+	DistanceKm     float64        `json:"distance_km"`
+	MaxSpeedKmh    float64        `json:"max_speed_kmh,omitempty"`
+	AvgHeartRate   float64        `json:"avg_heart_rate,omitempty"` // Over valid readings only
+	IncidentCounts map[string]int `json:"incident_counts"`          // Incidents opened during the trip, by type
+	SafetyScore    float64        `json:"safety_score"`             // 100 minus incident penalties by severity
+	SampleCount    int            `json:"sample_count"`
+	UpdatedAt      int64          `json:"updated_at"` // Server time of the last change
+
+	StartOdometerKm float64 `json:"start_odometer_km"` // GPS odometer when the trip started
+	LastMovingAt    int64   `json:"last_moving_at,omitempty"`
+	HeartRateSum    int64   `json:"heart_rate_sum,omitempty"`
+	HeartRateCount  int64   `json:"heart_rate_count,omitempty"`
+}
+
+// TripFilter narrows a trip listing. Zero values match everything.
+type TripFilter struct {
+	From  int64 // Start time, inclusive
+	To    int64 // Start time, inclusive
+	Limit int
+}
+
+// TripService segments a vehicle's telemetry into trips and keeps a summary
+// of each: route ends, distance, incidents, heart rate and a safety score.
+type TripService struct {
+	redisClient *redis.Client
+	ctx         context.Context
+}
+
+// NewTripService creates a new TripService instance.
+func NewTripService(redisClient *redis.Client, ctx context.Context) *TripService {
+	return &TripService{
+		redisClient: redisClient,
+		ctx:         ctx,
+	}
+}
+
+// Observe folds one processed sample into the vehicle's trip. opened is the
+// incident the sample opened, if any; odometerKm is the vehicle's GPS
+// odometer after the sample. Vehicles without GPS are split by message gaps
+// alone.
+func (s *TripService) Observe(data Telemetry, rule StatusRule, opened *Incident, odometerKm float64) {
+	trip, ok := s.Active(data.VehicleID)
+	if ok && data.Timestamp-trip.EndTime > TRIP_GAP {
+		s.complete(trip)
+		ok = false
+	}
+
+	hasFix := data.Lat != 0 || data.Long != 0
+	moving := data.SpeedKmh >= TRIP_MOVING_KMH
+	if !ok {
+		if hasFix && !moving {
+			return // Parked
+		}
+		trip = Trip{
+			ID:              newTripID(),
+			VehicleID:       data.VehicleID,
+			State:           TripActive,
+			StartTime:       data.Timestamp,
+			EndTime:         data.Timestamp,
+			StartLat:        data.Lat,
+			StartLong:       data.Long,
+			IncidentCounts:  map[string]int{},
+			SafetyScore:     100,
+			StartOdometerKm: odometerKm,
+		}
+		s.index(trip)
+		log.Printf("🚗 Trip started: %s (Vehicle: %s)", trip.ID, trip.VehicleID)
+	}
+
+	trip.EndTime = max(trip.EndTime, data.Timestamp)
+	trip.SampleCount++
+	if hasFix {
+		if trip.StartLat == 0 && trip.StartLong == 0 {
+			trip.StartLat, trip.StartLong = data.Lat, data.Long
+		}
+		trip.EndLat, trip.EndLong = data.Lat, data.Long
+		trip.DistanceKm = math.Round(math.Max(0, odometerKm-trip.StartOdometerKm)*1000) / 1000
+	}
+	if moving {
+		trip.LastMovingAt = max(trip.LastMovingAt, data.Timestamp)
+	}
+	trip.MaxSpeedKmh = math.Max(trip.MaxSpeedKmh, data.SpeedKmh)
+	if data.HeartRate > 0 && data.BiometricState != BiometricSensorFault {
+		trip.HeartRateSum += int64(data.HeartRate)
+		trip.HeartRateCount++
+	}
+	if opened != nil {
+		trip.IncidentCounts[opened.Type]++
+		trip.SafetyScore = math.Max(0, trip.SafetyScore-tripPenalty[rule.Severity])
+	}
+	trip.DurationSec = trip.EndTime - trip.StartTime
+	if trip.HeartRateCount > 0 {
+		trip.AvgHeartRate = math.Round(float64(trip.HeartRateSum)/float64(trip.HeartRateCount)*10) / 10
+	}
+
+	// Standing still long enough ends the trip where the vehicle stopped.
+	if hasFix && !moving && trip.LastMovingAt != 0 && data.Timestamp-trip.LastMovingAt >= TRIP_STOP_SECONDS {
+		trip.EndTime = trip.LastMovingAt
+		s.complete(trip)
+		return
+	}
+	s.save(trip)
+}
+
+// CompleteStale completes active trips that haven't been updated for
+// TRIP_GAP seconds of server time, e.g. because the vehicle was switched off.
+func (s *TripService) CompleteStale() {
+	ids, err := s.redisClient.SMembers(s.ctx, activeTripsKey).Result()
+	if err != nil {
+		log.Printf("Error getting active trips: %v", err)
+		return
+	}
+	now := time.Now().Unix()
+	for _, id := range ids {
+		trip, ok := s.Get(id)
+		if !ok {
+			s.redisClient.SRem(s.ctx, activeTripsKey, id)
+			continue
+		}
+		if trip.State == TripActive && now-trip.UpdatedAt > TRIP_GAP {
+			s.complete(trip)
+		}
+	}
+}
+
+// WatchForStale runs CompleteStale every interval.
+func (s *TripService) WatchForStale(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.CompleteStale()
+	}
+}
+
+// Active returns the vehicle's active trip, if any.
+func (s *TripService) Active(vehicleID string) (Trip, bool) {
+	id, err := s.redisClient.Get(s.ctx, fmt.Sprintf("trip_active:%s", vehicleID)).Result()
+	if err != nil {
+		return Trip{}, false
+	}
+	trip, ok := s.Get(id)
+	return trip, ok && trip.State == TripActive
+}
+
+// Get returns one trip.
+func (s *TripService) Get(id string) (Trip, bool) {
+	var trip Trip
+	val, err := s.redisClient.Get(s.ctx, fmt.Sprintf("trip:%s", id)).Bytes()
+	if err != nil || json.Unmarshal(val, &trip) != nil {
+		return trip, false
+	}
+	return trip, true
+}
+
+// List returns a vehicle's trips, newest first, and how many it has in total.
+func (s *TripService) List(vehicleID string, filter TripFilter) ([]Trip, int64, error) {
+	key := fmt.Sprintf("trips:%s", vehicleID)
+	maxStart := "+inf"
+	if filter.To != 0 {
+		maxStart = strconv.FormatInt(filter.To, 10)
+	}
+	minStart := "-inf"
+	if filter.From != 0 {
+		minStart = strconv.FormatInt(filter.From, 10)
+	}
+	ids, err := s.redisClient.ZRevRangeByScore(s.ctx, key, &redis.ZRangeBy{
+		Max: maxStart, Min: minStart, Count: int64(filter.Limit),
+	}).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := s.redisClient.ZCard(s.ctx, key).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	trips := []Trip{}
+	for _, id := range ids {
+		if trip, ok := s.Get(id); ok {
+			trips = append(trips, trip)
+		}
+	}
+	return trips, total, nil
+}
+
+// complete marks the trip completed. Removing it from the active set first
+// makes sure it is only completed once.
+func (s *TripService) complete(trip Trip) {
+	removed, err := s.redisClient.SRem(s.ctx, activeTripsKey, trip.ID).Result()
+	if err != nil || removed == 0 {
+		return // Already completed elsewhere
+	}
+	activeKey := fmt.Sprintf("trip_active:%s", trip.VehicleID)
+	if id, _ := s.redisClient.Get(s.ctx, activeKey).Result(); id == trip.ID {
+		s.redisClient.Del(s.ctx, activeKey)
+	}
+
+	trip.State = TripCompleted
+	trip.DurationSec = trip.EndTime - trip.StartTime
+	s.save(trip)
+	log.Printf("🏁 Trip completed: %s (Vehicle: %s, %ds, %.1f km, score %.0f)", trip.ID, trip.VehicleID, trip.DurationSec, trip.DistanceKm, trip.SafetyScore)
+}
+
+func (s *TripService) index(trip Trip) {
+	tripsKey := fmt.Sprintf("trips:%s", trip.VehicleID)
+	pipe := s.redisClient.TxPipeline()
+	pipe.Set(s.ctx, fmt.Sprintf("trip_active:%s", trip.VehicleID), trip.ID, 0)
+	pipe.SAdd(s.ctx, activeTripsKey, trip.ID)
+	pipe.ZAdd(s.ctx, tripsKey, &redis.Z{Score: float64(trip.StartTime), Member: trip.ID})
+	pipe.ZRemRangeByScore(s.ctx, tripsKey, "-inf", strconv.FormatInt(trip.StartTime-TRIP_RETENTION, 10))
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Failed to index trip %s: %v", trip.ID, err)
+	}
+}
+
+func (s *TripService) save(trip Trip) {
+	trip.UpdatedAt = time.Now().Unix()
+	tripJSON, _ := json.Marshal(trip)
+	err := s.redisClient.Set(s.ctx, fmt.Sprintf("trip:%s", trip.ID), tripJSON, TRIP_RETENTION*time.Second).Err()
+	if err != nil {
+		log.Printf("Failed to save trip %s: %v", trip.ID, err)
+	}
+}
+
+func newTripID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return "trip_" + hex.EncodeToString(buf)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestTripServiceSegments(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx := context.Background()
+	rdb.Del(ctx, "trip_active:test-trip", "trips:test-trip")
+	trips := NewTripService(rdb, ctx)
+
+	rules := defaultRules(t)
+	safe, _ := rules.Lookup("safe")
+	braking, _ := rules.Lookup("hard braking")
+	sample := func(ts int64, speed float64, hr int) Telemetry {
+		return Telemetry{VehicleID: "test-trip", Timestamp: ts, Status: "safe", Lat: 28.7, Long: 77.1, SpeedKmh: speed, HeartRate: hr}
+	}
+
+	trips.Observe(sample(1000, 0, 70), safe, nil, 10)
+	_, ok := trips.Active("test-trip")
+	assert.False(t, ok, "parked")
+
+	trips.Observe(sample(1010, 40, 70), safe, nil, 10)
+	trips.Observe(sample(1020, 50, 80), safe, nil, 10.2)
+	event := sample(1030, 30, 0)
+	event.Status = "hard braking"
+	trips.Observe(event, braking, &Incident{Type: "hard braking"}, 10.3)
+	trips.Observe(sample(1040, 0, 0), safe, nil, 10.3)
+
+	trip, ok := trips.Active("test-trip")
+	if assert.True(t, ok) {
+		assert.Equal(t, int64(1010), trip.StartTime)
+		assert.InDelta(t, 0.3, trip.DistanceKm, 0.001)
+		assert.Equal(t, 75.0, trip.AvgHeartRate)
+		assert.Equal(t, 50.0, trip.MaxSpeedKmh)
+		assert.Equal(t, map[string]int{"hard braking": 1}, trip.IncidentCounts)
+		assert.Equal(t, 95.0, trip.SafetyScore)
+	}
+
+	// Standing still for TRIP_STOP_SECONDS ends it where the vehicle stopped.
+	trips.Observe(sample(1030+TRIP_STOP_SECONDS, 0, 0), safe, nil, 10.3)
+	_, ok = trips.Active("test-trip")
+	assert.False(t, ok)
+	completed, ok := trips.Get(trip.ID)
+	if assert.True(t, ok) {
+		assert.Equal(t, TripCompleted, completed.State)
+		assert.Equal(t, int64(1030), completed.EndTime)
+		assert.Equal(t, int64(20), completed.DurationSec)
+	}
+
+	// A vehicle without GPS is split by message gaps.
+	noFix := Telemetry{VehicleID: "test-trip", Timestamp: 5000, Status: "safe"}
+	trips.Observe(noFix, safe, nil, 0)
+	noFix.Timestamp += TRIP_GAP + 1
+	trips.Observe(noFix, safe, nil, 0)
+
+	list, total, err := trips.List("test-trip", TripFilter{Limit: 50})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), total)
+	if assert.Len(t, list, 3) {
+		assert.Equal(t, TripActive, list[0].State)
+		assert.Equal(t, TripCompleted, list[1].State, "completed by the gap")
+	}
+}
@@ -6,12 +6,173 @@ type Telemetry struct {
 	VehicleID  string  `json:"vehicle_id"`
 	HeartRate  int     `json:"heart_rate"` // New field for Health Stats
 	Timestamp  int64   `json:"timestamp"`
-	Status     string  `json:"status"` // "safe", "fatigue", "distracted", "rash driving", "stress"
+	Status     string  `json:"status"`               // "safe", "fatigue", "drowsy", "harsh turn", ... (see status_rules.json)
+	RawStatus  string  `json:"raw_status,omitempty"` // What the device sent, when the detector stage held Status back
+	Pending    bool    `json:"pending,omitempty"`    // Detector held back an unsafe reading: neither an incident nor verified safe time
 	Lat        float64 `json:"lat"`
 	Long       float64 `json:"long"`
 	Confidence float64 `json:"confidence"`
-	Source     string  `json:"source,omitempty"`  // "ai" or "iot"
-	TxHash     string  `json:"tx_hash,omitempty"` // The Solana Proof
+	Source     string  `json:"source,omitempty"`     // "ai" or "iot"
+	TxHash     string  `json:"tx_hash,omitempty"`    // The Solana Proof
+	AgeMs      int64   `json:"age_ms,omitempty"`     // Sample taken this long before the message was sent (buffered data)
+	MessageID  string  `json:"message_id,omitempty"` // Unique per message; QoS 1 redeliveries repeat it
+	Seq        uint64  `json:"seq,omitempty"`        // Per-device counter, for duplicate and gap detection
+
+	SchemaVersion int `json:"schema_version,omitempty"` // Contract version; absent = 1 (see telemetry_schema.go)
+
+	// Clock fields: Timestamp above is the corrected event time.
+	DeviceID        string `json:"device_id,omitempty"`        // Which device on the vehicle sent it (clocks are per device)
+	UptimeMs        int64  `json:"uptime_ms,omitempty"`        // Monotonic ms since boot (Pico ticks_ms)
+	DeviceTimestamp int64  `json:"device_timestamp,omitempty"` // Timestamp as reported by the device clock
+	ReceivedAt      int64  `json:"received_at,omitempty"`      // Server time when the message arrived
+	ClockSkewMs     int64  `json:"clock_skew_ms,omitempty"`    // Estimated device clock offset that was applied
+	ClockSuspect    bool   `json:"clock_suspect,omitempty"`    // Skew is implausible; treat Timestamp with care
+
+	BiometricState string  `json:"biometric_state,omitempty"` // HR verdict: normal, tachycardia, sensor_fault, ... (see biometric_service.go)
+	RiskScore      float64 `json:"risk_score,omitempty"`      // Fused risk index after this sample, 0-100 (see risk_service.go)
+
+	// Raw motion data, consumed by the dynamics detector and not stored.
+	IMU   []IMUSample `json:"imu,omitempty"`
+	PeakG float64     `json:"peak_g,omitempty"` // Filtered peak of a detected dynamics event
+
+	// Derived from consecutive GPS fixes (see gps_service.go).
+	SpeedKmh      float64 `json:"speed_kmh,omitempty"`
+	SpeedLimitKmh float64 `json:"speed_limit_kmh,omitempty"` // Limit in force, on speeding samples
+
+	// Geofence events (see geofence_service.go).
+	GeofenceID string `json:"geofence_id,omitempty"`
+	Violation  string `json:"violation,omitempty"` // "no_entry" or "curfew"; driving time: "continuous", "daily" or "weekly"
+
+	Motion string `json:"motion,omitempty"` // "moving", "idling" or "parked" (see motion_service.go)
+}
+
+// IMUSample is one accelerometer/gyroscope reading in the vehicle frame:
+// x forward, y left, z up. Acceleration is in g, rotation in degrees/second.
+type IMUSample struct {
+	OffsetMs int64   `json:"t"` // Relative to the sample's timestamp
+	Ax       float64 `json:"ax"`
+	Ay       float64 `json:"ay"`
+	Az       float64 `json:"az"`
+	Gx       float64 `json:"gx"`
+	Gy       float64 `json:"gy"`
+	Gz       float64 `json:"gz"`
+}
+
+// TelemetryBatch carries samples a device buffered while offline. Sample
+// timestamps may be absolute, on the device clock (corrected with SentAt),
+// or relative via AgeMs.
+type TelemetryBatch struct {
+	VehicleID string      `json:"vehicle_id"`
+	SentAt    int64       `json:"sent_at,omitempty"` // Device clock when the batch was sent
+	Samples   []Telemetry `json:"samples"`
+}
+
+// SequenceGap is a range of sequence numbers a device sent that never
+// arrived, so reports can tell "no incidents" from "data was lost".
+type SequenceGap struct {
+	DeviceID   string `json:"device_id"`
+	From       uint64 `json:"from"`
+	To         uint64 `json:"to"`
+	DetectedAt int64  `json:"detected_at"`
+}
+
+// IngestResult summarizes what happened to a batch.
+type IngestResult struct {
+	Accepted   int `json:"accepted"`
+	Duplicates int `json:"duplicates"`
+	Derived    int `json:"derived,omitempty"` // Events detected from raw IMU or GPS data
+}
+
+// RawMessage is a telemetry payload as it arrived, before decoding.
+type RawMessage struct {
+	Transport string            // "mqtt", "http" or "replay"
+	Topic     string            // MQTT topic or HTTP path
+	Encoding  TelemetryEncoding // Empty: sniff from the payload
+	Payload   []byte
+}
+
+// DeadLetter is a rejected message kept for inspection and replay.
+type DeadLetter struct {
+	ID          string `json:"id"`
+	Transport   string `json:"transport"`
+	Topic       string `json:"topic"`
+	Encoding    string `json:"encoding"`
+	Reason      string `json:"reason"` // parse_error, schema_violation, auth_failure, ...
+	Error       string `json:"error"`
+	Payload     []byte `json:"payload"`                // Base64 in JSON
+	PayloadText string `json:"payload_text,omitempty"` // Same payload, when it is valid UTF-8
+	ReceivedAt  int64  `json:"received_at"`
+}
+
+// Incident is a burst of samples with the same non-safe status, e.g. a
+// 20-second drowsy episode instead of 40 raw events.
+type Incident struct {
+	ID             string           `json:"id"`
+	VehicleID      string           `json:"vehicle_id"`
+	Type           string           `json:"type"` // Normalized status
+	Category       string           `json:"category"`
+	Severity       string           `json:"severity"`
+	State          string           `json:"state"` // "open" or "closed"
+	StartTime      int64            `json:"start_time"`
+	EndTime        int64            `json:"end_time"` // Last sample so far while open
+	DurationSec    int64            `json:"duration_sec"`
+	PeakConfidence float64          `json:"peak_confidence"`
+	PeakHeartRate  int              `json:"peak_heart_rate,omitempty"`
+	PeakG          float64          `json:"peak_g,omitempty"`
+	PeakSpeedKmh   float64          `json:"peak_speed_kmh,omitempty"`
+	SampleCount    int              `json:"sample_count"`
+	Samples        []IncidentSample `json:"samples"` // First MAX_INCIDENT_SAMPLES only
+	TxHash         string           `json:"tx_hash,omitempty"`
+	AttestedOnOpen bool             `json:"attested_on_open,omitempty"` // Critical: attested as it opened, not again on close
+	UpdatedAt      int64            `json:"updated_at"`                 // Server time of the last change
+}
+
+// IncidentSample links an incident to one of its telemetry samples.
+type IncidentSample struct {
+	Timestamp  int64   `json:"timestamp"`
+	Confidence float64 `json:"confidence"`
+	HeartRate  int     `json:"heart_rate,omitempty"`
+	MessageID  string  `json:"message_id,omitempty"`
+	Seq        uint64  `json:"seq,omitempty"`
+}
+
+// Emergency is the "are you OK" workflow started by an emergency incident
+// such as a crash. Unless cancelled before Deadline, the vehicle's emergency
+// contacts are alerted.
+type Emergency struct {
+	ID          string             `json:"id"`
+	VehicleID   string             `json:"vehicle_id"`
+	IncidentID  string             `json:"incident_id"`
+	Type        string             `json:"type"`  // Status that started it, e.g. "CRASH"
+	State       string             `json:"state"` // "awaiting_response", "cancelled" or "escalated"
+	Timestamp   int64              `json:"timestamp"`
+	Lat         float64            `json:"lat"`
+	Long        float64            `json:"long"`
+	PeakG       float64            `json:"peak_g,omitempty"`
+	HeartRate   int                `json:"heart_rate,omitempty"`
+	CreatedAt   int64              `json:"created_at"` // Server time
+	Deadline    int64              `json:"deadline"`   // Server time the contacts are alerted at
+	EscalatedAt int64              `json:"escalated_at,omitempty"`
+	CancelledAt int64              `json:"cancelled_at,omitempty"`
+	CancelledBy string             `json:"cancelled_by,omitempty"` // "device" or "admin"
+	Contacts    []EmergencyContact `json:"contacts,omitempty"`     // Who was alerted
+}
+
+// EmergencyContact is someone to alert when a driver doesn't respond.
+type EmergencyContact struct {
+	Name  string `json:"name"`
+	Phone string `json:"phone,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// DownlinkMessage is sent to a vehicle on vehicles/{id}/downlink.
+type DownlinkMessage struct {
+	Type        string `json:"type"` // "are_you_ok", "emergency_escalated", "emergency_cancelled" or "break_reminder"
+	EmergencyID string `json:"emergency_id,omitempty"`
+	Status      string `json:"status,omitempty"`
+	TimeoutSec  int64  `json:"timeout_sec,omitempty"` // Time left to answer, or until the break is due
+	Message     string `json:"message,omitempty"`     // Text to show the driver
+	Timestamp   int64  `json:"timestamp"`
 }
 
 type User struct {
@@ -29,4 +190,5 @@ type LoginRequest struct {
 type RedeemRequest struct {
 	VehicleID string `json:"vehicle_id"`
 	Points    int    `json:"points"`
+	Reward    string `json:"reward,omitempty"` // What the points are spent on
 }
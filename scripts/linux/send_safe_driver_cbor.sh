@@ -0,0 +1,6 @@
+#!/bin/bash
+echo "Sending SAFE DRIVER status to SafeRide (CBOR)..."
+echo "{\"vehicle_id\": \"v-101\", \"status\": \"safe\", \"lat\": 28.7041, \"long\": 77.1025, \"confidence\": 0.99, \"source\": \"ai\"}" \
+  | docker exec -i saferide-backend ./saferide-engine encode cbor \
+  | docker exec -i saferide-mqtt mosquitto_pub -t vehicles/v-101/telemetry/cbor -s
+echo "Done!"